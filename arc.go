@@ -0,0 +1,519 @@
+package rfc2822
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errARCChainFailed = errors.New("ARC chain already failed, it can't be sealed again")
+var errARCTooLong = errors.New("ARC chain has the maximum number of sets")
+
+// ARC chain validation states, the cv= tag of ARC-Seal (RFC 8617 section
+// 4.1.3)
+const (
+	ARCNone = "none"
+	ARCPass = "pass"
+	ARCFail = "fail"
+)
+
+// Most ARC sets a chain may have, RFC 8617 section 4.2.1
+const maxARCInstances = 50
+
+/*
+	ARCSeal is an ARC-Seal field, RFC 8617 section 4.1.3.
+
+	Example:
+	ARC-Seal: i=1; a=rsa-sha256; t=1603946533; cv=none; d=google.com;
+		s=arc-20160816; b=BVpkSaAh...
+	will become
+	{
+		Instance: 1
+		Algorithm: rsa-sha256
+		ChainValidation: none
+		Domain: google.com
+		Selector: arc-20160816
+		Timestamp: 2020-10-29 04:42:13 +0000 UTC
+		...
+	}
+*/
+type ARCSeal struct {
+	Instance int
+	// rsa-sha256 or ed25519-sha256
+	Algorithm string
+	// Decoded b= tag
+	Signature []byte
+	// ARCNone, ARCPass or ARCFail, the state of the chain when sealed
+	ChainValidation string
+	Domain          string
+	Selector        string
+	// Zero when not given
+	Timestamp time.Time
+	// All the tags, whitespace removed from base64 values
+	Tags map[string]string
+}
+
+/*
+	ARCSet is the ARC-Seal, ARC-Message-Signature and
+	ARC-Authentication-Results fields sharing an instance number, added by
+	one intermediary (RFC 8617 section 4.1).
+	A parsed value is nil when its field is missing or could not be parsed
+*/
+type ARCSet struct {
+	Instance int
+	Seal     *ARCSeal
+	// Parsed like a DKIM-Signature, Version and Identifier are not set
+	MessageSignature *DKIMSignature
+	AuthResults      *AuthResults
+
+	SealField             HeaderField
+	MessageSignatureField HeaderField
+	AuthResultsField      HeaderField
+}
+
+// ARCResult is the outcome of validating the ARC chain of a message
+type ARCResult struct {
+	// ARCNone when there are no ARC sets, otherwise ARCPass or ARCFail
+	ChainValidation string
+	// Oldest first
+	Sets []ARCSet
+	// Why the chain failed
+	Err error
+}
+
+// AuthResult returns the result as the arc method of an
+// Authentication-Results field
+func (r ARCResult) AuthResult() AuthResult {
+	res := AuthResult{Method: "arc", Result: r.ChainValidation, Properties: map[string]string{}}
+	if r.Err != nil {
+		res.Reason = r.Err.Error()
+	}
+	return res
+}
+
+/*
+	ParseARC groups the ARC fields of a message by instance, oldest first.
+	All the sets that were found are returned, along with an error for the
+	first malformed field or incomplete set
+*/
+func ParseARC(n *Node) ([]ARCSet, error) {
+	return parseARCSets(n.RawHeaders)
+}
+
+func parseARCSets(fields []HeaderField) ([]ARCSet, error) {
+	byInstance := map[int]*ARCSet{}
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for _, f := range fields {
+		name := strings.ToLower(f.Name)
+		switch name {
+		case "arc-seal", "arc-message-signature", "arc-authentication-results":
+		default:
+			continue
+		}
+
+		value := string(f.Value)
+		instance, err := arcInstance(name, value)
+		if err != nil {
+			fail(fmt.Errorf("%v: %v", f.Name, err))
+			continue
+		}
+
+		set, ok := byInstance[instance]
+		if !ok {
+			set = &ARCSet{Instance: instance}
+			byInstance[instance] = set
+		}
+
+		switch name {
+		case "arc-seal":
+			if set.SealField.Raw != nil {
+				fail(fmt.Errorf("Duplicate ARC-Seal with i=%v", instance))
+				continue
+			}
+			set.SealField = f
+			if set.Seal, err = ParseARCSeal(value); err != nil {
+				fail(fmt.Errorf("ARC-Seal i=%v: %v", instance, err))
+			}
+		case "arc-message-signature":
+			if set.MessageSignatureField.Raw != nil {
+				fail(fmt.Errorf("Duplicate ARC-Message-Signature with i=%v", instance))
+				continue
+			}
+			set.MessageSignatureField = f
+			if set.MessageSignature, err = parseARCMessageSignature(value); err != nil {
+				fail(fmt.Errorf("ARC-Message-Signature i=%v: %v", instance, err))
+			}
+		case "arc-authentication-results":
+			if set.AuthResultsField.Raw != nil {
+				fail(fmt.Errorf("Duplicate ARC-Authentication-Results with i=%v", instance))
+				continue
+			}
+			set.AuthResultsField = f
+			// arcInstance found the ';' after the i= tag
+			ar, err := ParseAuthResults(value[strings.IndexByte(value, ';')+1:])
+			if err != nil {
+				fail(fmt.Errorf("ARC-Authentication-Results i=%v: %v", instance, err))
+			}
+			set.AuthResults = &ar
+		}
+	}
+
+	sets := make([]ARCSet, 0, len(byInstance))
+	for _, set := range byInstance {
+		sets = append(sets, *set)
+	}
+	sort.Slice(sets, func(i, j int) bool {
+		return sets[i].Instance < sets[j].Instance
+	})
+
+	for i, set := range sets {
+		if set.Instance != i+1 {
+			fail(fmt.Errorf("ARC set i=%v is missing", i+1))
+			break
+		}
+		if set.SealField.Raw == nil || set.MessageSignatureField.Raw == nil || set.AuthResultsField.Raw == nil {
+			fail(fmt.Errorf("ARC set i=%v is incomplete", set.Instance))
+			break
+		}
+	}
+
+	return sets, firstErr
+}
+
+// arcInstance reads the i= tag, which comes first in
+// ARC-Authentication-Results
+func arcInstance(name, value string) (int, error) {
+	var i string
+	if name == "arc-authentication-results" {
+		semicolon := strings.IndexByte(value, ';')
+		if semicolon < 0 {
+			return 0, fmt.Errorf("Missing i= tag")
+		}
+		tag := value[:semicolon]
+		eq := strings.IndexByte(tag, '=')
+		if eq < 0 || strings.TrimSpace(tag[:eq]) != "i" {
+			return 0, fmt.Errorf("Missing i= tag")
+		}
+		i = tag[eq+1:]
+	} else {
+		tags, err := parseTagList(value)
+		if err != nil {
+			return 0, err
+		}
+		i = tags["i"]
+	}
+
+	instance, err := strconv.Atoi(strings.TrimSpace(i))
+	if err != nil || instance < 1 || instance > maxARCInstances {
+		return 0, fmt.Errorf("Bad i= tag %q", i)
+	}
+	return instance, nil
+}
+
+// ParseARCSeal parses the value of an ARC-Seal field
+func ParseARCSeal(value string) (*ARCSeal, error) {
+	tags, err := parseTagList(value)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range []string{"i", "a", "b", "cv", "d", "s"} {
+		if _, ok := tags[t]; !ok {
+			return nil, fmt.Errorf("Missing %v= tag in seal", t)
+		}
+	}
+	// The seal covers the ARC sets, not header fields of choice
+	if _, ok := tags["h"]; ok {
+		return nil, fmt.Errorf("h= tag is not allowed in a seal")
+	}
+
+	seal := &ARCSeal{
+		Algorithm:       strings.ToLower(tags["a"]),
+		ChainValidation: strings.ToLower(tags["cv"]),
+		Domain:          strings.TrimSuffix(strings.ToLower(tags["d"]), "."),
+		Selector:        tags["s"],
+		Tags:            tags,
+	}
+	if seal.Instance, err = strconv.Atoi(tags["i"]); err != nil {
+		return nil, fmt.Errorf("Bad i= tag %v", tags["i"])
+	}
+	if err := checkDKIMAlgorithm(seal.Algorithm); err != nil {
+		return nil, err
+	}
+	switch seal.ChainValidation {
+	case ARCNone, ARCPass, ARCFail:
+	default:
+		return nil, fmt.Errorf("Unknown cv= value %v", tags["cv"])
+	}
+	if seal.Signature, err = base64.StdEncoding.DecodeString(tags["b"]); err != nil {
+		return nil, fmt.Errorf("Bad b= tag: %v", err)
+	}
+	if t, ok := tags["t"]; ok {
+		sec, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad t= tag %v", t)
+		}
+		seal.Timestamp = time.Unix(sec, 0)
+	}
+
+	return seal, nil
+}
+
+func parseARCMessageSignature(value string) (*DKIMSignature, error) {
+	tags, err := parseTagList(value)
+	if err != nil {
+		return nil, err
+	}
+	return signatureFromTags(tags)
+}
+
+/*
+	VerifyARC validates the ARC chain of a message, RFC 8617 section 5.2.
+	The structure of the chain, the newest ARC-Message-Signature and every
+	ARC-Seal are checked. Like VerifyDKIM the node must have been parsed
+	with WithRawRetained, an error is returned only when the raw message is
+	missing. A nil resolver uses DNSResolver
+*/
+func VerifyARC(n *Node, resolver TXTResolver) (ARCResult, error) {
+	if resolver == nil {
+		resolver = DNSResolver
+	}
+	body, err := n.rawBody()
+	if err != nil {
+		return ARCResult{}, err
+	}
+
+	sets, err := parseARCSets(n.RawHeaders)
+	res := ARCResult{ChainValidation: ARCFail, Sets: sets}
+	if err != nil {
+		res.Err = err
+		return res, nil
+	}
+	if len(sets) == 0 {
+		res.ChainValidation = ARCNone
+		return res, nil
+	}
+
+	last := sets[len(sets)-1]
+	if last.Seal.ChainValidation == ARCFail {
+		res.Err = fmt.Errorf("Chain was failed by instance %v", last.Instance)
+		return res, nil
+	}
+	for _, set := range sets {
+		expected := ARCPass
+		if set.Instance == 1 {
+			expected = ARCNone
+		}
+		if set.Seal.ChainValidation != expected {
+			res.Err = fmt.Errorf("ARC-Seal i=%v has cv=%v, expected %v", set.Instance, set.Seal.ChainValidation, expected)
+			return res, nil
+		}
+	}
+
+	// Older message signatures may have been broken by later
+	// intermediaries, only the newest one has to verify
+	if _, err := verifySignature(last.MessageSignature, n.RawHeaders, last.MessageSignatureField, body, resolver); err != nil {
+		res.Err = fmt.Errorf("ARC-Message-Signature i=%v: %v", last.Instance, err)
+		return res, nil
+	}
+
+	for i := len(sets) - 1; i >= 0; i-- {
+		if err := verifyARCSeal(sets[:i+1], resolver); err != nil {
+			res.Err = fmt.Errorf("ARC-Seal i=%v: %v", sets[i].Instance, err)
+			return res, nil
+		}
+	}
+
+	res.ChainValidation = ARCPass
+	return res, nil
+}
+
+// verifyARCSeal checks the seal of the last of sets
+func verifyARCSeal(sets []ARCSet, resolver TXTResolver) error {
+	seal := sets[len(sets)-1].Seal
+	key, _, err := lookupDKIMKey(resolver, seal.Selector, seal.Domain)
+	if err != nil {
+		return err
+	}
+	if err := key.accepts(seal.Algorithm); err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	writeARCSets(h, sets[:len(sets)-1])
+	last := sets[len(sets)-1]
+	h.Write(canonicalizeHeader(last.AuthResultsField, dkimCanonRelaxed))
+	h.Write(canonicalizeHeader(last.MessageSignatureField, dkimCanonRelaxed))
+	writeSignatureField(h, last.SealField, dkimCanonRelaxed)
+
+	return key.verify(h.Sum(nil), seal.Signature)
+}
+
+// writeARCSets hashes complete ARC sets the way a seal signs them, oldest
+// first and always with relaxed canonicalization (RFC 8617 section 5.1.1)
+func writeARCSets(h hash.Hash, sets []ARCSet) {
+	for _, set := range sets {
+		h.Write(canonicalizeHeader(set.AuthResultsField, dkimCanonRelaxed))
+		h.Write(canonicalizeHeader(set.MessageSignatureField, dkimCanonRelaxed))
+		h.Write(canonicalizeHeader(set.SealField, dkimCanonRelaxed))
+	}
+}
+
+// SealOptions configures Seal
+type SealOptions struct {
+	Domain   string
+	Selector string
+	// *rsa.PrivateKey or ed25519.PrivateKey
+	PrivateKey crypto.Signer
+	// Results of the checks this intermediary ran, written to the
+	// ARC-Authentication-Results field. The authserv-id is Domain when
+	// empty
+	AuthResults AuthResults
+	// Fields the ARC-Message-Signature signs, DefaultSignedHeaders and
+	// DKIM-Signature when empty
+	Headers []string
+	// cv= of the new seal. When empty the chain of the message is
+	// validated with Resolver
+	ChainValidation string
+	Resolver        TXTResolver
+}
+
+/*
+	Seal adds an ARC set to a message (RFC 8617 section 5.1) and returns the
+	ARC-Seal, ARC-Message-Signature and ARC-Authentication-Results fields,
+	folded and ending with CRLF, to be prepended to the message as is.
+	The instance is one more than the newest set of the message. A chain
+	which already failed is not sealed again.
+
+	Example:
+	ar := AuthResults{AuthServID: "mx.example.org", Results: []AuthResult{dkim.AuthResult()}}
+	fields, err := Seal(bytes.NewReader(msg), SealOptions{
+		Domain:      "example.org",
+		Selector:    "arc",
+		PrivateKey:  key,
+		AuthResults: ar,
+	})
+	sealed := append([]byte(fields), msg...)
+*/
+func Seal(msg io.Reader, opts SealOptions) (string, error) {
+	root, err := ParseMime(msg, nil, nil, false, WithRawRetained(), WithLenientParsing())
+	if err != nil {
+		return "", err
+	}
+	return sealNode(root, opts)
+}
+
+func sealNode(root *Node, opts SealOptions) (string, error) {
+	algorithm, sigLen, err := signingAlgorithm(opts.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	if opts.Domain == "" || opts.Selector == "" {
+		return "", errNoSigningDomain
+	}
+
+	sets, setsErr := parseARCSets(root.RawHeaders)
+	instance := 1
+	if len(sets) != 0 {
+		last := sets[len(sets)-1]
+		instance = last.Instance + 1
+		if last.Seal != nil && last.Seal.ChainValidation == ARCFail {
+			return "", errARCChainFailed
+		}
+	}
+	if instance > maxARCInstances {
+		return "", errARCTooLong
+	}
+
+	cv := strings.ToLower(opts.ChainValidation)
+	switch {
+	case cv != "":
+	case len(sets) == 0 && setsErr == nil:
+		cv = ARCNone
+	default:
+		res, err := VerifyARC(root, opts.Resolver)
+		if err != nil {
+			return "", err
+		}
+		cv = res.ChainValidation
+	}
+
+	i := "i=" + strconv.Itoa(instance)
+	now := "t=" + strconv.FormatInt(time.Now().Unix(), 10)
+
+	ar := opts.AuthResults
+	if ar.AuthServID == "" {
+		ar.AuthServID = opts.Domain
+	}
+	aarRaw := []byte(FoldHeader("ARC-Authentication-Results", i+"; "+ar.String()))
+	aar := HeaderField{Name: "ARC-Authentication-Results", Value: fieldValue(aarRaw), Raw: aarRaw, Offset: -1}
+
+	headers := opts.Headers
+	if len(headers) == 0 {
+		headers = append(append([]string{}, DefaultSignedHeaders...), "dkim-signature")
+	}
+	names := signedHeaderNames(root.RawHeaders, headers, nil)
+
+	body, err := root.rawBody()
+	if err != nil {
+		return "", err
+	}
+	bodyHash, err := dkimBodyHash(body, dkimCanonRelaxed, -1)
+	if err != nil {
+		return "", err
+	}
+
+	amsTags := []string{
+		i,
+		"a=" + algorithm,
+		"c=" + dkimCanonRelaxed + "/" + dkimCanonRelaxed,
+		"d=" + opts.Domain,
+		"s=" + opts.Selector,
+		now,
+		"h=" + strings.Join(names, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash),
+	}
+	amsRaw, err := signFields("ARC-Message-Signature", amsTags, dkimCanonRelaxed, opts.PrivateKey, sigLen, func(h hash.Hash) {
+		writeSignedHeaders(h, root.RawHeaders, names, dkimCanonRelaxed)
+	})
+	if err != nil {
+		return "", err
+	}
+	ams := HeaderField{Name: "ARC-Message-Signature", Value: fieldValue(amsRaw), Raw: amsRaw, Offset: -1}
+
+	asTags := []string{
+		i,
+		"a=" + algorithm,
+		now,
+		"cv=" + cv,
+		"d=" + opts.Domain,
+		"s=" + opts.Selector,
+	}
+	asRaw, err := signFields("ARC-Seal", asTags, dkimCanonRelaxed, opts.PrivateKey, sigLen, func(h hash.Hash) {
+		// A failed chain can't be relied on, the seal only covers its
+		// own set
+		if cv != ARCFail {
+			writeARCSets(h, sets)
+		}
+		h.Write(canonicalizeHeader(aar, dkimCanonRelaxed))
+		h.Write(canonicalizeHeader(ams, dkimCanonRelaxed))
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(asRaw) + string(amsRaw) + string(aarRaw), nil
+}
@@ -0,0 +1,206 @@
+package rfc2822
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Two ARC sets over the RFC 8463 message, sealed with its Ed25519 key
+var arcMessage = "ARC-Seal: i=2; a=ed25519-sha256; t=1792214602; cv=pass;\r\n" +
+	" d=football.example.com; s=brisbane;\r\n" +
+	" b=pS+UGnhY5e4xUg+qeiJPhOwTHeXBz0RDVPIZcyUUwkPAwtcwjcrn+9Y0tRg554E1\r\n" +
+	" i0vd2iOfQz/R/MJDt4ubBA==\r\n" +
+	"ARC-Message-Signature: i=2; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; s=brisbane; t=1792214602;\r\n" +
+	" h=from:subject:date:to:message-id;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=p4VvWpvaUsA6SpnWsyg/02kaGtImaGuDdxnv+w8jYOrWCFI4PZ0sHvUkRQwo66xx\r\n" +
+	" 1kXe/wYUnXJbUFSP69JpAg==\r\n" +
+	"ARC-Authentication-Results: i=2; lists.example.net; arc=pass\r\n" +
+	"ARC-Seal: i=1; a=ed25519-sha256; t=1792214602; cv=none;\r\n" +
+	" d=football.example.com; s=brisbane;\r\n" +
+	" b=7RG9eW0SKPabmVqJ/ZR+d5kEvUHDyjN6Gcwe26yg0/WORVA7H2ZmdhT/RFyrVJ0D\r\n" +
+	" X1IcCRd8KK0kVHQUdDWzDQ==\r\n" +
+	"ARC-Message-Signature: i=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; s=brisbane; t=1792214602;\r\n" +
+	" h=from:subject:date:to:message-id;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=njKlMG/6FlpSEt9+9Tx3clHjgUqNmbDVya+D00/Qka4lfQhJK3BRsZZfSQAoSw17\r\n" +
+	" BbsVJmxOqHHd9+0vAwBLCQ==\r\n" +
+	"ARC-Authentication-Results: i=1; mx.football.example.com; spf=pass\r\n" +
+	" smtp.mailfrom=football.example.com\r\n" +
+	unsignedMessage
+
+func verifyARCMessage(t *testing.T, msg string, resolver TXTResolver) ARCResult {
+	t.Helper()
+	root, err := ParseMime(strings.NewReader(msg), nil, nil, false, WithRawRetained())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	res, err := VerifyARC(root, resolver)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return res
+}
+
+func TestVerifyARC(t *testing.T) {
+	res := verifyARCMessage(t, arcMessage, rfc8463Records)
+	if res.ChainValidation != ARCPass || res.Err != nil {
+		t.Fatalf("got %v: %v, want %v", res.ChainValidation, res.Err, ARCPass)
+	}
+	if len(res.Sets) != 2 || res.Sets[0].Seal.ChainValidation != ARCNone || res.Sets[1].Seal.ChainValidation != ARCPass {
+		t.Errorf("got sets %+v", res.Sets)
+	}
+	if ar := res.Sets[0].AuthResults; ar.AuthServID != "mx.football.example.com" || len(ar.Results) != 1 || ar.Results[0].Method != "spf" {
+		t.Errorf("got first auth results %+v", ar)
+	}
+	if got := res.AuthResult(); got.Method != "arc" || got.Result != ARCPass {
+		t.Errorf("got auth result %+v", got)
+	}
+
+	if res := verifyARCMessage(t, unsignedMessage, rfc8463Records); res.ChainValidation != ARCNone || res.Err != nil {
+		t.Errorf("got %v: %v without ARC sets", res.ChainValidation, res.Err)
+	}
+}
+
+func TestVerifyARCFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      string
+		resolver TXTResolver
+	}{
+		{"body changed", strings.Replace(arcMessage, "We lost", "We won", 1), rfc8463Records},
+		{"signed header changed", strings.Replace(arcMessage, "Is dinner ready?", "Is lunch ready?", 1), rfc8463Records},
+		{"older set changed", strings.Replace(arcMessage, "spf=pass", "spf=fail", 1), rfc8463Records},
+		{"set missing", arcMessage[strings.Index(arcMessage, "ARC-Authentication-Results: i=2"):], rfc8463Records},
+		{"seal missing", arcMessage[strings.Index(arcMessage, "ARC-Message-Signature: i=2"):], rfc8463Records},
+		{"no key", arcMessage, TXTRecords{}},
+	}
+
+	for _, tt := range tests {
+		res := verifyARCMessage(t, tt.msg, tt.resolver)
+		if res.ChainValidation != ARCFail || res.Err == nil {
+			t.Errorf("%s: got %v: %v, want %v", tt.name, res.ChainValidation, res.Err, ARCFail)
+		}
+	}
+}
+
+func TestSealChain(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	records := TXTRecords{
+		"arc._domainkey.example.org":               {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)},
+		"brisbane._domainkey.football.example.com": rfc8463Records["brisbane._domainkey.football.example.com"],
+	}
+
+	// A third set on top of the ones sealed with Ed25519, and a body
+	// with bare LF line endings
+	for _, msg := range []string{arcMessage, strings.Replace(arcMessage, "\r\n", "\n", -1)} {
+		fields, err := Seal(strings.NewReader(msg), SealOptions{
+			Domain:      "example.org",
+			Selector:    "arc",
+			PrivateKey:  key,
+			AuthResults: AuthResults{AuthServID: "mx.example.org", Version: 1, Results: []AuthResult{{Method: "arc", Result: "pass"}}},
+			Resolver:    records,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !strings.HasPrefix(fields, "ARC-Seal: i=3; a=rsa-sha256;") || !strings.Contains(fields, "cv=pass;") {
+			t.Errorf("unexpected fields %q", fields)
+		}
+
+		res := verifyARCMessage(t, fields+msg, records)
+		if res.ChainValidation != ARCPass || len(res.Sets) != 3 {
+			t.Errorf("got %v: %v with %d sets", res.ChainValidation, res.Err, len(res.Sets))
+		}
+	}
+}
+
+func TestSealFailedChain(t *testing.T) {
+	// The seal of the broken chain is not checked, cv=fail is sealed
+	broken := strings.Replace(arcMessage, "We lost", "We won", 1)
+	opts := SealOptions{Domain: "football.example.com", Selector: "brisbane", PrivateKey: rfc8463Key(t), Resolver: rfc8463Records}
+
+	fields, err := Seal(strings.NewReader(broken), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(fields, "cv=fail;") {
+		t.Errorf("unexpected fields %q", fields)
+	}
+
+	failed := fields + broken
+	if res := verifyARCMessage(t, failed, rfc8463Records); res.ChainValidation != ARCFail {
+		t.Errorf("got %v for a failed chain", res.ChainValidation)
+	}
+	if _, err := Seal(strings.NewReader(failed), opts); err != errARCChainFailed {
+		t.Errorf("got error %v, want %v", err, errARCChainFailed)
+	}
+}
+
+func TestParseARCErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields string
+	}{
+		{"incomplete", "ARC-Seal: i=1; a=ed25519-sha256; cv=none; d=example.com; s=sel; b=YWJj\r\n"},
+		{"gap", strings.Replace(arcMessage[:strings.Index(arcMessage, "From:")], "i=1;", "i=3;", -1)},
+		{"duplicate", arcMessage[:strings.Index(arcMessage, "ARC-Message-Signature: i=2")] + arcMessage[:strings.Index(arcMessage, "ARC-Message-Signature: i=2")]},
+		{"bad instance", "ARC-Seal: i=51; a=ed25519-sha256; cv=none; d=example.com; s=sel; b=YWJj\r\n"},
+		{"seal with h=", "ARC-Seal: i=1; a=ed25519-sha256; cv=none; d=example.com; s=sel; h=from; b=YWJj\r\n"},
+		{"unknown cv", "ARC-Seal: i=1; a=ed25519-sha256; cv=maybe; d=example.com; s=sel; b=YWJj\r\n"},
+	}
+
+	for _, tt := range tests {
+		root, err := ParseMime(strings.NewReader(tt.fields+unsignedMessage), nil, nil, false)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if _, err := ParseARC(root); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestAuthResultsString(t *testing.T) {
+	ar := AuthResults{
+		AuthServID: "mx.example.org",
+		Version:    1,
+		Results: []AuthResult{
+			{Method: "dkim", Result: "pass", Properties: map[string]string{"header.d": "example.com", "header.i": "@example.com"}},
+			{Method: "spf", Result: "fail", Reason: "not permitted", Properties: map[string]string{"smtp.mailfrom": ""}, Comments: []string{"a (nested) comment"}},
+		},
+	}
+
+	want := "mx.example.org; dkim=pass header.d=example.com header.i=@example.com; " +
+		"spf=fail (a \\(nested\\) comment) reason=\"not permitted\" smtp.mailfrom=\"\""
+	if got := ar.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	parsed, err := ParseAuthResults(ar.String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	parsed.Raw = ""
+	if !reflect.DeepEqual(parsed, ar) {
+		t.Errorf("got %+v, want %+v", parsed, ar)
+	}
+
+	if got := (AuthResults{AuthServID: "mx.example.org", Version: 1}).String(); got != "mx.example.org; none" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,412 @@
+package rfc2822
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	AuthResults is an Authentication-Results field (RFC 8601), the outcome of
+	the checks an MTA ran on the message.
+
+	Example:
+	Authentication-Results: mx.google.com;
+		dkim=pass header.i=@example.com header.s=sel header.b=Ab1/Cd2+;
+		spf=pass (google.com: domain of a@example.com designates 192.0.2.1 as permitted sender) smtp.mailfrom=a@example.com;
+		dmarc=pass (p=NONE sp=NONE dis=NONE) header.from=example.com
+	will become
+	{
+		AuthServID: mx.google.com
+		Version: 1
+		Results: [
+			{Method: dkim, Result: pass, Properties: {header.i: @example.com, header.s: sel, header.b: Ab1/Cd2+}}
+			{Method: spf, Result: pass, Properties: {smtp.mailfrom: a@example.com}, Comments: [google.com: domain of ...]}
+			{Method: dmarc, Result: pass, Properties: {header.from: example.com}, Comments: [p=NONE sp=NONE dis=NONE]}
+		]
+	}
+*/
+type AuthResults struct {
+	// Who ran the checks, usually the host name of the MTA. Only results
+	// from an authserv-id you control can be trusted, see
+	// FilterAuthResults
+	AuthServID string
+	// 1 when not given
+	Version int
+	// Empty for "authserv-id; none"
+	Results []AuthResult
+	// The unfolded field value
+	Raw string
+}
+
+type AuthResult struct {
+	// Lowercase, eg. spf, dkim, dmarc, arc, iprev, auth
+	Method string
+	// Lowercase, eg. pass, fail, softfail, neutral, none, temperror,
+	// permerror, policy
+	Result string
+	Reason string
+	// Keyed by ptype.property in lowercase, eg. header.d, header.from,
+	// smtp.mailfrom, policy.iprev. Vendor extensions without a ptype,
+	// like Microsoft's action=none, are kept under their name
+	Properties map[string]string
+	Comments   []string
+}
+
+type authResultsParser struct {
+	headerParser
+	comments []string
+}
+
+// newAuthResultsParser parses a field value, folded or not
+func newAuthResultsParser(value string) *authResultsParser {
+	return &authResultsParser{
+		headerParser: headerParser{s: linebreak.ReplaceAllString(value, " ")},
+	}
+}
+
+// skipCFWS is headerParser.skipCFWS keeping the comments
+func (p *authResultsParser) skipCFWS() bool {
+	p.skipSpace()
+	for p.consume('(') {
+		comment, ok := p.consumeComment()
+		if !ok {
+			return false
+		}
+		p.comments = append(p.comments, strings.TrimSpace(comment))
+		p.skipSpace()
+	}
+	return true
+}
+
+// consumeValue reads a quoted-string or a run of characters up to
+// whitespace, a comment or a ';'. This is laxer than the RFC 2045 token of
+// RFC 8601, values like header.b often contain '=' and '/'
+func (p *authResultsParser) consumeValue() (string, error) {
+	if !p.empty() && p.peek() == '"' {
+		return p.consumeQuotedString()
+	}
+	i := strings.IndexAny(p.s, " \t(;")
+	if i < 0 {
+		i = p.len()
+	}
+	if i == 0 {
+		return "", fmt.Errorf("missing value")
+	}
+	var v string
+	v, p.s = p.s[:i], p.s[i:]
+	return v, nil
+}
+
+// consumeKeyword reads a method or property name, up to '=', '.', '/' or
+// whitespace
+func (p *authResultsParser) consumeKeyword() string {
+	i := strings.IndexAny(p.s, " \t(;=./")
+	if i < 0 {
+		i = p.len()
+	}
+	var k string
+	k, p.s = p.s[:i], p.s[i:]
+	return k
+}
+
+// skipResinfo skips a malformed resinfo up to the next ';'
+func (p *authResultsParser) skipResinfo() {
+	for !p.empty() && p.peek() != ';' {
+		if p.peek() == '"' {
+			if _, err := p.consumeQuotedString(); err != nil {
+				p.s = p.s[1:]
+			}
+			continue
+		}
+		if p.consume('(') {
+			p.consumeComment()
+			continue
+		}
+		p.s = p.s[1:]
+	}
+}
+
+/*
+	ParseAuthResults parses the value of an Authentication-Results field.
+	A malformed result is skipped and the first error is returned along with
+	the results that could be read.
+	It is an error only when the authserv-id is missing.
+	Fields written without an authserv-id, as Exchange Online does, are
+	returned with an empty AuthServID
+*/
+func ParseAuthResults(value string) (AuthResults, error) {
+	ar := AuthResults{Raw: value, Version: 1, Results: []AuthResult{}}
+	p := newAuthResultsParser(value)
+
+	if !p.skipCFWS() {
+		return ar, fmt.Errorf("Unable to parse Authentication-Results %v: malformed parenthetical comment", value)
+	}
+
+	// Exchange Online leaves out the authserv-id and starts with the first
+	// result
+	start := p.s
+	p.consumeKeyword()
+	rest := strings.TrimLeft(p.s, " \t")
+	p.s = start
+	if strings.HasPrefix(rest, "=") || strings.HasPrefix(rest, "/") {
+		p.s = ";" + p.s
+	} else {
+		id, err := p.consumeValue()
+		if err != nil {
+			return ar, fmt.Errorf("Unable to parse Authentication-Results %v: missing authserv-id", value)
+		}
+		ar.AuthServID = id
+
+		p.skipCFWS()
+		if !p.empty() && p.peek() >= '0' && p.peek() <= '9' {
+			v, _ := p.consumeValue()
+			if ar.Version, err = strconv.Atoi(v); err != nil {
+				return ar, fmt.Errorf("Unable to parse Authentication-Results %v: bad version %v", value, v)
+			}
+			p.skipCFWS()
+		}
+	}
+
+	var firstErr error
+	for p.consume(';') {
+		p.comments = nil
+		p.skipCFWS()
+		if p.empty() {
+			// Trailing ';'
+			break
+		}
+
+		res, err := p.parseResinfo()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Unable to parse Authentication-Results %v: %v", value, err)
+			}
+			p.skipResinfo()
+			continue
+		}
+		// "authserv-id; none" means no checks were run
+		if res.Method == "none" && res.Result == "" {
+			continue
+		}
+		ar.Results = append(ar.Results, res)
+	}
+
+	if !p.empty() && firstErr == nil {
+		firstErr = fmt.Errorf("Unable to parse Authentication-Results %v: unexpected %q", value, p.s)
+	}
+
+	return ar, firstErr
+}
+
+// parseResinfo parses "method=result [reason=value] [ptype.property=value]..."
+// after the ';'
+func (p *authResultsParser) parseResinfo() (AuthResult, error) {
+	res := AuthResult{Properties: map[string]string{}}
+
+	res.Method = strings.ToLower(p.consumeKeyword())
+	if res.Method == "" {
+		return res, fmt.Errorf("missing method")
+	}
+	p.skipCFWS()
+	if p.consume('/') {
+		// Method version, only 1 is defined
+		p.skipCFWS()
+		p.consumeKeyword()
+		p.skipCFWS()
+	}
+	if !p.consume('=') {
+		if res.Method == "none" {
+			return res, nil
+		}
+		return res, fmt.Errorf("missing '=' after method %v", res.Method)
+	}
+	p.skipCFWS()
+	result, err := p.consumeValue()
+	if err != nil {
+		return res, fmt.Errorf("missing result for method %v", res.Method)
+	}
+	res.Result = strings.ToLower(result)
+
+	for {
+		p.skipCFWS()
+		if p.empty() || p.peek() == ';' {
+			break
+		}
+
+		key := strings.ToLower(p.consumeKeyword())
+		if key == "" {
+			return res, fmt.Errorf("unexpected %q in %v result", p.s[:1], res.Method)
+		}
+		p.skipCFWS()
+		if p.consume('.') {
+			p.skipCFWS()
+			key += "." + strings.ToLower(p.consumeKeyword())
+			p.skipCFWS()
+		}
+		if !p.consume('=') {
+			return res, fmt.Errorf("missing '=' after %v in %v result", key, res.Method)
+		}
+		p.skipCFWS()
+		// The value may be empty, eg. smtp.mailfrom= for the null
+		// reverse-path
+		var v string
+		if !p.empty() && p.peek() != ';' {
+			if v, err = p.consumeValue(); err != nil {
+				return res, fmt.Errorf("bad value for %v in %v result: %v", key, res.Method, err)
+			}
+		}
+
+		if key == "reason" {
+			res.Reason = v
+		} else {
+			res.Properties[key] = v
+		}
+	}
+	res.Comments = p.comments
+
+	return res, nil
+}
+
+// String formats the results as the value of an Authentication-Results
+// field. Properties are written in sorted order
+func (ar AuthResults) String() string {
+	var sb strings.Builder
+	sb.WriteString(ar.AuthServID)
+	if ar.Version > 1 {
+		sb.WriteString(" " + strconv.Itoa(ar.Version))
+	}
+	if len(ar.Results) == 0 {
+		sb.WriteString("; none")
+	}
+
+	for _, res := range ar.Results {
+		sb.WriteString("; " + res.Method + "=" + res.Result)
+		for _, c := range res.Comments {
+			sb.WriteString(" (" + escapeComment(c) + ")")
+		}
+		if res.Reason != "" {
+			sb.WriteString(" reason=" + quoteString(res.Reason))
+		}
+
+		keys := make([]string, 0, len(res.Properties))
+		for k := range res.Properties {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sb.WriteString(" " + k + "=" + authResultValue(res.Properties[k]))
+		}
+	}
+
+	return sb.String()
+}
+
+// authResultValue quotes a property value when it can't be written as is
+func authResultValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " \t();\"\\") {
+		return quoteString(v)
+	}
+	return v
+}
+
+// FilterAuthResults keeps the results added by the given authserv-ids,
+// compared without case. Authentication-Results from other hosts may have
+// been forged by the sender, RFC 8601 section 5
+func FilterAuthResults(results []AuthResults, trusted []string) []AuthResults {
+	filtered := []AuthResults{}
+	for _, r := range results {
+		for _, id := range trusted {
+			if strings.EqualFold(r.AuthServID, id) {
+				filtered = append(filtered, r)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+/*
+	ReceivedSPF is a Received-SPF field, RFC 7208 section 9.1.
+
+	Example:
+	Received-SPF: pass (mybox.example.org: domain of myname@example.com
+		designates 192.0.2.1 as permitted sender)
+		receiver=mybox.example.org; client-ip=192.0.2.1;
+		envelope-from="myname@example.com"; helo=foo.example.com;
+	will become
+	{
+		Result: pass
+		Comment: mybox.example.org: domain of myname@example.com designates 192.0.2.1 as permitted sender
+		ClientIP: 192.0.2.1
+		EnvelopeFrom: myname@example.com
+		Helo: foo.example.com
+		Receiver: mybox.example.org
+		Params: {receiver: ..., client-ip: ..., envelope-from: ..., helo: ...}
+	}
+*/
+type ReceivedSPF struct {
+	// Lowercase, eg. pass, fail, softfail, neutral, none, temperror,
+	// permerror
+	Result       string
+	Comment      string
+	ClientIP     string
+	EnvelopeFrom string
+	Helo         string
+	Receiver     string
+	// Which identity was checked, mailfrom or helo
+	Identity string
+	// All the key-value pairs, keys in lowercase
+	Params map[string]string
+	// The unfolded field value
+	Raw string
+}
+
+// ParseReceivedSPF parses the value of a Received-SPF field. Like
+// ParseAuthResults it returns what could be read along with the first
+// error
+func ParseReceivedSPF(value string) (ReceivedSPF, error) {
+	spf := ReceivedSPF{Raw: value, Params: map[string]string{}}
+	p := newAuthResultsParser(value)
+
+	p.skipSpace()
+	spf.Result = strings.ToLower(p.consumeKeyword())
+	if spf.Result == "" {
+		return spf, fmt.Errorf("Unable to parse Received-SPF %v: missing result", value)
+	}
+	if !p.skipCFWS() {
+		return spf, fmt.Errorf("Unable to parse Received-SPF %v: malformed parenthetical comment", value)
+	}
+	spf.Comment = strings.Join(p.comments, " ")
+
+	var firstErr error
+	for !p.empty() {
+		key := strings.ToLower(p.consumeKeyword())
+		p.skipCFWS()
+		if key == "" || !p.consume('=') {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Unable to parse Received-SPF %v: bad key-value pair at %q", value, p.s)
+			}
+			p.skipResinfo()
+		} else {
+			p.skipCFWS()
+			v, err := p.consumeValue()
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("Unable to parse Received-SPF %v: bad value for %v", value, key)
+			}
+			spf.Params[key] = v
+		}
+		p.skipCFWS()
+		p.consume(';')
+		p.skipCFWS()
+	}
+
+	spf.ClientIP = spf.Params["client-ip"]
+	spf.EnvelopeFrom = spf.Params["envelope-from"]
+	spf.Helo = spf.Params["helo"]
+	spf.Receiver = spf.Params["receiver"]
+	spf.Identity = spf.Params["identity"]
+
+	return spf, firstErr
+}
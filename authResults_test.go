@@ -0,0 +1,173 @@
+package rfc2822
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAuthResults(t *testing.T) {
+	value := "mx.google.com;\r\n" +
+		"\tdkim=pass header.i=@example.com header.s=sel header.b=Ab1/Cd2+;\r\n" +
+		"\tspf=pass (google.com: domain of a@example.com designates 192.0.2.1 as permitted sender) smtp.mailfrom=a@example.com;\r\n" +
+		"\tdmarc=pass (p=NONE sp=NONE dis=NONE) header.from=example.com"
+
+	got, err := ParseAuthResults(value)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := AuthResults{
+		AuthServID: "mx.google.com",
+		Version:    1,
+		Results: []AuthResult{
+			{Method: "dkim", Result: "pass", Properties: map[string]string{"header.i": "@example.com", "header.s": "sel", "header.b": "Ab1/Cd2+"}},
+			{
+				Method: "spf", Result: "pass", Properties: map[string]string{"smtp.mailfrom": "a@example.com"},
+				Comments: []string{"google.com: domain of a@example.com designates 192.0.2.1 as permitted sender"},
+			},
+			{Method: "dmarc", Result: "pass", Properties: map[string]string{"header.from": "example.com"}, Comments: []string{"p=NONE sp=NONE dis=NONE"}},
+		},
+		Raw: value,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestParseAuthResultsVariants(t *testing.T) {
+	tests := []struct {
+		value   string
+		servID  string
+		version int
+		results []AuthResult
+	}{
+		{"example.org 1; none", "example.org", 1, []AuthResult{}},
+		{"example.org; none;", "example.org", 1, []AuthResult{}},
+		{
+			"example.com; auth/1=pass (cram-md5) smtp.auth=sender@example.net reason=\"good creds\"",
+			"example.com", 1,
+			[]AuthResult{{Method: "auth", Result: "pass", Reason: "good creds", Properties: map[string]string{"smtp.auth": "sender@example.net"}, Comments: []string{"cram-md5"}}},
+		},
+		{
+			"example.com; SPF=None smtp.mailfrom=",
+			"example.com", 1,
+			[]AuthResult{{Method: "spf", Result: "none", Properties: map[string]string{"smtp.mailfrom": ""}}},
+		},
+		{
+			// Exchange Online leaves out the authserv-id
+			"spf=pass (sender IP is 192.0.2.1) smtp.mailfrom=example.com; dkim=none (message not signed) header.d=none;dmarc=none action=none header.from=example.com;",
+			"", 1,
+			[]AuthResult{
+				{Method: "spf", Result: "pass", Properties: map[string]string{"smtp.mailfrom": "example.com"}, Comments: []string{"sender IP is 192.0.2.1"}},
+				{Method: "dkim", Result: "none", Properties: map[string]string{"header.d": "none"}, Comments: []string{"message not signed"}},
+				{Method: "dmarc", Result: "none", Properties: map[string]string{"action": "none", "header.from": "example.com"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseAuthResults(tt.value)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.value, err)
+			continue
+		}
+		if got.AuthServID != tt.servID || got.Version != tt.version || !reflect.DeepEqual(got.Results, tt.results) {
+			t.Errorf("%q: got %q %d %+v, want %q %d %+v", tt.value, got.AuthServID, got.Version, got.Results, tt.servID, tt.version, tt.results)
+		}
+	}
+}
+
+func TestParseAuthResultsMalformed(t *testing.T) {
+	// The broken result is skipped, the others are kept
+	got, err := ParseAuthResults("mx.example.org; dkim; spf=fail smtp.mailfrom=a@example.com")
+	if err == nil {
+		t.Error("no error for a result without '='")
+	}
+	if len(got.Results) != 1 || got.Results[0].Method != "spf" || got.Results[0].Result != "fail" {
+		t.Errorf("got results %+v", got.Results)
+	}
+
+	if _, err := ParseAuthResults(""); err == nil {
+		t.Error("no error for a missing authserv-id")
+	}
+	if _, err := ParseAuthResults("mx.example.org x; spf=pass"); err == nil {
+		t.Error("no error for a bad version")
+	}
+}
+
+func TestFilterAuthResults(t *testing.T) {
+	results := []AuthResults{{AuthServID: "mx.example.org"}, {AuthServID: "evil.example"}, {AuthServID: "MX.Example.Org"}}
+
+	got := FilterAuthResults(results, []string{"mx.example.org"})
+	if len(got) != 2 || got[0].AuthServID != "mx.example.org" || got[1].AuthServID != "MX.Example.Org" {
+		t.Errorf("got %+v", got)
+	}
+	if got := FilterAuthResults(results, nil); len(got) != 0 {
+		t.Errorf("got %+v for no trusted ids", got)
+	}
+}
+
+func TestParseReceivedSPF(t *testing.T) {
+	value := "pass (mybox.example.org: domain of myname@example.com\r\n" +
+		"\tdesignates 192.0.2.1 as permitted sender)\r\n" +
+		"\treceiver=mybox.example.org; client-ip=192.0.2.1;\r\n" +
+		"\tenvelope-from=\"myname@example.com\"; helo=foo.example.com;"
+
+	got, err := ParseReceivedSPF(value)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := ReceivedSPF{
+		Result:       "pass",
+		Comment:      "mybox.example.org: domain of myname@example.com designates 192.0.2.1 as permitted sender",
+		ClientIP:     "192.0.2.1",
+		EnvelopeFrom: "myname@example.com",
+		Helo:         "foo.example.com",
+		Receiver:     "mybox.example.org",
+		Params: map[string]string{
+			"receiver":      "mybox.example.org",
+			"client-ip":     "192.0.2.1",
+			"envelope-from": "myname@example.com",
+			"helo":          "foo.example.com",
+		},
+		Raw: value,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%+v\nwant\n%+v", got, want)
+	}
+
+	if _, err := ParseReceivedSPF(""); err == nil {
+		t.Error("no error for a missing result")
+	}
+}
+
+func TestFormatHeadersAuthResults(t *testing.T) {
+	msg := "Authentication-Results: mx.example.org; spf=pass smtp.mailfrom=a@example.com\r\n" +
+		"Authentication-Results: ;;;\r\n" +
+		"Received-SPF: softfail client-ip=192.0.2.1\r\n" +
+		"From: a@example.com\r\n" +
+		"Message-ID: <1@example.com>\r\n" +
+		"\r\n" +
+		"body\r\n"
+
+	root, err := ParseMime(strings.NewReader(msg), nil, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sm, err := FormatHeaders(root)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(sm.AuthResults) != 1 || sm.AuthResults[0].AuthServID != "mx.example.org" {
+		t.Errorf("got auth results %+v", sm.AuthResults)
+	}
+	if len(sm.ReceivedSPF) != 1 || sm.ReceivedSPF[0].Result != "softfail" || sm.ReceivedSPF[0].ClientIP != "192.0.2.1" {
+		t.Errorf("got received spf %+v", sm.ReceivedSPF)
+	}
+	if len(sm.Headers["authentication-results"]) != 2 {
+		t.Errorf("got headers %v", sm.Headers["authentication-results"])
+	}
+}
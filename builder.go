@@ -0,0 +1,389 @@
+package rfc2822
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errNoFrom = errors.New("From address is required")
+var errNoSender = errors.New("Sender is required when there are multiple From addresses")
+var errLineBreak = errors.New("Line breaks are not allowed")
+
+/*
+	Builder composes a new message. Build returns a Node tree which is
+	written out with Node.WriteMessage.
+
+	Example:
+	b := Builder{
+		From:    []Address{{Name: "Jörg", Address: "jorg@example.com"}},
+		To:      []Address{{Address: "team@example.com"}},
+		Subject: "Grüße",
+		Text:    []byte("Hello\n"),
+		HTML:    []byte("<p>Hello <img src=\"cid:logo\"></p>"),
+		Inlines: []Attachment{{Filename: "logo.png", ContentID: "logo", Data: png}},
+	}
+	root, err := b.Build()
+
+	The body becomes
+	text/plain, text/html or multipart/alternative of both,
+	with the html in a multipart/related along with the inlines,
+	and everything in a multipart/mixed when there are attachments
+*/
+type Builder struct {
+	From    []Address
+	Sender  []Address
+	ReplyTo []Address
+	To      []Address
+	Cc      []Address
+	// Not written to the header unless WriteBcc is set, the message is
+	// sent to them as envelope recipients, see Recipients
+	Bcc []Address
+	// Write the Bcc field, eg. for the copy kept by the sender. Every
+	// recipient of a message with it can see the blind copies
+	WriteBcc bool
+	Subject  string
+	// time.Now() when zero
+	Date time.Time
+	// Generated when empty
+	MessageID string
+	// Message ids with or without angle brackets, as in
+	// FormattedRootHeaders.MessageID
+	InReplyTo  []string
+	References []string
+
+	Text []byte
+	HTML []byte
+	// Parts referenced from the html by their ContentID
+	Inlines     []Attachment
+	Attachments []Attachment
+}
+
+type Attachment struct {
+	Filename string
+	// Guessed from the file extension when empty
+	ContentType string
+	ContentID   string
+	Data        []byte
+}
+
+// Build creates the Node tree of the message
+func (b *Builder) Build() (*Node, error) {
+	if len(b.From) == 0 {
+		return nil, errNoFrom
+	}
+	// https://datatracker.ietf.org/doc/html/rfc5322#section-3.6.2
+	if len(b.From) > 1 && len(b.Sender) != 1 {
+		return nil, errNoSender
+	}
+	if err := b.validate(); err != nil {
+		return nil, err
+	}
+
+	root, err := b.buildBody()
+	if err != nil {
+		return nil, err
+	}
+
+	date := b.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	messageID := b.MessageID
+	if messageID == "" {
+		messageID, err = generateMessageID(b.From[0].Address)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var fields []HeaderField
+	add := func(name, value string) {
+		if value != "" {
+			fields = append(fields, newHeaderField(name, value))
+		}
+	}
+
+	add("Date", date.Format(time.RFC1123Z))
+	add("From", FormatAddressList(b.From))
+	add("Sender", FormatAddressList(b.Sender))
+	add("Reply-To", FormatAddressList(b.ReplyTo))
+	add("To", FormatAddressList(b.To))
+	add("Cc", FormatAddressList(b.Cc))
+	if b.WriteBcc {
+		add("Bcc", FormatAddressList(b.Bcc))
+	}
+	add("Subject", EncodeText(b.Subject))
+	add("Message-ID", formatMessageIDs([]string{messageID}))
+	add("In-Reply-To", formatMessageIDs(b.InReplyTo))
+	add("References", formatMessageIDs(b.References))
+	add("MIME-Version", "1.0")
+
+	root.RawHeaders = append(fields, root.RawHeaders...)
+	for _, f := range fields {
+		root.headerChanged(f.Name)
+	}
+
+	setPaths(root, []int{1})
+
+	return root, nil
+}
+
+// Recipients returns the addresses of To, Cc and Bcc, the envelope
+// recipients of the message
+func (b *Builder) Recipients() []string {
+	var rcpts []string
+	for _, list := range [][]Address{b.To, b.Cc, b.Bcc} {
+		for _, a := range list {
+			rcpts = append(rcpts, a.Address)
+		}
+	}
+	return rcpts
+}
+
+// validate rejects line breaks in the fields which are written as they
+// are, they could be used to inject header fields
+func (b *Builder) validate() error {
+	lists := []struct {
+		name  string
+		addrs []Address
+	}{
+		{"From", b.From}, {"Sender", b.Sender}, {"Reply-To", b.ReplyTo},
+		{"To", b.To}, {"Cc", b.Cc}, {"Bcc", b.Bcc},
+	}
+	for _, l := range lists {
+		for _, a := range l.addrs {
+			if hasLineBreak(a.Name) || hasLineBreak(a.Address) {
+				return fmt.Errorf("Invalid %v address %q: %w", l.name, a.Address, errLineBreak)
+			}
+		}
+	}
+
+	ids := append([]string{b.MessageID}, b.InReplyTo...)
+	for _, id := range append(ids, b.References...) {
+		if hasLineBreak(id) {
+			return fmt.Errorf("Invalid message id %q: %w", id, errLineBreak)
+		}
+	}
+	return nil
+}
+
+func hasLineBreak(s string) bool {
+	return strings.ContainsAny(s, "\r\n")
+}
+
+func (b *Builder) buildBody() (*Node, error) {
+	var text, html *Node
+	var err error
+
+	if b.Text != nil || b.HTML == nil {
+		text = newTextNode("plain", b.Text)
+	}
+
+	attachments := b.Attachments
+
+	if b.HTML != nil {
+		html = newTextNode("html", b.HTML)
+
+		if len(b.Inlines) != 0 {
+			parts := []*Node{html}
+			for _, a := range b.Inlines {
+				inline, err := newAttachmentNode(a, "inline")
+				if err != nil {
+					return nil, err
+				}
+				parts = append(parts, inline)
+			}
+			if html, err = newMultipartNode("related", parts); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		// Nothing refers to the inlines, send them along with the
+		// attachments
+		attachments = append(append([]Attachment{}, b.Inlines...), attachments...)
+	}
+
+	var body *Node
+	switch {
+	case text != nil && html != nil:
+		if body, err = newMultipartNode("alternative", []*Node{text, html}); err != nil {
+			return nil, err
+		}
+	case html != nil:
+		body = html
+	default:
+		body = text
+	}
+
+	if len(attachments) != 0 {
+		parts := []*Node{body}
+		for i, a := range attachments {
+			disposition := "attachment"
+			if i < len(attachments)-len(b.Attachments) {
+				disposition = "inline"
+			}
+			part, err := newAttachmentNode(a, disposition)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+		}
+		if body, err = newMultipartNode("mixed", parts); err != nil {
+			return nil, err
+		}
+	}
+
+	return body, nil
+}
+
+func newBuiltNode(ct ContentType) *Node {
+	n := &Node{
+		ChildNodes:   []*Node{},
+		ParsedHeader: map[string][]string{},
+		BadHeaders:   map[string][]string{},
+		Body:         []string{},
+		ContentType:  ct,
+		Charset:      ct.Params["charset"],
+	}
+	n.SetHeader("Content-Type", FormatMediaType(ct.Type+"/"+ct.SubType, ct.Params))
+	return n
+}
+
+func newTextNode(subType string, body []byte) *Node {
+	n := newBuiltNode(ContentType{
+		Type:    "text",
+		SubType: subType,
+		Params:  map[string]string{"charset": UTF8},
+	})
+	n.SetHeader("Content-Transfer-Encoding", textTransferEncoding(body))
+	n.newBody = body
+	n.Size = len(body)
+	return n
+}
+
+func newMultipartNode(subType string, parts []*Node) (*Node, error) {
+	boundary, err := randomBoundary()
+	if err != nil {
+		return nil, err
+	}
+
+	n := newBuiltNode(ContentType{
+		Type:    "multipart",
+		SubType: subType,
+		Params:  map[string]string{"boundary": boundary},
+	})
+	n.Boundary = boundary
+	n.Multipart = subType
+	n.ChildNodes = parts
+	for _, p := range parts {
+		p.MultipartContainerType = subType
+	}
+	return n, nil
+}
+
+func newAttachmentNode(a Attachment, disposition string) (*Node, error) {
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(a.Filename))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	ct, err := ParseContentType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("Bad content type %q for %q: %v", contentType, a.Filename, err)
+	}
+	if a.Filename != "" {
+		// Legacy clients only look at the name param
+		ct.Params["name"] = a.Filename
+	}
+
+	n := newBuiltNode(ct)
+
+	cd := ContentDisposition{MediaType: disposition, Params: map[string]string{}}
+	if a.Filename != "" {
+		cd.Params["filename"] = a.Filename
+	}
+	n.ContentDisposition = cd
+	n.SetHeader("Content-Disposition", FormatMediaType(cd.MediaType, cd.Params))
+
+	if a.ContentID != "" {
+		n.SetHeader("Content-ID", ToIDHeader(a.ContentID))
+	}
+	n.SetHeader("Content-Transfer-Encoding", "base64")
+	n.newBody = a.Data
+	n.Size = len(a.Data)
+
+	return n, nil
+}
+
+func setPaths(n *Node, path []int) {
+	n.Path = path
+	for i, c := range n.ChildNodes {
+		childPath := make([]int, len(path), len(path)+1)
+		copy(childPath, path)
+		// The encapsulated message of a message/rfc822 part would share
+		// the number of its parent, not needed for built messages
+		setPaths(c, append(childPath, i+1))
+	}
+}
+
+// textTransferEncoding picks 7bit for plain ascii text within the line
+// length limit, quoted-printable otherwise
+func textTransferEncoding(body []byte) string {
+	lineLen := 0
+	for _, c := range body {
+		switch {
+		case c == '\n':
+			lineLen = 0
+			continue
+		case c > 127 || c == 0:
+			return "quoted-printable"
+		}
+		lineLen++
+		// https://datatracker.ietf.org/doc/html/rfc5322#section-2.1.1
+		if lineLen > 998 {
+			return "quoted-printable"
+		}
+	}
+	return "7bit"
+}
+
+func formatMessageIDs(ids []string) string {
+	list := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !strings.HasPrefix(id, "<") {
+			id = ToIDHeader(id)
+		}
+		list = append(list, id)
+	}
+	return strings.Join(list, " ")
+}
+
+func generateMessageID(from string) (string, error) {
+	domain := "localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 && i < len(from)-1 {
+		domain = from[i+1:]
+	}
+
+	var r [12]byte
+	if _, err := rand.Read(r[:]); err != nil {
+		return "", err
+	}
+	return ToIDHeader(fmt.Sprintf("%d.%x@%s", time.Now().UnixNano(), r, domain)), nil
+}
+
+func randomBoundary() (string, error) {
+	var r [15]byte
+	if _, err := rand.Read(r[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", r), nil
+}
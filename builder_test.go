@@ -0,0 +1,120 @@
+package rfc2822
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func buildMessage(t *testing.T, b *Builder) string {
+	t.Helper()
+	root, err := b.Build()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var buf bytes.Buffer
+	if _, err := root.WriteMessage(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return buf.String()
+}
+
+func TestBuilderParts(t *testing.T) {
+	b := &Builder{
+		From:        []Address{{Name: "Jörg", Address: "jorg@example.com"}},
+		To:          []Address{{Address: "team@example.com"}},
+		Subject:     "Grüße",
+		Date:        time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC),
+		MessageID:   "1@example.com",
+		Text:        []byte("Hello\n"),
+		HTML:        []byte("<p>Hello <img src=\"cid:logo\"></p>"),
+		Inlines:     []Attachment{{Filename: "logo.png", ContentID: "logo", Data: []byte{0x89, 'P', 'N', 'G'}}},
+		Attachments: []Attachment{{Filename: "a.txt", Data: []byte("attached")}},
+	}
+	msg := buildMessage(t, b)
+
+	var bodies []string
+	root, err := ParseMime(strings.NewReader(msg), func(n *Node) error {
+		body, err := ioutil.ReadAll(n)
+		bodies = append(bodies, n.ContentType.Type+"/"+n.ContentType.SubType+" "+string(body))
+		return err
+	}, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{
+		"text/plain Hello\r\n",
+		"text/html <p>Hello <img src=\"cid:logo\"></p>",
+		"image/png \x89PNG",
+		"text/plain attached",
+	}
+	if !reflect.DeepEqual(bodies, want) {
+		t.Errorf("got bodies %q, want %q", bodies, want)
+	}
+
+	if root.Multipart != "mixed" || root.ChildNodes[0].Multipart != "alternative" || root.ChildNodes[0].ChildNodes[1].Multipart != "related" {
+		t.Errorf("unexpected structure in %q", msg)
+	}
+	for key, want := range map[string]string{
+		"date":       "Wed, 03 Feb 2021 04:05:06 +0000",
+		"from":       "Jörg <jorg@example.com>",
+		"subject":    "Grüße",
+		"message-id": "<1@example.com>",
+	} {
+		if got := root.ParsedHeader[key]; len(got) != 1 || decodeHeader(got[0]) != want {
+			t.Errorf("got %s %v, want %q", key, got, want)
+		}
+	}
+}
+
+func TestBuilderBcc(t *testing.T) {
+	b := &Builder{
+		From:    []Address{{Address: "a@example.com"}},
+		To:      []Address{{Address: "b@example.com"}},
+		Cc:      []Address{{Address: "c@example.com"}},
+		Bcc:     []Address{{Address: "hidden@example.com"}},
+		Subject: "bcc",
+	}
+
+	if msg := buildMessage(t, b); strings.Contains(msg, "hidden@example.com") {
+		t.Errorf("Bcc written to the header: %q", msg)
+	}
+	if want := []string{"b@example.com", "c@example.com", "hidden@example.com"}; !reflect.DeepEqual(b.Recipients(), want) {
+		t.Errorf("got recipients %v, want %v", b.Recipients(), want)
+	}
+
+	b.WriteBcc = true
+	if msg := buildMessage(t, b); !strings.Contains(msg, "Bcc: hidden@example.com\r\n") {
+		t.Errorf("Bcc missing from the header: %q", msg)
+	}
+}
+
+func TestBuilderLineBreaks(t *testing.T) {
+	builders := []Builder{
+		{From: []Address{{Name: "a\r\nBcc: x@example.com", Address: "a@example.com"}}},
+		{From: []Address{{Address: "a@example.com"}}, To: []Address{{Address: "b@example.com\nBcc: x@example.com"}}},
+		{From: []Address{{Address: "a@example.com"}}, Bcc: []Address{{Address: "b@example.com\r"}}},
+		{From: []Address{{Address: "a@example.com"}}, References: []string{"<1@x>\r\nBcc: x@example.com"}},
+	}
+
+	for _, b := range builders {
+		if _, err := b.Build(); !errors.Is(err, errLineBreak) {
+			t.Errorf("got error %v, want %v", err, errLineBreak)
+		}
+	}
+}
+
+func TestBuilderRequiredFields(t *testing.T) {
+	if _, err := (&Builder{}).Build(); err != errNoFrom {
+		t.Errorf("got error %v, want %v", err, errNoFrom)
+	}
+	b := &Builder{From: []Address{{Address: "a@example.com"}, {Address: "b@example.com"}}}
+	if _, err := b.Build(); err != errNoSender {
+		t.Errorf("got error %v, want %v", err, errNoSender)
+	}
+}
@@ -0,0 +1,129 @@
+package rfc2822
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+	CapturePolicy keeps the start of the decoded bodies of some parts in
+	Node.Body, see WithCapturePolicies. Text bodies are converted to utf-8
+	from their declared charset, whether charset decoding is enabled or not.
+	Node.BodyTruncated is set for the bodies longer than MaxBytes.
+*/
+type CapturePolicy struct {
+	// Media types the policy applies to, like "text/plain", or "text/*"
+	// for a whole type. An empty list matches every part
+	Types []string
+	// Decoded octets kept, zero keeps nothing
+	MaxBytes int64
+	// Apply to parts with an attachment Content-Disposition as well
+	Attachments bool
+}
+
+// CaptureTextBodies keeps up to maxBytes of the text/plain and text/html
+// parts which are not attachments, ie. the displayed body of a message
+func CaptureTextBodies(maxBytes int64) CapturePolicy {
+	return CapturePolicy{
+		Types:    []string{"text/plain", "text/html"},
+		MaxBytes: maxBytes,
+	}
+}
+
+/*
+	WithCapturePolicies fills Node.Body for the leaf parts matched by a
+	policy, the first matching policy applies. Parts no policy matches are
+	kept as per WithBodyCapture.
+
+	Capture goes along with the BodyCallback, the body is captured as the
+	callback reads it and what it leaves unread is captured by the parser.
+	Node.Body is filled once the part ended, see PartHooks.PartEnd.
+
+	Example, to keep the displayed bodies but no images:
+	WithCapturePolicies(
+		CapturePolicy{Types: []string{"image/*"}},
+		CaptureTextBodies(64 << 10),
+	)
+*/
+func WithCapturePolicies(policies ...CapturePolicy) Option {
+	return func(o *ParserOptions) {
+		o.CapturePolicies = policies
+	}
+}
+
+func (p CapturePolicy) matches(n *Node) bool {
+	if n.ContentDisposition.MediaType == "attachment" && !p.Attachments {
+		return false
+	}
+	if len(p.Types) == 0 {
+		return true
+	}
+	for _, t := range p.Types {
+		typ, subType := t, "*"
+		if i := strings.IndexByte(t, '/'); i >= 0 {
+			typ, subType = t[:i], t[i+1:]
+		}
+		if !strings.EqualFold(typ, n.ContentType.Type) {
+			continue
+		}
+		if subType == "*" || strings.EqualFold(subType, n.ContentType.SubType) {
+			return true
+		}
+	}
+	return false
+}
+
+// setCapture sets how much of the body of n is captured, and whether it is
+// converted to utf-8
+func (mt *mimeTree) setCapture(n *Node) {
+	n.tstate.captureBytes = mt.opts.CaptureBodyBytes
+	for _, p := range mt.opts.CapturePolicies {
+		if p.matches(n) {
+			n.tstate.captureBytes = p.MaxBytes
+			n.tstate.captureText = n.ContentType.Type == "text"
+			return
+		}
+	}
+}
+
+// capturedBody returns the captured start of the body of n, as utf-8 for
+// the text parts captured by a policy
+func (n *Node) capturedBody() string {
+	captured := n.tstate.captured
+	if !n.tstate.captureText {
+		return string(captured)
+	}
+
+	// Body read without charset decoding
+	if n.DecodedCharset == "" && n.Charset != "" {
+		if r, _, err := newBodyCharsetReader(n.Charset, bytes.NewReader(captured)); err == nil {
+			if decoded, err := ioutil.ReadAll(r); err == nil {
+				captured = decoded
+			}
+		}
+	}
+
+	// Converted text can be longer than the cap
+	if int64(len(captured)) > n.tstate.captureBytes {
+		captured = captured[:n.tstate.captureBytes]
+		n.BodyTruncated = true
+	}
+
+	// The cap can fall in the middle of a character, leaving the start of
+	// a utf-8 sequence, or a replacement character for the start of a
+	// sequence in the original charset
+	if n.BodyTruncated {
+		for i := 0; i < utf8.UTFMax-1 && len(captured) > 0; i++ {
+			if r, size := utf8.DecodeLastRune(captured); r != utf8.RuneError || size != 1 {
+				break
+			}
+			captured = captured[:len(captured)-1]
+		}
+		if r, size := utf8.DecodeLastRune(captured); r == utf8.RuneError && size > 1 {
+			captured = captured[:len(captured)-size]
+		}
+	}
+	return string(captured)
+}
@@ -0,0 +1,153 @@
+package rfc2822
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const captureMessage = "Subject: capture\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"plain text\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>html</p>\r\n" +
+	"--b\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"iVBORw0KGgo=\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Disposition: attachment; filename=notes.txt\r\n" +
+	"\r\n" +
+	"attached notes\r\n" +
+	"--b--\r\n"
+
+func capturedBodies(t *testing.T, msg string, bc BodyCallback, opts ...Option) []*Node {
+	root, err := ParseMime(strings.NewReader(msg), bc, nil, false, opts...)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(root.ChildNodes) == 0 {
+		return []*Node{root}
+	}
+	return root.ChildNodes
+}
+
+func TestCapturePolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies []CapturePolicy
+		want     [][]string
+	}{
+		{
+			"text bodies",
+			[]CapturePolicy{CaptureTextBodies(1024)},
+			[][]string{{"plain text"}, {"<p>html</p>"}, {"\x89PN"}, {"att"}},
+		},
+		{
+			"wildcard with attachments",
+			[]CapturePolicy{{Types: []string{"TEXT/*"}, MaxBytes: 4, Attachments: true}},
+			[][]string{{"plai"}, {"<p>h"}, {"\x89PN"}, {"atta"}},
+		},
+		{
+			"first match applies",
+			[]CapturePolicy{{Types: []string{"image/*"}}, {MaxBytes: 2}},
+			[][]string{{"pl"}, {"<p"}, {}, {"att"}},
+		},
+	}
+
+	for _, tt := range tests {
+		// Parts no policy matches fall back to WithBodyCapture
+		parts := capturedBodies(t, captureMessage, nil, WithBodyCapture(3), WithCapturePolicies(tt.policies...))
+		for i, want := range tt.want {
+			if got := parts[i].Body; !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: part %v: got %q, want %q", tt.name, parts[i].Path, got, want)
+			}
+		}
+	}
+}
+
+func TestCaptureTruncation(t *testing.T) {
+	tests := []struct {
+		name      string
+		charset   string
+		body      string
+		max       int64
+		want      string
+		truncated bool
+	}{
+		{"fits", "us-ascii", "0123456789", 10, "0123456789", false},
+		{"one over", "us-ascii", "0123456789", 9, "012345678", true},
+		// The cap falls inside é, only the complete characters are kept
+		{"utf-8 cut", "utf-8", "h\xc3\xa9llo", 2, "h", true},
+		{"utf-8 whole", "utf-8", "h\xc3\xa9llo", 3, "h\xc3\xa9", true},
+		// Converted after capture, the utf-8 text is longer than the cap
+		{"latin1 grows", "iso-8859-1", "\xe9\xe9\xe9\xe9", 4, "\xc3\xa9\xc3\xa9", true},
+		{"latin1 grows odd cap", "iso-8859-1", "\xe9\xe9\xe9\xe9", 5, "\xc3\xa9\xc3\xa9", true},
+		{"latin1 fits", "iso-8859-1", "caf\xe9", 5, "caf\xc3\xa9", false},
+		// As windows-1252, like the body reader does
+		{"latin1 euro", "iso-8859-1", "\x80", 3, "\xe2\x82\xac", false},
+		// The cap splits 本, the decoder replaces what is left of it
+		{"shift_jis cut", "shift_jis", "\x93\xfa\x96\x7b", 3, "\xe6\x97\xa5", true},
+	}
+
+	for _, tt := range tests {
+		msg := "Content-Type: text/plain; charset=" + tt.charset + "\r\n" +
+			"\r\n" +
+			tt.body
+		part := capturedBodies(t, msg, nil, WithCapturePolicies(CaptureTextBodies(tt.max)))[0]
+		if len(part.Body) != 1 || part.Body[0] != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, part.Body, tt.want)
+		}
+		if part.BodyTruncated != tt.truncated {
+			t.Errorf("%s: got truncated %v, want %v", tt.name, part.BodyTruncated, tt.truncated)
+		}
+	}
+}
+
+func TestCaptureCharsetDecoding(t *testing.T) {
+	msg := "Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"\r\n" +
+		"\xe9\xe9\xe9"
+
+	// The body reader converts already, the cap counts utf-8 bytes
+	part := capturedBodies(t, msg, nil, WithCharsetDecoding(), WithCapturePolicies(CaptureTextBodies(3)))[0]
+	if len(part.Body) != 1 || part.Body[0] != "\xc3\xa9" || !part.BodyTruncated {
+		t.Errorf("got %q, truncated %v", part.Body, part.BodyTruncated)
+	}
+}
+
+func TestCaptureWithCallback(t *testing.T) {
+	callbacks := map[string]BodyCallback{
+		"readAll": readAllCallback,
+		"skip":    func(n *Node) error { return n.Skip() },
+		"partial": func(n *Node) error {
+			_, err := n.Read(make([]byte, 2))
+			return err
+		},
+	}
+
+	for name, bc := range callbacks {
+		parts := capturedBodies(t, captureMessage, bc, WithCapturePolicies(CaptureTextBodies(5)))
+		if got := parts[0].Body; len(got) != 1 || got[0] != "plain" || !parts[0].BodyTruncated {
+			t.Errorf("%s: got %q, truncated %v", name, got, parts[0].BodyTruncated)
+		}
+		if len(parts[2].Body) != 0 || parts[2].BodyTruncated {
+			t.Errorf("%s: got image body %q", name, parts[2].Body)
+		}
+	}
+
+	// Skip reads one byte past the cap to tell whether the body is longer
+	parts := capturedBodies(t, captureMessage, func(n *Node) error { return n.Skip() },
+		WithCapturePolicies(CaptureTextBodies(10)))
+	if got := parts[0].Body; len(got) != 1 || got[0] != "plain text" || parts[0].BodyTruncated {
+		t.Errorf("got %q, truncated %v", got, parts[0].BodyTruncated)
+	}
+}
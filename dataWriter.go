@@ -0,0 +1,208 @@
+package rfc2822
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrDataEnd is returned by DataWriter.Write for the bytes following the
+// end of data line, they are not part of the message
+var ErrDataEnd = errors.New("End of data reached")
+
+var errNoDataEnd = errors.New("Data ended without the end of data line")
+
+/*
+	DataWriter parses a message as it is written, the way an SMTP server
+	receives it after the DATA command (RFC 5321 section 4.5.2): leading
+	dots are removed from the lines and the message ends with a line holding
+	a single dot.
+
+	The message is parsed by ParseMimeWithOptions on its own goroutine, the
+	callbacks are called from there. Parsing errors, like a crossed limit,
+	are returned by the next Write so the transfer can be rejected early,
+	the following writes keep returning the error and still look for the
+	end of data line, so the reply can be sent once the client is done.
+	The Write completing the data waits for parsing to end and returns its
+	error, if any.
+
+	Close must be called once done writing, it returns the parsing error or
+	an error if the end of data line was missing.
+
+	Example:
+	w := NewDataWriter(bodyCallback, nil, WithLenientParsing())
+	for !w.Ended() {
+		n, err := conn.Read(buf)
+		if m, werr := w.Write(buf[:n]); werr == ErrDataEnd {
+			// Pipelined commands follow the data in buf[m:n]
+		} else if werr != nil {
+			// Remember the error, reply once the data ended
+		}
+		...
+	}
+	err := w.Close()
+	root := w.Root()
+*/
+type DataWriter struct {
+	pw   *io.PipeWriter
+	root *Node
+	err  error
+	// Closed once parsing ended, root and err are set then
+	done chan struct{}
+
+	// Next byte starts a line
+	lineStart bool
+	// The line starting follows a CRLF, only such a line can end the data
+	crlfStart bool
+	prevCR    bool
+	// A leading dot was dropped, the line could be the end of data
+	dot bool
+	// A dot and CR were seen at the start of the line, the CR is held
+	// back until it is known not to be the end of data
+	dotCR bool
+	ended bool
+	buf   []byte
+}
+
+// NewDataWriter returns a DataWriter parsing with the ParseMime options
+func NewDataWriter(bc BodyCallback, hc RootHeaderCallback, opts ...Option) *DataWriter {
+	parserOpts := DefaultParserOptions()
+	parserOpts.BodyCallback = bc
+	parserOpts.RootHeaderCallback = hc
+
+	for _, opt := range opts {
+		opt(&parserOpts)
+	}
+
+	return NewDataWriterWithOptions(parserOpts)
+}
+
+// NewDataWriterWithOptions is NewDataWriter with per call limits, see
+// ParserOptions
+func NewDataWriterWithOptions(opts ParserOptions) *DataWriter {
+	pr, pw := io.Pipe()
+	w := &DataWriter{
+		pw:        pw,
+		done:      make(chan struct{}),
+		lineStart: true,
+		crlfStart: true,
+	}
+
+	go func() {
+		w.root, w.err = ParseMimeWithOptions(pr, opts)
+		// Fail the pending and next writes when parsing stopped early
+		pr.CloseWithError(w.err)
+		close(w.done)
+	}()
+
+	return w
+}
+
+// Write removes the dot stuffing of p and parses it. When p holds the end
+// of data line the bytes after it are not written, ErrDataEnd is returned
+// along with the count up to the end of the line
+func (w *DataWriter) Write(p []byte) (int, error) {
+	if w.ended {
+		return 0, ErrDataEnd
+	}
+
+	w.buf = w.buf[:0]
+	n := len(p)
+	for i, c := range p {
+		if w.lineStart {
+			w.lineStart = false
+			if c == '.' {
+				w.dot = true
+				continue
+			}
+		}
+
+		if w.dot {
+			w.dot = false
+			if c == '\r' && w.crlfStart {
+				w.dotCR = true
+				continue
+			}
+		}
+
+		if w.dotCR {
+			w.dotCR = false
+			if c == '\n' {
+				w.ended = true
+				n = i + 1
+				break
+			}
+			w.emit('\r')
+		}
+
+		w.emit(c)
+	}
+
+	if _, err := w.pw.Write(w.buf); err != nil {
+		// Parsing stopped early, the data is still scanned so the caller
+		// learns where it ends
+		<-w.done
+		if !w.ended {
+			return n, w.err
+		}
+	}
+
+	if w.ended {
+		w.pw.Close()
+		<-w.done
+		if w.err != nil {
+			return n, w.err
+		}
+		if n < len(p) {
+			return n, ErrDataEnd
+		}
+	}
+
+	return n, nil
+}
+
+func (w *DataWriter) emit(c byte) {
+	w.buf = append(w.buf, c)
+	if c == '\n' {
+		w.lineStart = true
+		w.crlfStart = w.prevCR
+	}
+	w.prevCR = c == '\r'
+}
+
+// Ended reports whether the end of data line was written
+func (w *DataWriter) Ended() bool {
+	return w.ended
+}
+
+// Close ends the message and waits for parsing to end. It returns the
+// parsing error, or an error if the end of data line was not written
+func (w *DataWriter) Close() error {
+	if !w.ended {
+		if w.dotCR {
+			// Keep what was held back, the message is incomplete anyway
+			w.dotCR = false
+			w.pw.Write([]byte("\r"))
+		}
+		w.pw.Close()
+	}
+	<-w.done
+
+	if w.err != nil {
+		return w.err
+	}
+	if !w.ended {
+		return errNoDataEnd
+	}
+	return nil
+}
+
+// Root returns the parsed message once Close returned, or once the Write
+// holding the end of data line returned
+func (w *DataWriter) Root() *Node {
+	select {
+	case <-w.done:
+		return w.root
+	default:
+		return nil
+	}
+}
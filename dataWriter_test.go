@@ -0,0 +1,146 @@
+package rfc2822
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const stuffedMessage = "Subject: dots\r\n\r\n..one\r\n...\r\nplain.\r\n. two\r\n.\r\n"
+
+func dataWriterBody(t *testing.T, chunks ...string) string {
+	var body []byte
+	w := NewDataWriter(func(n *Node) (err error) {
+		body, err = ioutil.ReadAll(n)
+		return err
+	}, nil)
+
+	for _, chunk := range chunks {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatalf("unexpected error writing %q: %v", chunk, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return string(body)
+}
+
+func TestDataWriterUnstuffing(t *testing.T) {
+	want := ".one\r\n..\r\nplain.\r\n two\r\n"
+
+	if got := dataWriterBody(t, stuffedMessage); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The dots and the end of data line split across writes
+	for i := 1; i < len(stuffedMessage); i++ {
+		if got := dataWriterBody(t, stuffedMessage[:i], stuffedMessage[i:]); got != want {
+			t.Errorf("split at %d: got %q, want %q", i, got, want)
+		}
+	}
+
+	bytes := make([]string, len(stuffedMessage))
+	for i := range stuffedMessage {
+		bytes[i] = stuffedMessage[i : i+1]
+	}
+	if got := dataWriterBody(t, bytes...); got != want {
+		t.Errorf("byte by byte: got %q, want %q", got, want)
+	}
+}
+
+func TestDataWriterPipelined(t *testing.T) {
+	w := NewDataWriter(nil, nil)
+	data := "Subject: pipelined\r\n\r\nbody\r\n.\r\nQUIT\r\n"
+
+	n, err := w.Write([]byte(data))
+	if err != ErrDataEnd {
+		t.Fatalf("got error %v, want %v", err, ErrDataEnd)
+	}
+	if rest := data[n:]; rest != "QUIT\r\n" {
+		t.Errorf("got %q left, want %q", rest, "QUIT\r\n")
+	}
+	if !w.Ended() || w.Root() == nil {
+		t.Errorf("data did not end")
+	}
+	if subject := w.Root().ParsedHeader["subject"]; len(subject) != 1 || subject[0] != "pipelined" {
+		t.Errorf("got subject %q", subject)
+	}
+
+	if n, err := w.Write([]byte("NOOP\r\n")); n != 0 || err != ErrDataEnd {
+		t.Errorf("got %d, %v writing after the end", n, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDataWriterEndAtWriteEnd(t *testing.T) {
+	w := NewDataWriter(nil, nil)
+	data := "Subject: exact\r\n\r\nbody\r\n.\r\n"
+
+	if n, err := w.Write([]byte(data)); n != len(data) || err != nil {
+		t.Errorf("got %d, %v, want %d, nil", n, err, len(data))
+	}
+	if !w.Ended() {
+		t.Errorf("data did not end")
+	}
+}
+
+func TestDataWriterMissingEnd(t *testing.T) {
+	w := NewDataWriter(nil, nil)
+	// Only a dot line after CRLF ends the data
+	if _, err := w.Write([]byte("Subject: open\r\n\r\nbody\r\n.\r")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if w.Ended() {
+		t.Errorf("data ended early")
+	}
+	if err := w.Close(); err != errNoDataEnd {
+		t.Errorf("got error %v, want %v", err, errNoDataEnd)
+	}
+}
+
+func TestDataWriterParseError(t *testing.T) {
+	opts := DefaultParserOptions()
+	opts.MaxHeaderLines = 1
+	w := NewDataWriterWithOptions(opts)
+
+	lines := []string{
+		"Subject: one\r\n",
+		"From: two@example.com\r\n",
+		"To: three@example.com\r\n",
+		"\r\n",
+		strings.Repeat("body\r\n", 1000),
+		"..\r\n.",
+	}
+	var parseErr error
+	for _, line := range lines {
+		n, err := w.Write([]byte(line))
+		if n != len(line) {
+			t.Errorf("wrote %d of %q", n, line)
+		}
+		if parseErr != nil && err != parseErr {
+			t.Errorf("got error %v, want %v", err, parseErr)
+		}
+		if err != nil {
+			parseErr = err
+		}
+	}
+	if w.Ended() {
+		t.Errorf("data ended early")
+	}
+
+	// The end of data is still found, split across writes
+	n, err := w.Write([]byte("\r\nQUIT\r\n"))
+	if !errors.Is(err, ErrMaxHeaderLines) || (parseErr != nil && err != parseErr) {
+		t.Errorf("got error %v, want %v", err, ErrMaxHeaderLines)
+	}
+	if n != 2 || !w.Ended() {
+		t.Errorf("got %d bytes written, ended %v", n, w.Ended())
+	}
+	if err := w.Close(); !errors.Is(err, ErrMaxHeaderLines) {
+		t.Errorf("got error %v from Close, want %v", err, ErrMaxHeaderLines)
+	}
+}
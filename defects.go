@@ -0,0 +1,55 @@
+package rfc2822
+
+import "fmt"
+
+// DefectType identifies a problem the parser found and recovered from
+type DefectType string
+
+const (
+	// Content-Type could not be parsed, the part is treated as text/plain
+	DefectInvalidContentType DefectType = "invalid-content-type"
+	// Multipart Content-Type without a boundary param, the part is
+	// treated as application/octet-stream
+	DefectNoBoundary DefectType = "no-boundary"
+	// Content-Disposition could not be parsed
+	DefectInvalidContentDisposition DefectType = "invalid-content-disposition"
+	// Content-Disposition other than inline or attachment, the part is
+	// treated as an attachment (RFC 2183 section 2.8)
+	DefectUnknownContentDisposition DefectType = "unknown-content-disposition"
+	// Content-Transfer-Encoding is not known, the body is read as 7bit
+	DefectUnknownTransferEncoding DefectType = "unknown-transfer-encoding"
+	// Header line without a ':'
+	DefectMalformedHeaderLine DefectType = "malformed-header-line"
+	// Multipart ended without its close delimiter
+	DefectMissingCloseBoundary DefectType = "missing-close-boundary"
+	// Content-Type or Content-Disposition param which had to be repaired
+	// or was skipped, see ParseMediaType
+	DefectInvalidParam DefectType = "invalid-param"
+	// Param value with RFC 2047 encoded words, decoded anyway
+	DefectEncodedWordParam DefectType = "encoded-word-param"
+)
+
+/*
+	Defect is a problem found in a mime part which did not stop the parser,
+	similar to the defects of Python's email package.
+	Some defects are errors unless ParserOptions.Lenient is set, in that case
+	the RFC 2045 defaults are used and the defect is kept in Node.Defects
+*/
+type Defect struct {
+	Type DefectType
+	// The offending value
+	Value string
+	// Underlying parse error, if any
+	Err error
+}
+
+func (d Defect) Error() string {
+	if d.Err != nil {
+		return fmt.Sprintf("%v %q: %v", d.Type, d.Value, d.Err)
+	}
+	return fmt.Sprintf("%v %q", d.Type, d.Value)
+}
+
+func (n *Node) addDefect(t DefectType, value string, err error) {
+	n.Defects = append(n.Defects, Defect{Type: t, Value: value, Err: err})
+}
@@ -0,0 +1,114 @@
+package rfc2822
+
+import (
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const defectsMessage = "From: a@example.com\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/pl@in\r\n" +
+	"Content-Disposition: weird\r\n" +
+	"\r\n" +
+	"one\r\n" +
+	"--b\r\n" +
+	"Content-Type: multipart/alternative\r\n" +
+	"Content-Transfer-Encoding: x-uuencode\r\n" +
+	"\r\n" +
+	"two\r\n" +
+	"--b\r\n" +
+	"NotAHeader\r\n" +
+	"Content-Disposition: attachment/\r\n" +
+	"\r\n" +
+	"three\r\n" +
+	"--b--\r\n"
+
+func defectTypes(n *Node) []DefectType {
+	var types []DefectType
+	for _, d := range n.Defects {
+		types = append(types, d.Type)
+	}
+	return types
+}
+
+func TestLenientDefects(t *testing.T) {
+	root, err := ParseMime(strings.NewReader(defectsMessage), readAllCallback, nil, false, WithLenientParsing())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(root.ChildNodes) != 3 {
+		t.Fatalf("got %d parts, want 3", len(root.ChildNodes))
+	}
+
+	tests := []struct {
+		defects     []DefectType
+		contentType string
+		disposition string
+	}{
+		{[]DefectType{DefectUnknownContentDisposition, DefectInvalidContentType}, "text/plain", "attachment"},
+		{[]DefectType{DefectNoBoundary, DefectUnknownTransferEncoding}, "application/octet-stream", ""},
+		{[]DefectType{DefectMalformedHeaderLine, DefectInvalidContentDisposition, DefectUnknownContentDisposition}, "text/plain", "attachment"},
+	}
+
+	for i, tt := range tests {
+		n := root.ChildNodes[i]
+		if got := defectTypes(n); !reflect.DeepEqual(got, tt.defects) {
+			t.Errorf("part %d: got defects %v, want %v", i+1, got, tt.defects)
+		}
+		if got := n.ContentType.Type + "/" + n.ContentType.SubType; got != tt.contentType {
+			t.Errorf("part %d: got content type %v, want %v", i+1, got, tt.contentType)
+		}
+		if n.ContentDisposition.MediaType != tt.disposition {
+			t.Errorf("part %d: got disposition %q, want %q", i+1, n.ContentDisposition.MediaType, tt.disposition)
+		}
+	}
+
+	if len(root.Defects) != 0 {
+		t.Errorf("got root defects %v", root.Defects)
+	}
+}
+
+func TestStrictDefects(t *testing.T) {
+	msgs := []string{
+		"Content-Type: text/pl@in\r\n\r\nbody\r\n",
+		"Content-Disposition: weird\r\n\r\nbody\r\n",
+		"Content-Type: multipart/mixed\r\n\r\nbody\r\n",
+		"Content-Transfer-Encoding: x-uuencode\r\n\r\nbody\r\n",
+	}
+
+	for _, msg := range msgs {
+		if _, err := ParseMime(strings.NewReader(msg), readAllCallback, nil, false); err == nil {
+			t.Errorf("no error parsing %q", msg)
+		}
+		if _, err := ParseMime(strings.NewReader(msg), readAllCallback, nil, false, WithLenientParsing()); err != nil {
+			t.Errorf("lenient parsing %q: %v", msg, err)
+		}
+	}
+}
+
+func TestMissingCloseBoundary(t *testing.T) {
+	msg := "Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"\r\n" +
+		"unterminated\r\n"
+
+	// Reading the body fails, the callback can still go on
+	root, err := ParseMime(strings.NewReader(msg), func(n *Node) error {
+		if _, err := ioutil.ReadAll(n); err != io.ErrUnexpectedEOF {
+			t.Errorf("got read error %v, want %v", err, io.ErrUnexpectedEOF)
+		}
+		return nil
+	}, nil, false, WithLenientParsing())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := defectTypes(root); !reflect.DeepEqual(got, []DefectType{DefectMissingCloseBoundary}) {
+		t.Errorf("got defects %v", got)
+	}
+}
@@ -0,0 +1,694 @@
+package rfc2822
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errDKIMBodyHash = errors.New("Body hash did not verify")
+var errDKIMSignature = errors.New("Signature did not verify")
+var errDKIMBodyLength = errors.New("Body is shorter than the l= length")
+var errDKIMKeyRevoked = errors.New("Key was revoked")
+var errDKIMNoKey = errors.New("No key record for the signature")
+
+// DKIM result values, as in the dkim method of Authentication-Results
+// (RFC 8601 section 2.7.1)
+const (
+	DKIMPass      = "pass"
+	DKIMFail      = "fail"
+	DKIMTempError = "temperror"
+	DKIMPermError = "permerror"
+)
+
+const dkimCanonSimple = "simple"
+const dkimCanonRelaxed = "relaxed"
+
+// Keys shorter than this are not accepted, RFC 8301 section 3.2
+const minRSAKeyBits = 1024
+
+/*
+	DKIMSignature is a DKIM-Signature field, RFC 6376 section 3.5.
+
+	Example:
+	DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com;
+		s=sel; h=from:to:subject:date; bh=...; b=...
+	will become
+	{
+		Version: 1
+		Algorithm: rsa-sha256
+		HeaderCanonicalization: relaxed
+		BodyCanonicalization: relaxed
+		Domain: example.com
+		Selector: sel
+		Headers: [from to subject date]
+		Identifier: @example.com
+		BodyLength: -1
+		...
+	}
+*/
+type DKIMSignature struct {
+	Version int
+	// rsa-sha256 or ed25519-sha256
+	Algorithm string
+	// Decoded b= and bh= tags
+	Signature []byte
+	BodyHash  []byte
+	// simple or relaxed
+	HeaderCanonicalization string
+	BodyCanonicalization   string
+	// Signing domain
+	Domain   string
+	Selector string
+	// Signed header field names in the order they were hashed
+	Headers []string
+	// Agent or user identifier, "@" + Domain when not given
+	Identifier string
+	// Octets of the canonicalized body which were signed, -1 for the
+	// whole body
+	BodyLength int64
+	// Zero when not given
+	Timestamp  time.Time
+	Expiration time.Time
+	// All the tags, whitespace removed from base64 values
+	Tags map[string]string
+}
+
+/*
+	TXTResolver looks up the TXT records of a domain, the way DKIM and ARC
+	find their keys. DNSResolver asks the DNS, TXTRecords serves records from
+	a map for tests and offline tools.
+	Errors which are a *net.DNSError with IsNotFound set mean that there is
+	no such record, other errors are treated as temporary
+*/
+type TXTResolver interface {
+	LookupTXT(name string) ([]string, error)
+}
+
+// TXTResolverFunc adapts a function to the TXTResolver interface
+type TXTResolverFunc func(name string) ([]string, error)
+
+func (f TXTResolverFunc) LookupTXT(name string) ([]string, error) {
+	return f(name)
+}
+
+// DNSResolver looks up TXT records with the system resolver
+var DNSResolver TXTResolver = TXTResolverFunc(net.LookupTXT)
+
+/*
+	TXTRecords is a TXTResolver serving records from memory, keyed by domain
+	name.
+
+	Example:
+	TXTRecords{
+		"sel._domainkey.example.com": {"v=DKIM1; k=rsa; p=MIIBIjANBg..."},
+	}
+*/
+type TXTRecords map[string][]string
+
+func (r TXTRecords) LookupTXT(name string) ([]string, error) {
+	name = strings.TrimSuffix(name, ".")
+	for k, v := range r {
+		if strings.EqualFold(strings.TrimSuffix(k, "."), name) {
+			return v, nil
+		}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// DKIMVerification is the outcome of checking one DKIM-Signature field
+type DKIMVerification struct {
+	// The field which was checked
+	Field HeaderField
+	// nil when the field could not be parsed
+	Signature *DKIMSignature
+	// One of DKIMPass, DKIMFail, DKIMTempError and
+	// DKIMPermError
+	Result string
+	// Why the signature did not pass
+	Err error
+}
+
+// AuthResult returns the verification as the dkim method of an
+// Authentication-Results field
+func (v DKIMVerification) AuthResult() AuthResult {
+	res := AuthResult{Method: "dkim", Result: v.Result, Properties: map[string]string{}}
+	if v.Err != nil {
+		res.Reason = v.Err.Error()
+	}
+	if s := v.Signature; s != nil {
+		res.Properties["header.d"] = s.Domain
+		res.Properties["header.i"] = s.Identifier
+		res.Properties["header.s"] = s.Selector
+		// The first characters tell signatures apart, RFC 6008
+		b := s.Tags["b"]
+		if len(b) > 8 {
+			b = b[:8]
+		}
+		res.Properties["header.b"] = b
+	}
+	return res
+}
+
+/*
+	VerifyDKIM checks the DKIM-Signature fields of a message. The node must
+	have been parsed with WithRawRetained, the signatures are computed over
+	the header fields and body exactly as they were received.
+
+	There is one DKIMVerification for each field, in the order they appear in
+	the message. An error is returned only when the raw message is missing.
+	A nil resolver uses DNSResolver
+*/
+func VerifyDKIM(n *Node, resolver TXTResolver) ([]DKIMVerification, error) {
+	if resolver == nil {
+		resolver = DNSResolver
+	}
+	body, err := n.rawBody()
+	if err != nil {
+		return nil, err
+	}
+
+	verifications := []DKIMVerification{}
+	for i, f := range n.RawHeaders {
+		if !strings.EqualFold(f.Name, "DKIM-Signature") {
+			continue
+		}
+		v := DKIMVerification{Field: f}
+		v.Signature, v.Result, v.Err = verifyDKIMField(n.RawHeaders, i, body, resolver)
+		verifications = append(verifications, v)
+	}
+
+	return verifications, nil
+}
+
+func verifyDKIMField(fields []HeaderField, i int, body []byte, resolver TXTResolver) (*DKIMSignature, string, error) {
+	sig, err := ParseDKIMSignature(string(fields[i].Value))
+	if err != nil {
+		return nil, DKIMPermError, err
+	}
+	if !sig.Expiration.IsZero() && time.Now().After(sig.Expiration) {
+		return sig, DKIMPermError, fmt.Errorf("Signature expired at %v", sig.Expiration)
+	}
+
+	result, err := verifySignature(sig, fields, fields[i], body, resolver)
+	return sig, result, err
+}
+
+// verifySignature checks a DKIM-Signature or ARC-Message-Signature field
+// against its key, the body and the signed fields
+func verifySignature(sig *DKIMSignature, fields []HeaderField, field HeaderField, body []byte, resolver TXTResolver) (string, error) {
+	key, result, err := lookupDKIMKey(resolver, sig.Selector, sig.Domain)
+	if err != nil {
+		return result, err
+	}
+	if err := key.accepts(sig.Algorithm); err != nil {
+		return DKIMPermError, err
+	}
+	if key.strict && sig.Identifier != "" && !strings.EqualFold(identifierDomain(sig.Identifier), sig.Domain) {
+		return DKIMPermError, fmt.Errorf("Key does not allow subdomains, i=%v d=%v", sig.Identifier, sig.Domain)
+	}
+
+	bodyHash, err := dkimBodyHash(body, sig.BodyCanonicalization, sig.BodyLength)
+	if err != nil {
+		return DKIMFail, err
+	}
+	if !bytes.Equal(bodyHash, sig.BodyHash) {
+		return DKIMFail, errDKIMBodyHash
+	}
+
+	h := sha256.New()
+	writeSignedHeaders(h, fields, sig.Headers, sig.HeaderCanonicalization)
+	writeSignatureField(h, field, sig.HeaderCanonicalization)
+
+	if err := key.verify(h.Sum(nil), sig.Signature); err != nil {
+		return DKIMFail, err
+	}
+
+	return DKIMPass, nil
+}
+
+/*
+	ParseDKIMSignature parses the value of a DKIM-Signature field and checks
+	the required tags. Only rsa-sha256 and ed25519-sha256 are accepted,
+	rsa-sha1 is not allowed anymore (RFC 8301)
+*/
+func ParseDKIMSignature(value string) (*DKIMSignature, error) {
+	tags, err := parseTagList(value)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := tags["v"]; !ok {
+		return nil, fmt.Errorf("Missing v= tag in signature")
+	}
+	if tags["v"] != "1" {
+		return nil, fmt.Errorf("Unknown signature version %v", tags["v"])
+	}
+
+	sig, err := signatureFromTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	sig.Version = 1
+
+	sig.Identifier = "@" + sig.Domain
+	if i, ok := tags["i"]; ok {
+		domain := strings.TrimSuffix(strings.ToLower(identifierDomain(i)), ".")
+		if domain != sig.Domain && !strings.HasSuffix(domain, "."+sig.Domain) {
+			return nil, fmt.Errorf("i= domain %v is not d= %v or a subdomain of it", domain, sig.Domain)
+		}
+		sig.Identifier = i
+	}
+
+	return sig, nil
+}
+
+// signatureFromTags checks the tags DKIM-Signature and ARC-Message-Signature
+// have in common
+func signatureFromTags(tags map[string]string) (*DKIMSignature, error) {
+	for _, t := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[t]; !ok {
+			return nil, fmt.Errorf("Missing %v= tag in signature", t)
+		}
+	}
+
+	sig := &DKIMSignature{Tags: tags, BodyLength: -1}
+
+	sig.Algorithm = strings.ToLower(tags["a"])
+	if err := checkDKIMAlgorithm(sig.Algorithm); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if sig.Signature, err = base64.StdEncoding.DecodeString(tags["b"]); err != nil {
+		return nil, fmt.Errorf("Bad b= tag: %v", err)
+	}
+	if sig.BodyHash, err = base64.StdEncoding.DecodeString(tags["bh"]); err != nil {
+		return nil, fmt.Errorf("Bad bh= tag: %v", err)
+	}
+
+	sig.HeaderCanonicalization, sig.BodyCanonicalization = dkimCanonSimple, dkimCanonSimple
+	if c, ok := tags["c"]; ok {
+		header, body := c, dkimCanonSimple
+		if i := strings.IndexByte(c, '/'); i >= 0 {
+			header, body = c[:i], c[i+1:]
+		}
+		sig.HeaderCanonicalization = strings.ToLower(header)
+		sig.BodyCanonicalization = strings.ToLower(body)
+		for _, canon := range []string{sig.HeaderCanonicalization, sig.BodyCanonicalization} {
+			if canon != dkimCanonSimple && canon != dkimCanonRelaxed {
+				return nil, fmt.Errorf("Unknown canonicalization %v", c)
+			}
+		}
+	}
+
+	sig.Domain = strings.TrimSuffix(strings.ToLower(tags["d"]), ".")
+	sig.Selector = tags["s"]
+
+	for _, h := range strings.Split(tags["h"], ":") {
+		if h = strings.TrimSpace(h); h != "" {
+			sig.Headers = append(sig.Headers, strings.ToLower(h))
+		}
+	}
+	if !Contains("from", sig.Headers) {
+		return nil, fmt.Errorf("From field is not signed")
+	}
+
+	if l, ok := tags["l"]; ok {
+		if sig.BodyLength, err = strconv.ParseInt(l, 10, 64); err != nil || sig.BodyLength < 0 {
+			return nil, fmt.Errorf("Bad l= tag %v", l)
+		}
+	}
+
+	if q, ok := tags["q"]; ok && !strings.EqualFold(strings.SplitN(q, ":", 2)[0], "dns/txt") {
+		return nil, fmt.Errorf("Unknown query method %v", q)
+	}
+
+	for tag, t := range map[string]*time.Time{"t": &sig.Timestamp, "x": &sig.Expiration} {
+		if v, ok := tags[tag]; ok {
+			sec, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Bad %v= tag %v", tag, v)
+			}
+			*t = time.Unix(sec, 0)
+		}
+	}
+	if !sig.Expiration.IsZero() && sig.Expiration.Before(sig.Timestamp) {
+		return nil, fmt.Errorf("x= is before t=")
+	}
+
+	return sig, nil
+}
+
+func checkDKIMAlgorithm(a string) error {
+	switch a {
+	case "rsa-sha256", "ed25519-sha256":
+		return nil
+	}
+	return fmt.Errorf("Unsupported signing algorithm %v", a)
+}
+
+func identifierDomain(i string) string {
+	if at := strings.LastIndexByte(i, '@'); at >= 0 {
+		return i[at+1:]
+	}
+	return i
+}
+
+/*
+	parseTagList parses a tag=value list, RFC 6376 section 3.2.
+	Whitespace around names and values is removed, and all of it inside the
+	base64 values b, bh and p
+*/
+func parseTagList(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
+			// Trailing ';'
+			continue
+		}
+		i := strings.IndexByte(spec, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("Missing '=' in tag %q", strings.TrimSpace(spec))
+		}
+		name := strings.TrimSpace(spec[:i])
+		value := strings.TrimSpace(spec[i+1:])
+		if name == "" {
+			return nil, fmt.Errorf("Empty tag name")
+		}
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("Duplicate tag %v", name)
+		}
+		if name == "b" || name == "bh" || name == "p" {
+			value = strings.Join(strings.Fields(value), "")
+		}
+		tags[name] = value
+	}
+	return tags, nil
+}
+
+// dkimKey is a key record published at selector._domainkey.domain,
+// RFC 6376 section 3.6.1
+type dkimKey struct {
+	pub crypto.PublicKey
+	// Key type, rsa or ed25519
+	keyType string
+	// Acceptable hash algorithms, empty for all
+	hashes []string
+	// t=s, the i= domain must be the d= domain
+	strict bool
+}
+
+// lookupDKIMKey fetches and parses the key record, the result is the one to
+// report when it fails
+func lookupDKIMKey(resolver TXTResolver, selector, domain string) (*dkimKey, string, error) {
+	name := selector + "._domainkey." + domain
+	records, err := resolver.LookupTXT(name)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, DKIMPermError, errDKIMNoKey
+		}
+		return nil, DKIMTempError, fmt.Errorf("Unable to look up %v: %v", name, err)
+	}
+	if len(records) == 0 {
+		return nil, DKIMPermError, errDKIMNoKey
+	}
+
+	// Only one record is expected, use the first one that makes sense
+	var firstErr error
+	for _, r := range records {
+		key, err := parseDKIMKey(r)
+		if err == nil {
+			return key, "", nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, DKIMPermError, fmt.Errorf("Bad key record at %v: %v", name, firstErr)
+}
+
+func parseDKIMKey(record string) (*dkimKey, error) {
+	tags, err := parseTagList(record)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("Unknown key record version %v", v)
+	}
+
+	key := &dkimKey{keyType: "rsa"}
+	if k, ok := tags["k"]; ok {
+		key.keyType = strings.ToLower(k)
+	}
+	if h, ok := tags["h"]; ok {
+		for _, a := range strings.Split(h, ":") {
+			key.hashes = append(key.hashes, strings.ToLower(strings.TrimSpace(a)))
+		}
+	}
+	if s, ok := tags["s"]; ok {
+		email := false
+		for _, t := range strings.Split(s, ":") {
+			t = strings.TrimSpace(t)
+			email = email || t == "*" || strings.EqualFold(t, "email")
+		}
+		if !email {
+			return nil, fmt.Errorf("Key is not for email, s=%v", s)
+		}
+	}
+	for _, flag := range strings.Split(tags["t"], ":") {
+		if strings.TrimSpace(flag) == "s" {
+			key.strict = true
+		}
+	}
+
+	p, ok := tags["p"]
+	if !ok {
+		return nil, fmt.Errorf("Missing p= tag in key record")
+	}
+	if p == "" {
+		return nil, errDKIMKeyRevoked
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, fmt.Errorf("Bad p= tag: %v", err)
+	}
+
+	switch key.keyType {
+	case "rsa":
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			// Some publish the bare RSAPublicKey
+			if pub, err = x509.ParsePKCS1PublicKey(der); err != nil {
+				return nil, fmt.Errorf("Bad RSA key: %v", err)
+			}
+		}
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("Key is not an RSA key")
+		}
+		if rsaPub.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA key is too short, %v bits", rsaPub.N.BitLen())
+		}
+		key.pub = rsaPub
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Bad Ed25519 key length %v", len(der))
+		}
+		key.pub = ed25519.PublicKey(der)
+	default:
+		return nil, fmt.Errorf("Unknown key type %v", key.keyType)
+	}
+
+	return key, nil
+}
+
+// accepts checks that the key can verify signatures made with algorithm a
+func (k *dkimKey) accepts(a string) error {
+	i := strings.IndexByte(a, '-')
+	keyType, hashAlg := a[:i], a[i+1:]
+	if keyType != k.keyType {
+		return fmt.Errorf("Key type %v does not match algorithm %v", k.keyType, a)
+	}
+	if len(k.hashes) != 0 && !Contains(hashAlg, k.hashes) {
+		return fmt.Errorf("Key does not allow %v", hashAlg)
+	}
+	return nil
+}
+
+// verify checks sig over the sha256 digest of the signed data
+func (k *dkimKey) verify(digest, sig []byte) error {
+	switch pub := k.pub.(type) {
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig) != nil {
+			return errDKIMSignature
+		}
+	case ed25519.PublicKey:
+		// Ed25519 signs the hash, RFC 8463 section 3
+		if !ed25519.Verify(pub, digest, sig) {
+			return errDKIMSignature
+		}
+	}
+	return nil
+}
+
+/*
+	dkimBodyHash canonicalizes the body (RFC 6376 section 3.4.3 and 3.4.4)
+	and returns its sha256 hash, of only the first limit octets unless limit
+	is negative.
+	Bare LF line endings are taken as CRLF, as they would be sent on the wire
+*/
+func dkimBodyHash(body []byte, canon string, limit int64) ([]byte, error) {
+	h := sha256.New()
+	var written int64
+	write := func(b []byte) {
+		if limit >= 0 && written+int64(len(b)) > limit {
+			b = b[:limit-written]
+		}
+		h.Write(b)
+		written += int64(len(b))
+	}
+
+	// Empty lines are only written once a line with content follows, the
+	// ones at the end of the body are ignored
+	emptyLines := 0
+	for len(body) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(body, '\n'); i >= 0 {
+			line, body = body[:i], body[i+1:]
+		} else {
+			line, body = body, nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+
+		if canon == dkimCanonRelaxed {
+			line = relaxWhitespace(line)
+			line = bytes.TrimRight(line, " ")
+		}
+
+		if len(line) == 0 {
+			emptyLines++
+			continue
+		}
+		for ; emptyLines > 0; emptyLines-- {
+			write([]byte("\r\n"))
+		}
+		write(line)
+		write([]byte("\r\n"))
+	}
+
+	// An empty body is a single CRLF with simple, nothing with relaxed
+	if written == 0 && canon == dkimCanonSimple {
+		write([]byte("\r\n"))
+	}
+
+	if limit >= 0 && written < limit {
+		return nil, errDKIMBodyLength
+	}
+	return h.Sum(nil), nil
+}
+
+// relaxWhitespace reduces runs of spaces and tabs to a single space
+func relaxWhitespace(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	space := false
+	for _, c := range b {
+		if c == ' ' || c == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			out = append(out, ' ')
+			space = false
+		}
+		out = append(out, c)
+	}
+	if space {
+		out = append(out, ' ')
+	}
+	return out
+}
+
+// canonicalizeHeader returns a field as it is hashed, RFC 6376 section
+// 3.4.1 and 3.4.2. The field ends with CRLF
+func canonicalizeHeader(f HeaderField, canon string) []byte {
+	if canon == dkimCanonSimple {
+		raw := toCRLF(f.Raw)
+		if !bytes.HasSuffix(raw, []byte("\r\n")) {
+			raw = append(raw[:len(raw):len(raw)], '\r', '\n')
+		}
+		return raw
+	}
+
+	value := strings.NewReplacer("\r", "", "\n", "").Replace(string(f.Value))
+	value = string(bytes.TrimSpace(relaxWhitespace([]byte(value))))
+	return []byte(strings.ToLower(strings.TrimSpace(f.Name)) + ":" + value + "\r\n")
+}
+
+// writeSignedHeaders hashes the fields named in the h= tag. Each name
+// picks the last field not picked yet, names without a field left are
+// skipped, RFC 6376 section 5.4.2
+func writeSignedHeaders(h hash.Hash, fields []HeaderField, names []string, canon string) {
+	used := make([]bool, len(fields))
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].Name, name) {
+				used[i] = true
+				h.Write(canonicalizeHeader(fields[i], canon))
+				break
+			}
+		}
+	}
+}
+
+// writeSignatureField hashes the signature field itself, with an empty b=
+// value and without its final line break
+func writeSignatureField(h hash.Hash, f HeaderField, canon string) {
+	f.Raw = stripSignatureValue(f.Raw)
+	f.Value = fieldValue(f.Raw)
+	c := canonicalizeHeader(f, canon)
+	h.Write(bytes.TrimSuffix(c, []byte("\r\n")))
+}
+
+// stripSignatureValue removes the value of the b= tag from a raw field,
+// leaving everything else as it was
+func stripSignatureValue(raw []byte) []byte {
+	colon := bytes.IndexByte(raw, ':')
+	if colon < 0 {
+		return raw
+	}
+	end := len(raw) - trailingLineBreakLen(raw, false)
+
+	out := append([]byte{}, raw[:colon+1]...)
+	for pos := colon + 1; pos < end; {
+		next := bytes.IndexByte(raw[pos:end], ';')
+		if next < 0 {
+			next = end
+		} else {
+			next += pos
+		}
+
+		spec := raw[pos:next]
+		if eq := bytes.IndexByte(spec, '='); eq >= 0 && string(bytes.TrimSpace(spec[:eq])) == "b" {
+			out = append(out, spec[:eq+1]...)
+		} else {
+			out = append(out, spec...)
+		}
+
+		if next < end {
+			out = append(out, ';')
+		}
+		pos = next + 1
+	}
+	return append(out, raw[end:]...)
+}
@@ -0,0 +1,263 @@
+package rfc2822
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errNoSigningKey = errors.New("Private key is required")
+var errNoSigningDomain = errors.New("Domain and selector are required")
+var errFromNotSigned = errors.New("Message has no From field to sign")
+
+// Header fields signed by default when present, RFC 6376 section 5.4.1
+var DefaultSignedHeaders = []string{
+	"from", "reply-to", "subject", "date", "to", "cc",
+	"resent-date", "resent-from", "resent-to", "resent-cc",
+	"in-reply-to", "references", "message-id",
+	"list-id", "list-help", "list-unsubscribe", "list-subscribe", "list-post", "list-owner", "list-archive",
+	"mime-version", "content-type", "content-transfer-encoding",
+}
+
+// Base64 characters of the signature per word, so that FoldHeader can fold
+// the b= tag
+const signatureChunkLen = 64
+
+// SignOptions configures Sign
+type SignOptions struct {
+	Domain   string
+	Selector string
+	// *rsa.PrivateKey or ed25519.PrivateKey
+	PrivateKey crypto.Signer
+	// Fields to sign, DefaultSignedHeaders when empty. Every field with one
+	// of these names is signed, From is always signed
+	Headers []string
+	// Fields listed once more than they appear, so that adding one of them
+	// later breaks the signature. Eg. From, Subject, To
+	OversignHeaders []string
+	// simple or relaxed, relaxed when empty
+	HeaderCanonicalization string
+	BodyCanonicalization   string
+	// Agent or user identifier, the i= tag. Left out when empty
+	Identifier string
+	// How long the signature is valid, the x= tag. Left out when zero
+	Expiration time.Duration
+}
+
+/*
+	Sign computes a DKIM signature (RFC 6376) for a message and returns the
+	DKIM-Signature field, folded and ending with CRLF, to be prepended to the
+	message as is.
+	The message is hashed as it will be sent, bare LF line endings count as
+	CRLF.
+
+	Example:
+	field, err := Sign(bytes.NewReader(msg), SignOptions{
+		Domain:          "example.com",
+		Selector:        "sel",
+		PrivateKey:      key,
+		OversignHeaders: []string{"from", "subject"},
+	})
+	signed := append([]byte(field), msg...)
+*/
+func Sign(msg io.Reader, opts SignOptions) (string, error) {
+	root, err := ParseMime(msg, nil, nil, false, WithRawRetained(), WithLenientParsing())
+	if err != nil {
+		return "", err
+	}
+	return signNode(root, opts)
+}
+
+func signNode(root *Node, opts SignOptions) (string, error) {
+	algorithm, sigLen, err := signingAlgorithm(opts.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	if opts.Domain == "" || opts.Selector == "" {
+		return "", errNoSigningDomain
+	}
+
+	headerCanon, err := signingCanonicalization(opts.HeaderCanonicalization)
+	if err != nil {
+		return "", err
+	}
+	bodyCanon, err := signingCanonicalization(opts.BodyCanonicalization)
+	if err != nil {
+		return "", err
+	}
+
+	names := signedHeaderNames(root.RawHeaders, opts.Headers, opts.OversignHeaders)
+	if !Contains("from", names) {
+		return "", errFromNotSigned
+	}
+
+	body, err := root.rawBody()
+	if err != nil {
+		return "", err
+	}
+	bodyHash, err := dkimBodyHash(body, bodyCanon, -1)
+	if err != nil {
+		return "", err
+	}
+
+	tags := []string{
+		"v=1",
+		"a=" + algorithm,
+		"c=" + headerCanon + "/" + bodyCanon,
+		"d=" + opts.Domain,
+	}
+	if opts.Identifier != "" {
+		tags = append(tags, "i="+opts.Identifier)
+	}
+	now := time.Now()
+	tags = append(tags, "s="+opts.Selector, "t="+strconv.FormatInt(now.Unix(), 10))
+	if opts.Expiration != 0 {
+		tags = append(tags, "x="+strconv.FormatInt(now.Add(opts.Expiration).Unix(), 10))
+	}
+	tags = append(tags,
+		"h="+strings.Join(names, ":"),
+		"bh="+base64.StdEncoding.EncodeToString(bodyHash),
+	)
+
+	field, err := signFields("DKIM-Signature", tags, headerCanon, opts.PrivateKey, sigLen, func(h hash.Hash) {
+		writeSignedHeaders(h, root.RawHeaders, names, headerCanon)
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(field), nil
+}
+
+/*
+	signFields adds the b= tag to tags and signs what writeSigned hashes
+	followed by the new field itself, which is returned folded.
+
+	The signature is hashed over the field as it will be written, so the
+	field is folded with a placeholder of the signature length first, and
+	the placeholder is then replaced character by character
+*/
+func signFields(name string, tags []string, canon string, key crypto.Signer, sigLen int, writeSigned func(hash.Hash)) ([]byte, error) {
+	placeholder := strings.Repeat("A", base64.StdEncoding.EncodedLen(sigLen))
+	raw := []byte(FoldHeader(name, strings.Join(tags, "; ")+"; b="+chunkBase64(placeholder)))
+	f := HeaderField{Name: name, Value: fieldValue(raw), Raw: raw, Offset: -1}
+
+	h := sha256.New()
+	writeSigned(h)
+	writeSignatureField(h, f, canon)
+
+	opts := crypto.Hash(0)
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		opts = crypto.SHA256
+	}
+	// Ed25519 signs the hash like RSA does, RFC 8463 section 3
+	sig, err := key.Sign(rand.Reader, h.Sum(nil), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return fillSignatureValue(raw, base64.StdEncoding.EncodeToString(sig)), nil
+}
+
+func signingAlgorithm(key crypto.Signer) (string, int, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < minRSAKeyBits {
+			return "", 0, fmt.Errorf("RSA key is too short, %v bits", k.N.BitLen())
+		}
+		return "rsa-sha256", k.Size(), nil
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", ed25519.SignatureSize, nil
+	case nil:
+		return "", 0, errNoSigningKey
+	}
+	return "", 0, fmt.Errorf("Unsupported key type %T", key)
+}
+
+func signingCanonicalization(c string) (string, error) {
+	switch c = strings.ToLower(c); c {
+	case "":
+		return dkimCanonRelaxed, nil
+	case dkimCanonSimple, dkimCanonRelaxed:
+		return c, nil
+	}
+	return "", fmt.Errorf("Unknown canonicalization %v", c)
+}
+
+// signedHeaderNames lists each name once for every field of that name, and
+// once more when it is oversigned
+func signedHeaderNames(fields []HeaderField, headers, oversign []string) []string {
+	if len(headers) == 0 {
+		headers = DefaultSignedHeaders
+	}
+	if !containsFold("from", headers) {
+		headers = append([]string{"from"}, headers...)
+	}
+
+	names := []string{}
+	seen := map[string]bool{}
+	for _, name := range append(append([]string{}, headers...), oversign...) {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		for _, f := range fields {
+			if strings.EqualFold(f.Name, name) {
+				names = append(names, name)
+			}
+		}
+		if containsFold(name, oversign) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func containsFold(val string, items []string) bool {
+	for _, item := range items {
+		if strings.EqualFold(val, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// chunkBase64 splits a base64 value in words FoldHeader can fold between
+func chunkBase64(s string) string {
+	var chunks []string
+	for len(s) > signatureChunkLen {
+		chunks = append(chunks, s[:signatureChunkLen])
+		s = s[signatureChunkLen:]
+	}
+	return strings.Join(append(chunks, s), " ")
+}
+
+// fillSignatureValue replaces the characters of the b= value of a raw field
+// with sig, which has as many characters, keeping the folding
+func fillSignatureValue(raw []byte, sig string) []byte {
+	// b= is the last tag, its value starts where the stripped field ends
+	stripped := stripSignatureValue(raw)
+	pos := len(stripped) - trailingLineBreakLen(stripped, false)
+
+	out := append([]byte{}, raw...)
+	for i := pos; i < len(out) && len(sig) > 0; i++ {
+		switch out[i] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		out[i] = sig[0]
+		sig = sig[1:]
+	}
+	return out
+}
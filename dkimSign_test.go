@@ -0,0 +1,166 @@
+package rfc2822
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const rfc8463PrivateKey = "nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A="
+
+// The RFC 8463 message without its signatures
+var unsignedMessage = rfc8463Message[strings.Index(rfc8463Message, "From:"):]
+
+func rfc8463Key(t *testing.T) ed25519.PrivateKey {
+	seed, err := base64.StdEncoding.DecodeString(rfc8463PrivateKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+func TestSignEd25519(t *testing.T) {
+	field, err := Sign(strings.NewReader(unsignedMessage), SignOptions{
+		Domain:     "football.example.com",
+		Selector:   "brisbane",
+		PrivateKey: rfc8463Key(t),
+		Headers:    []string{"from", "to", "subject", "date", "message-id"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Same body hash as the RFC 8463 signature
+	if !strings.Contains(field, "bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;") {
+		t.Errorf("unexpected body hash in %q", field)
+	}
+	if !strings.HasPrefix(field, "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n d=football.example.com;") {
+		t.Errorf("unexpected field %q", field)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(field, "\r\n"), "\r\n") {
+		if len(line) > foldColumns {
+			t.Errorf("line of %d columns: %q", len(line), line)
+		}
+	}
+
+	v := verifyDKIMMessage(t, field+unsignedMessage, rfc8463Records)
+	if v.Result != DKIMPass {
+		t.Errorf("got %v: %v", v.Result, v.Err)
+	}
+}
+
+func TestSignRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	records := TXTRecords{"sel._domainkey.example.com": {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)}}
+
+	for _, canon := range []string{"simple", "relaxed"} {
+		for _, msg := range []string{unsignedMessage, strings.Replace(unsignedMessage, "\r\n", "\n", -1)} {
+			field, err := Sign(strings.NewReader(msg), SignOptions{
+				Domain:                 "example.com",
+				Selector:               "sel",
+				PrivateKey:             key,
+				HeaderCanonicalization: canon,
+				BodyCanonicalization:   canon,
+				Identifier:             "joe@example.com",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			v := verifyDKIMMessage(t, field+msg, records)
+			if v.Result != DKIMPass {
+				t.Errorf("%s: got %v: %v", canon, v.Result, v.Err)
+			}
+			if v.Signature.Identifier != "joe@example.com" {
+				t.Errorf("%s: got identifier %q", canon, v.Signature.Identifier)
+			}
+		}
+	}
+}
+
+func TestSignOversign(t *testing.T) {
+	opts := SignOptions{
+		Domain:          "football.example.com",
+		Selector:        "brisbane",
+		PrivateKey:      rfc8463Key(t),
+		Headers:         []string{"from", "subject"},
+		OversignHeaders: []string{"from", "subject"},
+	}
+	field, err := Sign(strings.NewReader(unsignedMessage), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(field, "h=from:from:subject:subject;") {
+		t.Errorf("unexpected h= tag in %q", field)
+	}
+
+	// An added From breaks an oversigned signature
+	added := field + "From: someone@else.example\r\n" + unsignedMessage
+	if v := verifyDKIMMessage(t, added, rfc8463Records); v.Result != DKIMFail {
+		t.Errorf("got %v with an added From", v.Result)
+	}
+	// An unsigned field can be added
+	added = field + "X-Spam: no\r\n" + unsignedMessage
+	if v := verifyDKIMMessage(t, added, rfc8463Records); v.Result != DKIMPass {
+		t.Errorf("got %v: %v with an added unsigned field", v.Result, v.Err)
+	}
+}
+
+func TestSignedHeaderNames(t *testing.T) {
+	fields := []HeaderField{{Name: "Received"}, {Name: "From"}, {Name: "To"}, {Name: "to"}, {Name: "Subject"}}
+
+	tests := []struct {
+		headers  []string
+		oversign []string
+		want     []string
+	}{
+		{nil, nil, []string{"from", "subject", "to", "to"}},
+		{[]string{"Subject"}, nil, []string{"from", "subject"}},
+		{[]string{"to", "To"}, []string{"from", "cc"}, []string{"from", "from", "to", "to", "cc"}},
+	}
+
+	for _, tt := range tests {
+		if got := signedHeaderNames(fields, tt.headers, tt.oversign); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("signedHeaderNames(%v, %v) = %v, want %v", tt.headers, tt.oversign, got, tt.want)
+		}
+	}
+}
+
+func TestSignErrors(t *testing.T) {
+	shortKey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		msg  string
+		opts SignOptions
+		err  error
+	}{
+		{"no key", unsignedMessage, SignOptions{Domain: "example.com", Selector: "sel"}, errNoSigningKey},
+		{"no domain", unsignedMessage, SignOptions{Selector: "sel", PrivateKey: rfc8463Key(t)}, errNoSigningDomain},
+		{"no from", "Subject: x\r\n\r\nbody\r\n", SignOptions{Domain: "example.com", Selector: "sel", PrivateKey: rfc8463Key(t)}, errFromNotSigned},
+		{"short key", unsignedMessage, SignOptions{Domain: "example.com", Selector: "sel", PrivateKey: shortKey}, nil},
+		{"bad canonicalization", unsignedMessage, SignOptions{Domain: "example.com", Selector: "sel", PrivateKey: rfc8463Key(t), BodyCanonicalization: "fancy"}, nil},
+	}
+
+	for _, tt := range tests {
+		_, err := Sign(bytes.NewReader([]byte(tt.msg)), tt.opts)
+		if err == nil || (tt.err != nil && err != tt.err) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
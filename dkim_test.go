@@ -0,0 +1,209 @@
+package rfc2822
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// RFC 8463 appendix A
+const rfc8463Message = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+var rfc8463Records = TXTRecords{
+	"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="},
+}
+
+func verifyDKIMMessage(t *testing.T, msg string, resolver TXTResolver) DKIMVerification {
+	t.Helper()
+	root, err := ParseMime(strings.NewReader(msg), nil, nil, false, WithRawRetained())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	v, err := VerifyDKIM(root, resolver)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(v) != 1 {
+		t.Fatalf("got %d verifications, want 1", len(v))
+	}
+	return v[0]
+}
+
+func TestVerifyDKIMRFC8463(t *testing.T) {
+	v := verifyDKIMMessage(t, rfc8463Message, rfc8463Records)
+	if v.Result != DKIMPass || v.Err != nil {
+		t.Fatalf("got %v: %v, want %v", v.Result, v.Err, DKIMPass)
+	}
+
+	res := v.AuthResult()
+	if res.Method != "dkim" || res.Result != DKIMPass || res.Properties["header.d"] != "football.example.com" ||
+		res.Properties["header.s"] != "brisbane" || res.Properties["header.b"] != "/gCrinpc" {
+		t.Errorf("got auth result %+v", res)
+	}
+
+	// Bare LF line endings are taken as CRLF
+	v = verifyDKIMMessage(t, strings.Replace(rfc8463Message, "\r\n", "\n", -1), rfc8463Records)
+	if v.Result != DKIMPass {
+		t.Errorf("got %v: %v with LF line endings", v.Result, v.Err)
+	}
+}
+
+func TestVerifyDKIMFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      string
+		resolver TXTResolver
+		result   string
+		err      error
+	}{
+		{
+			"body changed",
+			strings.Replace(rfc8463Message, "We lost", "We won", 1),
+			rfc8463Records, DKIMFail, errDKIMBodyHash,
+		},
+		{
+			"signed header changed",
+			strings.Replace(rfc8463Message, "Is dinner ready?", "Is lunch ready?", 1),
+			rfc8463Records, DKIMFail, errDKIMSignature,
+		},
+		{
+			"no key",
+			rfc8463Message, TXTRecords{}, DKIMPermError, errDKIMNoKey,
+		},
+		{
+			"revoked key",
+			rfc8463Message,
+			TXTRecords{"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; p="}},
+			DKIMPermError, nil,
+		},
+		{
+			"dns failure",
+			rfc8463Message,
+			TXTResolverFunc(func(name string) ([]string, error) {
+				return nil, &net.DNSError{Err: "timeout", Name: name, IsTimeout: true}
+			}),
+			DKIMTempError, nil,
+		},
+		{
+			"key type mismatch",
+			rfc8463Message,
+			TXTRecords{"brisbane._domainkey.football.example.com": {"v=DKIM1; k=rsa; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="}},
+			DKIMPermError, nil,
+		},
+		{
+			"hash not allowed",
+			rfc8463Message,
+			TXTRecords{"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; h=sha1; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="}},
+			DKIMPermError, nil,
+		},
+	}
+
+	for _, tt := range tests {
+		v := verifyDKIMMessage(t, tt.msg, tt.resolver)
+		if v.Result != tt.result || v.Err == nil {
+			t.Errorf("%s: got %v: %v, want %v", tt.name, v.Result, v.Err, tt.result)
+		}
+		if tt.err != nil && !errors.Is(v.Err, tt.err) {
+			t.Errorf("%s: got error %v, want %v", tt.name, v.Err, tt.err)
+		}
+	}
+}
+
+func TestVerifyDKIMWithoutSource(t *testing.T) {
+	root, err := ParseMime(strings.NewReader(rfc8463Message), nil, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := VerifyDKIM(root, rfc8463Records); !errors.Is(err, ErrNoRawSource) {
+		t.Errorf("got error %v, want %v", err, ErrNoRawSource)
+	}
+}
+
+func TestParseDKIMSignature(t *testing.T) {
+	sig, err := ParseDKIMSignature("v=1; a=RSA-SHA256; c=relaxed; d=Example.COM; s=sel; h=From : Subject;\r\n" +
+		" i=user@mail.example.com; l=10; t=100; x=200; bh=YWJj; b=ZG V m")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sig.Algorithm != "rsa-sha256" || sig.HeaderCanonicalization != "relaxed" || sig.BodyCanonicalization != "simple" ||
+		sig.Domain != "example.com" || sig.Identifier != "user@mail.example.com" || sig.BodyLength != 10 ||
+		sig.Timestamp.Unix() != 100 || sig.Expiration.Unix() != 200 ||
+		string(sig.BodyHash) != "abc" || string(sig.Signature) != "def" ||
+		strings.Join(sig.Headers, ":") != "from:subject" {
+		t.Errorf("got %+v", sig)
+	}
+
+	bad := []string{
+		"v=1; a=rsa-sha256; d=example.com; s=sel; h=from; bh=YWJj",
+		"v=2; a=rsa-sha256; d=example.com; s=sel; h=from; bh=YWJj; b=ZGVm",
+		"v=1; a=rsa-sha1; d=example.com; s=sel; h=from; bh=YWJj; b=ZGVm",
+		"v=1; a=rsa-sha256; d=example.com; s=sel; h=subject; bh=YWJj; b=ZGVm",
+		"v=1; a=rsa-sha256; d=example.com; s=sel; h=from; i=@example.org; bh=YWJj; b=ZGVm",
+		"v=1; a=rsa-sha256; c=fancy; d=example.com; s=sel; h=from; bh=YWJj; b=ZGVm",
+		"v=1; a=rsa-sha256; d=example.com; s=sel; h=from; t=200; x=100; bh=YWJj; b=ZGVm",
+		"v=1; v=1; a=rsa-sha256; d=example.com; s=sel; h=from; bh=YWJj; b=ZGVm",
+	}
+	for _, value := range bad {
+		if _, err := ParseDKIMSignature(value); err == nil {
+			t.Errorf("%q: no error", value)
+		}
+	}
+}
+
+func TestDKIMBodyHash(t *testing.T) {
+	hash := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	tests := []struct {
+		body  string
+		canon string
+		limit int64
+		want  string
+	}{
+		// RFC 6376 section 3.4.3 and 3.4.4
+		{"", dkimCanonSimple, -1, "frcCV1k9oG9oKj3dpUqdJg1PxRT2RSN/XKdLCPjaYaY="},
+		{"", dkimCanonRelaxed, -1, "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+		// RFC 6376 section 3.4.5
+		{" C \r\nD \t E\r\n\r\n\r\n", dkimCanonRelaxed, -1, hash(" C\r\nD E\r\n")},
+		{" C \r\nD \t E\r\n\r\n\r\n", dkimCanonSimple, -1, hash(" C \r\nD \t E\r\n")},
+		{"no line break", dkimCanonSimple, -1, hash("no line break\r\n")},
+		{"abc\ndef\n", dkimCanonSimple, 5, hash("abc\r\n")},
+	}
+
+	for _, tt := range tests {
+		got, err := dkimBodyHash([]byte(tt.body), tt.canon, tt.limit)
+		if err != nil {
+			t.Errorf("%q %s: unexpected error: %v", tt.body, tt.canon, err)
+			continue
+		}
+		if b := base64.StdEncoding.EncodeToString(got); b != tt.want {
+			t.Errorf("%q %s: got %v, want %v", tt.body, tt.canon, b, tt.want)
+		}
+	}
+
+	if _, err := dkimBodyHash([]byte("short\r\n"), dkimCanonSimple, 100); err != errDKIMBodyLength {
+		t.Errorf("got error %v, want %v", err, errDKIMBodyLength)
+	}
+}
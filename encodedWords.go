@@ -17,7 +17,10 @@ import (
 	"golang.org/x/text/transform"
 )
 
-// decodeToUTF8Base64Header decodes a MIME header per RFC 2047,
+// decodeToUTF8Base64Header decodes the RFC 2047 encoded words of a header
+// and encodes them again as B encoded utf-8, so that the result only has
+// utf-8 encoded words. It does not return plain utf-8, use decodeHeader for
+// that and EncodeText to encode
 func decodeToUTF8Base64Header(input string) string {
 	if !strings.Contains(input, "=?") {
 		// Don't scan if there is nothing to do here
@@ -89,15 +92,45 @@ func decodeHeader(input string) string {
 const UTF8 = "utf-8"
 
 func NewCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	r, _, err := newCharsetReader(charset, input)
+	return r, err
+}
 
-	if strings.ToLower(charset) == UTF8 {
-		return input, nil
+// newCharsetReader is NewCharsetReader but also returns the canonical name
+// of the charset that is actually used for decoding
+func newCharsetReader(charset string, input io.Reader) (io.Reader, string, error) {
+	charset = normalizeCharset(charset)
+	if charset == UTF8 {
+		return input, UTF8, nil
 	}
-	csentry, ok := encodings[strings.ToLower(charset)]
+	csentry, ok := encodings[charset]
 	if !ok {
-		return nil, fmt.Errorf("Unsupported charset %q", charset)
+		return nil, "", fmt.Errorf("Unsupported charset %q", charset)
+	}
+	if csentry.e == encoding.Nop {
+		return input, csentry.name, nil
 	}
-	return transform.NewReader(input, csentry.e.NewDecoder()), nil
+	return transform.NewReader(input, csentry.e.NewDecoder()), csentry.name, nil
+}
+
+// newBodyCharsetReader is newCharsetReader for bodies. Those labelled
+// iso-8859-1 are decoded as windows-1252, its superset, like browsers do
+// (WHATWG Encoding Standard): mail clients often send windows-1252 quotes
+// and dashes under that label. The name returned is then windows-1252, the
+// charset actually used
+func newBodyCharsetReader(charset string, input io.Reader) (io.Reader, string, error) {
+	r, used, err := newCharsetReader(charset, input)
+	if err == nil && used == "iso-8859-1" {
+		r = transform.NewReader(input, charmap.Windows1252.NewDecoder())
+		used = "windows-1252"
+	}
+	return r, used, err
+}
+
+// Charset params are often sent quoted twice or with stray spaces,
+// eg. charset="'utf-8' "
+func normalizeCharset(charset string) string {
+	return strings.ToLower(strings.Trim(charset, " \t\"'"))
 }
 
 var encodings = map[string]struct {
@@ -2,8 +2,51 @@ package rfc2822
 
 import (
 	"errors"
+	"fmt"
 )
 
-var errMaxLineLength = errors.New("Reached maximum read limit for a line")
-var errMaxHeaderLines = errors.New("Reached maximum limit for number of header lines")
 var errNoBoundary = errors.New("No boundary param for Multipart data")
+
+// Limit errors, see ParserOptions
+var ErrMaxMimeNodes = errors.New("Reached maximum limit for number of mime nodes")
+var ErrMaxLineLength = errors.New("Reached maximum read limit for a line")
+var ErrMaxHeaderLines = errors.New("Reached maximum limit for number of header lines")
+var ErrMaxNestingDepth = errors.New("Reached maximum nesting depth of mime tree")
+var ErrMaxHeaderBytes = errors.New("Reached maximum limit for header bytes")
+var ErrMaxPartBytes = errors.New("Reached maximum limit for decoded bytes of a part")
+var ErrMaxMessageSize = errors.New("Reached maximum message size")
+
+// LimitError is returned when a message crosses one of the ParserOptions
+// limits. Use errors.Is with the ErrMax* values to tell which one
+type LimitError struct {
+	Err   error
+	Limit int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%v (limit %d)", e.Err, e.Limit)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// ParseError is returned by ParseMime when parsing stops halfway. The
+// partially parsed tree is returned along with it
+type ParseError struct {
+	Err error
+	// Path of the node being parsed
+	Path []int
+	// HEADER or BODY
+	State string
+	// Bytes of the raw message consumed before parsing stopped
+	Offset int64
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%v (part %v, %v, offset %d)", e.Err, e.Path, e.State, e.Offset)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,69 @@
+package rfc2822
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseErrorPartialTree(t *testing.T) {
+	opts := DefaultParserOptions()
+	opts.BodyCallback = readAllCallback
+	opts.MaxMimeNodes = 3
+
+	root, err := ParseMimeWithOptions(strings.NewReader(limitsMessage), opts)
+
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("got error %v, want a ParseError", err)
+	}
+	if !errors.Is(err, ErrMaxMimeNodes) {
+		t.Errorf("got error %v, want %v", err, ErrMaxMimeNodes)
+	}
+	if want := []int{1, 2, 1}; !reflect.DeepEqual(parseErr.Path, want) {
+		t.Errorf("got path %v, want %v", parseErr.Path, want)
+	}
+	if parseErr.State != HEADER {
+		t.Errorf("got state %v, want %v", parseErr.State, HEADER)
+	}
+	if want := int64(strings.Index(limitsMessage, "Content-Type: text/plain\r\n\r\nnested")); parseErr.Offset != want {
+		t.Errorf("got offset %d, want %d", parseErr.Offset, want)
+	}
+
+	if root == nil || len(root.ChildNodes) != 2 {
+		t.Fatalf("got partial tree %v, want the root with 2 parts", root)
+	}
+	if root.ChildNodes[1].Multipart != "alternative" {
+		t.Errorf("got second part %v, want multipart/alternative", root.ChildNodes[1].ContentType)
+	}
+}
+
+// A header processed before the failure is not processed again when the
+// partial tree is finalized
+func TestParseErrorDefectsOnce(t *testing.T) {
+	msg := "Content-Type: text/pl@in\r\n\r\nbody\r\n"
+	errHeader := errors.New("rejected")
+
+	root, err := ParseMime(strings.NewReader(msg), nil, func(n *Node) error {
+		return errHeader
+	}, false, WithLenientParsing())
+	if err == nil {
+		t.Fatal("no error from the root header callback")
+	}
+	if got := defectTypes(root); !reflect.DeepEqual(got, []DefectType{DefectInvalidContentType}) {
+		t.Errorf("got defects %v, want a single %v", got, DefectInvalidContentType)
+	}
+}
+
+func TestParseErrorUnfinishedHeader(t *testing.T) {
+	msg := "Subject: no body\r\nContent-Type: text/ht@ml\r\n"
+
+	root, err := ParseMime(strings.NewReader(msg), nil, nil, false, WithLenientParsing())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if root.ContentType.SubType != "plain" || len(root.Defects) != 1 {
+		t.Errorf("got content type %v and defects %v", root.ContentType, root.Defects)
+	}
+}
@@ -0,0 +1,82 @@
+package rfc2822
+
+import (
+	"bytes"
+	"strings"
+)
+
+/*
+	HeaderField is a header field exactly as it appeared in the message.
+	Node.RawHeaders keeps these in their original order, which is needed
+	for DKIM and for writing the message back byte by byte.
+
+	Example, for the field
+	Subject: Hello\r\n
+	  World\r\n
+	{
+		Name: "Subject"
+		Value: " Hello\r\n  World"
+		Raw: "Subject: Hello\r\n  World\r\n"
+	}
+*/
+type HeaderField struct {
+	// Field name in its original case
+	Name string
+	// Everything after the ':', still folded, without the final line break
+	Value []byte
+	// The whole field including the final line break
+	Raw []byte
+	// Absolute offset of the field in the message
+	Offset int64
+}
+
+// appendHeaderLine adds a raw header line to RawHeaders, continuation lines
+// are folded into the previous field
+func (n *Node) appendHeaderLine(line []byte, offset int64) {
+	if l := len(n.RawHeaders); l > 0 && len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+		f := &n.RawHeaders[l-1]
+		f.Raw = append(f.Raw, line...)
+		f.Value = fieldValue(f.Raw)
+		return
+	}
+
+	raw := append([]byte{}, line...)
+	n.RawHeaders = append(n.RawHeaders, HeaderField{
+		Name:   fieldName(raw),
+		Value:  fieldValue(raw),
+		Raw:    raw,
+		Offset: offset,
+	})
+}
+
+// fieldName returns the name of a raw field, or the whole trimmed line
+// if it has no ':'
+func fieldName(raw []byte) string {
+	if i := bytes.IndexByte(raw, ':'); i >= 0 {
+		return strings.TrimSpace(string(raw[:i]))
+	}
+	return strings.TrimSpace(string(raw))
+}
+
+func fieldValue(raw []byte) []byte {
+	i := bytes.IndexByte(raw, ':')
+	if i < 0 {
+		return nil
+	}
+	v := raw[i+1:]
+	return v[:len(v)-trailingLineBreakLen(v, false)]
+}
+
+// hasColon reports whether the raw field has a name/value separator
+func (f HeaderField) hasColon() bool {
+	return bytes.IndexByte(f.Raw, ':') >= 0
+}
+
+// Unfolded returns the value with the folding removed, as described in
+// RFC 5322 section 2.2.3, and surrounding whitespace trimmed. Only the line
+// breaks are removed, the whitespace following them is kept
+func (f HeaderField) Unfolded() string {
+	v := strings.Replace(string(f.Value), "\r\n", "", -1)
+	v = strings.Replace(v, "\n", "", -1)
+	return strings.Trim(v, " \t")
+}
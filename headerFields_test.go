@@ -0,0 +1,81 @@
+package rfc2822
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const rawHeadersMessage = "Received: from a\r\n" +
+	"\tby b; Mon, 7 Feb 1994 21:52:25 -0800\r\n" +
+	"SUBJECT: Hello\r\n" +
+	"   folded  World\r\n" +
+	"x-Custom:no space\r\n" +
+	"Received: from c by d\r\n" +
+	"\r\n" +
+	"body\r\n"
+
+func TestRawHeaders(t *testing.T) {
+	root, err := ParseMime(strings.NewReader(rawHeadersMessage), nil, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var names []string
+	var raw string
+	for _, f := range root.RawHeaders {
+		names = append(names, f.Name)
+		raw += string(f.Raw)
+		if want := int64(strings.Index(rawHeadersMessage, string(f.Raw))); f.Offset != want {
+			t.Errorf("%s: got offset %d, want %d", f.Name, f.Offset, want)
+		}
+	}
+
+	if want := []string{"Received", "SUBJECT", "x-Custom", "Received"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got names %v, want %v", names, want)
+	}
+	if want := rawHeadersMessage[:strings.Index(rawHeadersMessage, "\r\n\r\n")+2]; raw != want {
+		t.Errorf("got raw headers %q, want %q", raw, want)
+	}
+	if got := string(root.RawHeaders[1].Value); got != " Hello\r\n   folded  World" {
+		t.Errorf("got value %q", got)
+	}
+}
+
+func TestHeaderFieldUnfolded(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{" Hello", "Hello"},
+		{" Hello\r\n World", "Hello World"},
+		{" Hello\r\n   folded  World", "Hello   folded  World"},
+		{"\tHello\n\tWorld ", "Hello\tWorld"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		f := HeaderField{Value: []byte(tt.value)}
+		if got := f.Unfolded(); got != tt.want {
+			t.Errorf("Unfolded(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParsedHeaderFromRawHeaders(t *testing.T) {
+	root, err := ParseMime(strings.NewReader(rawHeadersMessage), nil, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[string][]string{
+		// Repeated fields are kept bottom up
+		"received":     {"from c by d", "from a\tby b; Mon, 7 Feb 1994 21:52:25 -0800"},
+		"subject":      {"Hello   folded  World"},
+		"x-custom":     {"no space"},
+		"content-type": {"text/plain"},
+	}
+	if !reflect.DeepEqual(root.ParsedHeader, want) {
+		t.Errorf("got %v, want %v", root.ParsedHeader, want)
+	}
+}
@@ -420,3 +420,375 @@ func ToIDHeader(v string) string {
 	v = url.QueryEscape(v)
 	return "<" + strings.Replace(v, "%40", "@", -1) + ">"
 }
+
+/*
+	AddressError is returned by ParseAddressList, Pos is the byte offset in
+	Input where parsing failed
+*/
+type AddressError struct {
+	Err   error
+	Pos   int
+	Input string
+}
+
+func (e *AddressError) Error() string {
+	return fmt.Sprintf("%v at position %d in %q", e.Err, e.Pos, e.Input)
+}
+
+func (e *AddressError) Unwrap() error {
+	return e.Err
+}
+
+type addressParser struct {
+	headerParser
+	input    string
+	comments []string
+}
+
+func (p *addressParser) pos() int {
+	return len(p.input) - p.len()
+}
+
+func (p *addressParser) errorf(format string, args ...interface{}) error {
+	return &AddressError{Err: fmt.Errorf(format, args...), Pos: p.pos(), Input: p.input}
+}
+
+// skipCFWS is headerParser.skipCFWS keeping the comments
+func (p *addressParser) skipCFWS() error {
+	p.skipSpace()
+	for !p.empty() && p.peek() == '(' {
+		start := p.pos()
+		p.consume('(')
+		comment, ok := p.consumeComment()
+		if !ok {
+			return &AddressError{Err: fmt.Errorf("unclosed comment"), Pos: start, Input: p.input}
+		}
+		p.comments = append(p.comments, strings.TrimSpace(decodeHeader(comment)))
+		p.skipSpace()
+	}
+	return nil
+}
+
+/*
+	ParseAddressList parses an address-list (RFC 5322 section 3.4) as found in
+	From, To, Cc and the like.
+
+	Display names are decoded to utf-8. Members of a group get the group name
+	in Address.Group, an empty group like "undisclosed-recipients:;" is
+	returned as a single Address with only Group set.
+	Besides the obsolete syntax of RFC 5322 section 4.4 (routes, empty list
+	elements, dots in names) it accepts
+	missing commas between addresses,
+	'@' and other specials in unquoted display names,
+	encoded words inside quoted display names,
+	a missing '>' or ';' at the end,
+	and a comment as the display name of a bare addr-spec.
+	Errors are *AddressError with the position where parsing failed
+*/
+func ParseAddressList(s string) ([]Address, error) {
+	p := addressParser{headerParser: headerParser{s}, input: s}
+	var list []Address
+
+	for {
+		if err := p.skipCFWS(); err != nil {
+			return list, err
+		}
+		if p.empty() {
+			break
+		}
+		// obs-addr-list allows empty elements
+		if p.consume(',') {
+			continue
+		}
+
+		addrs, err := p.parseAddress()
+		if err != nil {
+			return list, err
+		}
+		list = append(list, addrs...)
+	}
+
+	return list, nil
+}
+
+/*
+	parseReturnPath parses a Return-Path value. Unlike an address list it can
+	be the null reverse-path "<>" of bounces (RFC 5321 section 4.4), which is
+	returned as a single Address with only Raw set
+*/
+func parseReturnPath(s string) ([]Address, error) {
+	p := addressParser{headerParser: headerParser{s}, input: s}
+	if err := p.skipCFWS(); err != nil {
+		return nil, err
+	}
+	if p.consume('<') {
+		if err := p.skipCFWS(); err != nil {
+			return nil, err
+		}
+		if p.consume('>') {
+			if err := p.skipCFWS(); err != nil {
+				return nil, err
+			}
+			if p.empty() {
+				return []Address{{Comments: p.comments, Raw: "<>"}}, nil
+			}
+		}
+	}
+	return ParseAddressList(s)
+}
+
+// nextSpecial returns the first of '<', ':', ',' or ';' outside quoted
+// strings and comments, 0 if there is none
+func (p *addressParser) nextSpecial() byte {
+	depth := 0
+	quoted := false
+	for i := 0; i < p.len(); i++ {
+		c := p.s[i]
+		switch {
+		case c == '\\':
+			i++
+		case quoted:
+			quoted = c != '"'
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth > 0:
+		case c == '"':
+			quoted = true
+		case c == '<' || c == ':' || c == ',' || c == ';':
+			return c
+		}
+	}
+	return 0
+}
+
+func (p *addressParser) parseAddress() ([]Address, error) {
+	if p.nextSpecial() != ':' {
+		a, err := p.parseMailbox()
+		if err != nil {
+			return nil, err
+		}
+		return []Address{a}, nil
+	}
+
+	// group = display-name ":" [group-list] ";" [CFWS]
+	start := p.pos()
+	p.comments = nil
+	name, err := p.parseDisplayName(':')
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, p.errorf("empty group name")
+	}
+	p.consume(':')
+
+	var members []Address
+	for {
+		if err := p.skipCFWS(); err != nil {
+			return nil, err
+		}
+		// A missing ';' at the end is tolerated
+		if p.empty() || p.consume(';') {
+			break
+		}
+		if p.consume(',') {
+			continue
+		}
+		a, err := p.parseMailbox()
+		if err != nil {
+			return nil, err
+		}
+		a.Group = name
+		members = append(members, a)
+	}
+
+	if len(members) == 0 {
+		return []Address{{
+			Group:       name,
+			AddressText: EncodePhrase(name) + ":;",
+			Raw:         strings.TrimSpace(p.input[start:p.pos()]),
+		}}, nil
+	}
+	return members, nil
+}
+
+// mailbox = name-addr / addr-spec
+func (p *addressParser) parseMailbox() (a Address, err error) {
+	start := p.pos()
+	p.comments = nil
+
+	if p.nextSpecial() == '<' {
+		// name-addr = [display-name] angle-addr
+		if a.Name, err = p.parseDisplayName('<'); err != nil {
+			return a, err
+		}
+		p.consume('<')
+		if err = p.skipCFWS(); err != nil {
+			return a, err
+		}
+		if err = p.skipRoute(); err != nil {
+			return a, err
+		}
+		if a.Address, err = p.parseAddrSpec(); err != nil {
+			return a, err
+		}
+		if err = p.skipCFWS(); err != nil {
+			return a, err
+		}
+		// A missing '>' at the end is tolerated
+		if !p.consume('>') && !p.empty() {
+			return a, p.errorf("missing '>' in angle-addr")
+		}
+	} else {
+		if a.Address, err = p.parseAddrSpec(); err != nil {
+			return a, err
+		}
+	}
+
+	if err = p.skipCFWS(); err != nil {
+		return a, err
+	}
+	if !p.empty() && p.peek() != ',' && p.peek() != ';' && p.peek() != '"' && p.peek() != '<' &&
+		!isAtextStart(p.s) {
+		return a, p.errorf("unexpected %q after address", p.peek())
+	}
+
+	// Before display names were common the name went into a comment,
+	// eg. "john@example.com (John Doe)"
+	if a.Name == "" && len(p.comments) != 0 {
+		a.Name = p.comments[len(p.comments)-1]
+	}
+	a.Comments = p.comments
+	a.Raw = strings.TrimSpace(p.input[start:p.pos()])
+	a.AddressText = a.String()
+	return a, nil
+}
+
+func isAtextStart(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return isAtext(r, false, false, false)
+}
+
+// parseDisplayName reads the phrase before an angle-addr or a group ':'.
+// Unquoted specials are accepted, only the terminator ends the name
+func (p *addressParser) parseDisplayName(terminator byte) (string, error) {
+	var words []string
+
+	for {
+		if err := p.skipCFWS(); err != nil {
+			return "", err
+		}
+		if p.empty() || p.peek() == terminator {
+			break
+		}
+
+		if p.peek() == '"' {
+			start := p.pos()
+			qs, err := p.consumeQuotedString()
+			if err != nil {
+				return "", &AddressError{Err: err, Pos: start, Input: p.input}
+			}
+			words = append(words, qs)
+			continue
+		}
+
+		i := strings.IndexFunc(p.s, func(r rune) bool {
+			return isWSP(r) || r == '"' || r == '(' || r == rune(terminator)
+		})
+		if i < 0 {
+			i = p.len()
+		}
+		if !utf8.ValidString(p.s[:i]) {
+			return "", p.errorf("invalid utf-8 in display name")
+		}
+		words = append(words, p.s[:i])
+		p.s = p.s[i:]
+	}
+
+	if p.empty() {
+		return "", p.errorf("expected %q after display name", terminator)
+	}
+
+	// Encoded words are decoded in quoted strings too, many clients put
+	// them there
+	return decodeHeader(strings.Join(words, " ")), nil
+}
+
+// skipRoute skips an obs-route, "@a.example,@b.example:" before the
+// addr-spec of an angle-addr
+func (p *addressParser) skipRoute() error {
+	if p.empty() || p.peek() != '@' {
+		return nil
+	}
+	i := strings.IndexByte(p.s, ':')
+	if i < 0 {
+		return p.errorf("unterminated obs-route")
+	}
+	p.s = p.s[i+1:]
+	return p.skipCFWS()
+}
+
+// addr-spec = local-part "@" domain
+func (p *addressParser) parseAddrSpec() (string, error) {
+	var local string
+	var err error
+
+	if p.empty() {
+		return "", p.errorf("missing addr-spec")
+	}
+
+	if p.peek() == '"' {
+		start := p.pos()
+		if local, err = p.consumeQuotedString(); err != nil {
+			return "", &AddressError{Err: err, Pos: start, Input: p.input}
+		}
+		if needsQuotedLocalPart(local) {
+			local = quoteString(local)
+		}
+	} else {
+		if local, err = p.consumeAtomText(true, false, false); err != nil {
+			return "", p.errorf("invalid local-part")
+		}
+	}
+
+	if err := p.skipCFWS(); err != nil {
+		return "", err
+	}
+	if !p.consume('@') {
+		return "", p.errorf("missing '@' in addr-spec")
+	}
+	if err := p.skipCFWS(); err != nil {
+		return "", err
+	}
+
+	var domain string
+	if !p.empty() && p.peek() == '[' {
+		start := p.pos()
+		if domain, err = p.parseNoFoldLiteral(); err != nil {
+			return "", &AddressError{Err: err, Pos: start, Input: p.input}
+		}
+	} else if domain, err = p.consumeAtomText(true, false, false); err != nil {
+		return "", p.errorf("invalid domain")
+	}
+
+	if strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") || strings.Contains(domain, "..") {
+		return "", p.errorf("invalid domain %q", domain)
+	}
+
+	return local + "@" + domain, nil
+}
+
+// needsQuotedLocalPart reports whether a local-part is not a dot-atom
+func needsQuotedLocalPart(local string) bool {
+	if local == "" || strings.HasPrefix(local, ".") || strings.HasSuffix(local, ".") || strings.Contains(local, "..") {
+		return true
+	}
+	for _, r := range local {
+		if !isAtext(r, true, false, false) {
+			return true
+		}
+	}
+	return false
+}
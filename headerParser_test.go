@@ -0,0 +1,142 @@
+package rfc2822
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseAddressList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []Address
+	}{
+		{
+			"a@example.com",
+			[]Address{{Address: "a@example.com", AddressText: "a@example.com", Raw: "a@example.com"}},
+		},
+		{
+			"John Doe <john@example.com>, \"Doe, Jane\" <jane@example.com>",
+			[]Address{
+				{Name: "John Doe", Address: "john@example.com", AddressText: "John Doe <john@example.com>", Raw: "John Doe <john@example.com>"},
+				{Name: "Doe, Jane", Address: "jane@example.com", AddressText: "\"Doe, Jane\" <jane@example.com>", Raw: "\"Doe, Jane\" <jane@example.com>"},
+			},
+		},
+		{
+			"=?ISO-8859-1?Q?Keld_J=F8rn_Simonsen?= (Keld) <keld@example.com>",
+			[]Address{{Name: "Keld Jørn Simonsen", Address: "keld@example.com", AddressText: "Keld =?utf-8?b?SsO4cm4=?= Simonsen <keld@example.com>", Comments: []string{"Keld"}, Raw: "=?ISO-8859-1?Q?Keld_J=F8rn_Simonsen?= (Keld) <keld@example.com>"}},
+		},
+		{
+			"john@example.com (John Doe)",
+			[]Address{{Name: "John Doe", Address: "john@example.com", AddressText: "John Doe <john@example.com>", Comments: []string{"John Doe"}, Raw: "john@example.com (John Doe)"}},
+		},
+		{
+			"Team: a@example.com, B <b@example.com>;, c@example.com",
+			[]Address{
+				{Address: "a@example.com", AddressText: "a@example.com", Group: "Team", Raw: "a@example.com"},
+				{Name: "B", Address: "b@example.com", AddressText: "B <b@example.com>", Group: "Team", Raw: "B <b@example.com>"},
+				{Address: "c@example.com", AddressText: "c@example.com", Raw: "c@example.com"},
+			},
+		},
+		{
+			"undisclosed-recipients:;",
+			[]Address{{Group: "undisclosed-recipients", AddressText: "undisclosed-recipients:;", Raw: "undisclosed-recipients:;"}},
+		},
+		{
+			"<@relay.example,@other.example:a@example.com>",
+			[]Address{{Address: "a@example.com", AddressText: "a@example.com", Raw: "<@relay.example,@other.example:a@example.com>"}},
+		},
+		{
+			"a@example.com,, ,b@example.com",
+			[]Address{{Address: "a@example.com", AddressText: "a@example.com", Raw: "a@example.com"}, {Address: "b@example.com", AddressText: "b@example.com", Raw: "b@example.com"}},
+		},
+		{
+			"a@example.com b@example.com",
+			[]Address{{Address: "a@example.com", AddressText: "a@example.com", Raw: "a@example.com"}, {Address: "b@example.com", AddressText: "b@example.com", Raw: "b@example.com"}},
+		},
+		{
+			"a@example.com <a@example.com>",
+			[]Address{{Name: "a@example.com", Address: "a@example.com", AddressText: "\"a@example.com\" <a@example.com>", Raw: "a@example.com <a@example.com>"}},
+		},
+		{
+			"\"=?utf-8?q?J=C3=B6rg?=\" <jorg@example.com>",
+			[]Address{{Name: "Jörg", Address: "jorg@example.com", AddressText: "=?utf-8?b?SsO2cmc=?= <jorg@example.com>", Raw: "\"=?utf-8?q?J=C3=B6rg?=\" <jorg@example.com>"}},
+		},
+		{
+			"\"john doe\"@example.com, <john.doe@[127.0.0.1]",
+			[]Address{
+				{Address: "\"john doe\"@example.com", AddressText: "\"john doe\"@example.com", Raw: "\"john doe\"@example.com"},
+				{Address: "john.doe@[127.0.0.1]", AddressText: "john.doe@[127.0.0.1]", Raw: "<john.doe@[127.0.0.1]"},
+			},
+		},
+		{
+			"用户@例子.广告",
+			[]Address{{Address: "用户@例子.广告", AddressText: "用户@例子.广告", Raw: "用户@例子.广告"}},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseAddressList(tt.in)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseAddressListErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		pos int
+	}{
+		{"a@", 2},
+		{"a@example..com", 14},
+		{"John <john>", 10},
+		{"a@example.com (unclosed", 14},
+		{"Name <a@example.com> x", 22},
+		{": a@example.com;", 0},
+		{"\"unclosed <a@example.com>", 0},
+		{"<>", 1},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseAddressList(tt.in)
+		var addrErr *AddressError
+		if !errors.As(err, &addrErr) {
+			t.Errorf("%q: got error %v, want an AddressError", tt.in, err)
+			continue
+		}
+		if addrErr.Pos != tt.pos || addrErr.Input != tt.in {
+			t.Errorf("%q: got position %d, want %d: %v", tt.in, addrErr.Pos, tt.pos, err)
+		}
+	}
+}
+
+func TestParseReturnPath(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []Address
+	}{
+		{"<>", []Address{{Raw: "<>"}}},
+		{" < > (bounce)", []Address{{Comments: []string{"bounce"}, Raw: "<>"}}},
+		{"<bounce@example.com>", []Address{{Address: "bounce@example.com", AddressText: "bounce@example.com", Raw: "<bounce@example.com>"}}},
+	}
+
+	for _, tt := range tests {
+		got, err := parseReturnPath(tt.in)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+
+	if _, err := parseReturnPath("<> x"); err == nil {
+		t.Error("no error for text after the null reverse-path")
+	}
+}
@@ -5,17 +5,22 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
-	"mime"
 	"mime/quotedprintable"
-	"net/mail"
 	"strings"
 )
 
 func ParseContentType(s string) (ct ContentType, err error) {
-	mdType, params, err := mime.ParseMediaType(s)
+	ct, _, err = parseContentType(s)
+	return
+}
+
+// parseContentType is ParseContentType but also returns the problems found
+// in the params
+func parseContentType(s string) (ct ContentType, defects []Defect, err error) {
+	mdType, params, defects, err := ParseMediaType(s)
 
 	if err != nil {
-		return ContentType{}, err
+		return ContentType{}, nil, err
 	}
 
 	types := strings.Split(mdType, "/")
@@ -43,21 +48,21 @@ func Contains(val string, items []string) bool {
 	Note:
 	The MIME specifications specify that the proper method for encoding Content-Type and Content-Disposition parameter values is the method described in rfc2231.
 	However, it is common for some older email clients to improperly encode using the method described in rfc2047 instead.
-	mime.ParseMediaType takes care of rfc2231 specs of encoded parameter types and decode it to utf-8
-	but it will not handle rfc2047 type encoding and will return an error
+	ParseMediaType handles both, unlike mime.ParseMediaType which fails on rfc2047 encoded params
 
-	eg, this works
+	eg, both of these work
 	name*0*=utf-8''%D0%AD%D1%82%D0%BE%20%D1%80%D1%83%D1%81%D1%81%D0%BA%D0%BE;\n\tname*1*=%D0%B5%20%D0%B8%D0%BC%D1%8F%20%D1%84%D0%B0%D0%B9%D0%BB%D0%B0.txt"
-	but this does not
 	name=\"=?utf-8?b?0K3RgtC+INGA0YPRgdGB0LrQvtC1INC40LzRjyDRhNCw0LnQu9CwLnR4?=\n\t=?utf-8?q?t?=\"
-
-	// TODO: Try to catch exact parsing errors, like in this case say something like
-	"badly encoded content disposition param" instead of a genereic "bad mime"
 */
 func ParseContentDisposition(s string) (ct ContentDisposition, err error) {
-	ct.MediaType, ct.Params, err = mime.ParseMediaType(s)
+	ct, _, err = parseContentDisposition(s)
+	return
+}
+
+func parseContentDisposition(s string) (ct ContentDisposition, defects []Defect, err error) {
+	ct.MediaType, ct.Params, defects, err = ParseMediaType(s)
 	if err != nil {
-		return ContentDisposition{}, err
+		return ContentDisposition{}, nil, err
 	}
 
 	return
@@ -67,6 +72,10 @@ func ParseContentDisposition(s string) (ct ContentDisposition, err error) {
 // bufio.ReadBytes keeps reading till it finds the delim
 // but it could be used to feed the parser very long bad data
 func readBytesWithLimit(r *bufio.Reader, delim byte, limit int) ([]byte, error) {
+	if limit < 0 {
+		limit = int(^uint(0) >> 1)
+	}
+
 	var frag []byte
 	var full [][]byte
 	var err error
@@ -76,7 +85,7 @@ func readBytesWithLimit(r *bufio.Reader, delim byte, limit int) ([]byte, error)
 
 		if n >= limit {
 			// Limit reached, don't read anymore
-			err = errMaxLineLength
+			err = ErrMaxLineLength
 			break
 		}
 
@@ -110,6 +119,11 @@ func readBytesWithLimit(r *bufio.Reader, delim byte, limit int) ([]byte, error)
 
 	n += len(frag)
 
+	// The line fit in the buffer, so the loop above never checked it
+	if err == nil && n > limit {
+		err = ErrMaxLineLength
+	}
+
 	// Allocate new buffer to hold the full pieces and the fragment.
 	buf := make([]byte, n)
 	n = 0
@@ -121,6 +135,30 @@ func readBytesWithLimit(r *bufio.Reader, delim byte, limit int) ([]byte, error)
 	return buf, err
 }
 
+// sizeLimitReader fails once more than limit bytes are read from r. It
+// reads one byte past the limit so that a message of exactly limit bytes
+// is still accepted
+type sizeLimitReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	if l.n > l.limit {
+		return 0, &LimitError{ErrMaxMessageSize, l.limit}
+	}
+	if left := l.limit - l.n + 1; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		return n, &LimitError{ErrMaxMessageSize, l.limit}
+	}
+	return n, err
+}
+
 func validHeaderKeyByte(b byte) bool {
 	c := int(b)
 	return c >= 33 && c <= 126 && c != ':'
@@ -142,19 +180,18 @@ func encodingReader(enc string, r io.Reader) (io.Reader, error) {
 	return dec, nil
 }
 
-func parseAddress(headerVal string) ([]*mail.Address, error) {
-	decodedAddr := decodeToUTF8Base64Header(headerVal)
-	ret, err := mail.ParseAddressList(decodedAddr)
-	if err != nil {
-		switch err.Error() {
-		case "mail: expected comma":
-			return mail.ParseAddressList(ensureCommaDelimitedAddresses(decodedAddr))
-		case "mail: no address":
-			return nil, mail.ErrHeaderNotPresent
-		}
-		return nil, err
+// https://datatracker.ietf.org/doc/html/rfc2046#section-5.2.1
+// message/rfc822 parts can only use 7bit, 8bit or binary encoding.
+// Anything else is treated as an opaque body
+func isIdentityEncoding(enc []string) bool {
+	if len(enc) == 0 {
+		return true
+	}
+	switch strings.ToLower(strings.TrimSpace(enc[0])) {
+	case "7bit", "8bit", "binary", "":
+		return true
 	}
-	return ret, nil
+	return false
 }
 
 func IsInternational(val string) bool {
@@ -166,62 +203,3 @@ func IsInternational(val string) bool {
 
 	return false
 }
-
-// Used by AddressList to ensure that address lists are properly delimited
-func ensureCommaDelimitedAddresses(s string) string {
-	// This normalizes the whitespace, but may interfere with CFWS (comments with folding whitespace)
-	// RFC-5322 3.4.0:
-	//      because some legacy implementations interpret the comment,
-	//      comments generally SHOULD NOT be used in address fields
-	//      to avoid confusing such implementations.
-	s = strings.Join(strings.Fields(s), " ")
-
-	inQuotes := false
-	inDomain := false
-	escapeSequence := false
-	sb := strings.Builder{}
-	for _, r := range s {
-		if escapeSequence {
-			escapeSequence = false
-			sb.WriteRune(r)
-			continue
-		}
-		if r == '"' {
-			inQuotes = !inQuotes
-			sb.WriteRune(r)
-			continue
-		}
-		if inQuotes {
-			if r == '\\' {
-				escapeSequence = true
-				sb.WriteRune(r)
-				continue
-			}
-		} else {
-			if r == '@' {
-				inDomain = true
-				sb.WriteRune(r)
-				continue
-			}
-			if inDomain {
-				if r == ';' {
-					sb.WriteRune(r)
-					break
-				}
-				if r == ',' {
-					inDomain = false
-					sb.WriteRune(r)
-					continue
-				}
-				if r == ' ' {
-					inDomain = false
-					sb.WriteRune(',')
-					sb.WriteRune(r)
-					continue
-				}
-			}
-		}
-		sb.WriteRune(r)
-	}
-	return sb.String()
-}
@@ -0,0 +1,103 @@
+package rfc2822
+
+import "errors"
+
+// ErrSkipPart is returned by PartHooks.PartHeader to skip the body of a
+// part, or all the bodies of a multipart or encapsulated message
+var ErrSkipPart = errors.New("Skip part")
+
+/*
+	PartHooks are called as the parser goes through every part of a
+	message, multiparts and encapsulated messages included, see WithHooks.
+	Any of them may be nil. An error returned by a hook stops parsing,
+	except ErrSkipPart returned by PartHeader.
+
+	For each part PartStart, PartHeader and PartEnd are called in that
+	order, and the PartEnd of a part comes after those of its child parts.
+	The hooks of a part run before its BodyCallback, or before
+	Reader.NextPart returns it. When parsing stops on an error PartEnd is
+	still called for the parts left open, its error is ignored then.
+
+	Example, to leave out executables:
+	WithHooks(PartHooks{
+		PartHeader: func(n *Node) error {
+			if n.ContentType.SubType == "x-msdownload" {
+				return ErrSkipPart
+			}
+			return nil
+		},
+	})
+*/
+type PartHooks struct {
+	// A part starts, only its Path and HeaderStart are set
+	PartStart func(node *Node) error
+	// The header of a part is parsed, its body is not read yet. Bodies
+	// skipped with ErrSkipPart are discarded without decoding, see
+	// Node.Skip, and they are not given to the BodyCallback nor returned
+	// by Reader.NextPart
+	PartHeader func(node *Node) error
+	// A part ended, its offsets, sizes and defects are final. Preamble
+	// and epilogue of a multipart are set if they are stored
+	PartEnd func(node *Node) error
+	// A defect was found in a part, it is in Node.Defects as well
+	Defect func(node *Node, defect Defect) error
+}
+
+// WithHooks calls hooks while parsing, see PartHooks
+func WithHooks(hooks PartHooks) Option {
+	return func(o *ParserOptions) {
+		o.Hooks = hooks
+	}
+}
+
+func (mt *mimeTree) partStart(n *Node) error {
+	if mt.opts.Hooks.PartStart == nil {
+		return nil
+	}
+	return mt.opts.Hooks.PartStart(n)
+}
+
+// partHeader reports the defects found in the header of n, then calls the
+// PartHeader hook
+func (mt *mimeTree) partHeader(n *Node) error {
+	if err := mt.reportDefects(n); err != nil {
+		return err
+	}
+	if mt.opts.Hooks.PartHeader == nil {
+		return nil
+	}
+
+	err := mt.opts.Hooks.PartHeader(n)
+	if err == ErrSkipPart {
+		n.tstate.skipPart = true
+		return nil
+	}
+	return err
+}
+
+func (mt *mimeTree) partEnd(n *Node) error {
+	if err := mt.reportDefects(n); err != nil {
+		return err
+	}
+	if mt.opts.Hooks.PartEnd == nil {
+		return nil
+	}
+	return mt.opts.Hooks.PartEnd(n)
+}
+
+// reportDefects calls the Defect hook for the defects of n it was not
+// called for yet
+func (mt *mimeTree) reportDefects(n *Node) error {
+	defects := n.Defects[n.tstate.reportedDefects:]
+	n.tstate.reportedDefects = len(n.Defects)
+
+	if mt.opts.Hooks.Defect == nil {
+		return nil
+	}
+	for _, d := range defects {
+		if err := mt.opts.Hooks.Defect(n, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package rfc2822
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const hooksMessage = "Subject: hooks\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"first\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"plain\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<b>html</b>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"Subject: attached\r\n" +
+	"\r\n" +
+	"attached body\r\n" +
+	"--outer--\r\n"
+
+// recordHooks logs the hook calls and the bodies given to the body callback
+func recordHooks(log *[]string) (PartHooks, BodyCallback) {
+	hooks := PartHooks{
+		PartStart: func(n *Node) error {
+			*log = append(*log, fmt.Sprint("start ", n.Path))
+			return nil
+		},
+		PartHeader: func(n *Node) error {
+			*log = append(*log, fmt.Sprint("header ", n.Path))
+			return nil
+		},
+		PartEnd: func(n *Node) error {
+			*log = append(*log, fmt.Sprint("end ", n.Path))
+			return nil
+		},
+		Defect: func(n *Node, d Defect) error {
+			*log = append(*log, fmt.Sprint("defect ", n.Path, " ", d.Type))
+			return nil
+		},
+	}
+	bc := func(n *Node) error {
+		body, err := ioutil.ReadAll(n)
+		*log = append(*log, fmt.Sprintf("body %v %s", n.Path, body))
+		return err
+	}
+	return hooks, bc
+}
+
+func TestHooksOrder(t *testing.T) {
+	var log []string
+	hooks, bc := recordHooks(&log)
+	if _, err := ParseMime(strings.NewReader(hooksMessage), bc, nil, false, WithHooks(hooks)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{
+		"start [1]", "header [1]",
+		"start [1 1]", "header [1 1]", "body [1 1] first", "end [1 1]",
+		"start [1 2]", "header [1 2]",
+		"start [1 2 1]", "header [1 2 1]", "body [1 2 1] plain", "end [1 2 1]",
+		"start [1 2 2]", "header [1 2 2]", "body [1 2 2] <b>html</b>", "end [1 2 2]",
+		"end [1 2]",
+		"start [1 3]", "header [1 3]",
+		"start [1 3 1]", "header [1 3 1]", "body [1 3 1] attached body", "end [1 3 1]",
+		"end [1 3]",
+		"end [1]",
+	}
+	if !reflect.DeepEqual(log, want) {
+		t.Errorf("got calls\n%q\nwant\n%q", log, want)
+	}
+}
+
+func TestHooksReader(t *testing.T) {
+	var log []string
+	hooks, bc := recordHooks(&log)
+	_, err := ParseMime(strings.NewReader(hooksMessage), bc, nil, false, WithHooks(hooks))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := log
+
+	log = nil
+	r := NewReader(strings.NewReader(hooksMessage), WithHooks(hooks))
+	for {
+		n, _, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := bc(n); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if !reflect.DeepEqual(log, want) {
+		t.Errorf("got calls\n%q\nwant\n%q", log, want)
+	}
+}
+
+func TestHooksSkipPart(t *testing.T) {
+	var log []string
+	hooks, bc := recordHooks(&log)
+	hooks.PartHeader = func(n *Node) error {
+		// Skips the alternative subtree and the encapsulated message
+		if n.ContentType.Type == "multipart" && n.ContentType.SubType == "alternative" ||
+			n.ContentType.Type == "message" {
+			return ErrSkipPart
+		}
+		return nil
+	}
+	root, err := ParseMime(strings.NewReader(hooksMessage), bc, nil, false, WithHooks(hooks))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var bodies []string
+	for _, l := range log {
+		if strings.HasPrefix(l, "body ") {
+			bodies = append(bodies, l)
+		}
+	}
+	if want := []string{"body [1 1] first"}; !reflect.DeepEqual(bodies, want) {
+		t.Errorf("got bodies %q, want %q", bodies, want)
+	}
+
+	// Skipped parts are still in the tree, with their offsets
+	alternative := root.ChildNodes[1]
+	if len(alternative.ChildNodes) != 2 {
+		t.Fatalf("got %d alternative parts, want 2", len(alternative.ChildNodes))
+	}
+	html := alternative.ChildNodes[1]
+	if got := hooksMessage[html.BodyStart:html.BodyEnd]; got != "<b>html</b>" || html.Size != 0 {
+		t.Errorf("got skipped body %q of size %d", got, html.Size)
+	}
+	if attached := root.ChildNodes[2].ChildNodes[0]; attached.Size != 0 {
+		t.Errorf("got skipped attached size %d", attached.Size)
+	}
+}
+
+func TestHooksSkipPartReader(t *testing.T) {
+	r := NewReader(strings.NewReader(hooksMessage), WithHooks(PartHooks{
+		PartHeader: func(n *Node) error {
+			if n.ContentType.SubType == "plain" {
+				return ErrSkipPart
+			}
+			return nil
+		},
+	}))
+
+	var paths []string
+	for {
+		n, _, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		paths = append(paths, fmt.Sprint(n.Path))
+	}
+	if want := []string{"[1 2 2]"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("got parts %q, want %q", paths, want)
+	}
+}
+
+func TestHooksDefects(t *testing.T) {
+	msg := strings.TrimSuffix(defectsMessage, "--b--\r\n")
+
+	var log []string
+	hooks, _ := recordHooks(&log)
+	root, err := ParseMime(strings.NewReader(msg), nil, nil, false, WithLenientParsing(), WithHooks(hooks))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Every defect is reported once, before the PartEnd of its part
+	reported := map[string]int{}
+	ended := map[string]bool{}
+	for _, l := range log {
+		if strings.HasPrefix(l, "end ") {
+			ended[strings.TrimPrefix(l, "end ")] = true
+		}
+		if strings.HasPrefix(l, "defect ") {
+			reported[l]++
+			path := l[len("defect ") : strings.Index(l, "]")+1]
+			if ended[path] {
+				t.Errorf("%q reported after the part ended", l)
+			}
+		}
+	}
+
+	var want int
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		for _, d := range n.Defects {
+			want++
+			if l := fmt.Sprint("defect ", n.Path, " ", d.Type); reported[l] != 1 {
+				t.Errorf("%q reported %d times", l, reported[l])
+			}
+		}
+		for _, c := range n.ChildNodes {
+			walk(c)
+		}
+	}
+	walk(root)
+
+	if want == 0 || len(reported) > want {
+		t.Errorf("got %d defects reported for %d defects", len(reported), want)
+	}
+	if reported["defect [1] "+string(DefectMissingCloseBoundary)] != 1 {
+		t.Errorf("missing close boundary not reported: %q", log)
+	}
+}
+
+func TestHooksErrors(t *testing.T) {
+	errHook := errors.New("Hook failed")
+	fail := func(n *Node) error {
+		if fmt.Sprint(n.Path) == "[1 2 1]" {
+			return errHook
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name  string
+		hooks PartHooks
+	}{
+		{"start", PartHooks{PartStart: fail}},
+		{"header", PartHooks{PartHeader: fail}},
+		{"end", PartHooks{PartEnd: fail}},
+	}
+
+	for _, tt := range tests {
+		var ended []string
+		hooks := tt.hooks
+		if hooks.PartEnd == nil {
+			hooks.PartEnd = func(n *Node) error {
+				ended = append(ended, fmt.Sprint(n.Path))
+				return nil
+			}
+		}
+
+		root, err := ParseMime(strings.NewReader(hooksMessage), readAllCallback, nil, false, WithHooks(hooks))
+		var parseErr *ParseError
+		if !errors.Is(err, errHook) || !errors.As(err, &parseErr) {
+			t.Errorf("%s: got error %v, want a ParseError for %v", tt.name, err, errHook)
+		}
+		if root == nil || len(root.ChildNodes) != 2 {
+			t.Errorf("%s: got partial tree %v", tt.name, root)
+		}
+		// The parts left open are still ended
+		if tt.hooks.PartEnd == nil && (len(ended) == 0 || ended[len(ended)-1] != "[1]") {
+			t.Errorf("%s: got parts ended %q", tt.name, ended)
+		}
+	}
+}
+
+func TestHooksSkipPartError(t *testing.T) {
+	// ErrSkipPart only means something from PartHeader
+	_, err := ParseMime(strings.NewReader(hooksMessage), nil, nil, false, WithHooks(PartHooks{
+		PartStart: func(n *Node) error {
+			if len(n.Path) == 2 {
+				return ErrSkipPart
+			}
+			return nil
+		},
+	}))
+	if !errors.Is(err, ErrSkipPart) {
+		t.Errorf("got error %v, want %v", err, ErrSkipPart)
+	}
+}
@@ -0,0 +1,572 @@
+package rfc2822
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errModifiedSource = errors.New("Message was modified after parsing")
+
+// Date format of the ENVELOPE date, as in the Date field
+const imapEnvelopeDate = "Mon, 02 Jan 2006 15:04:05 -0700"
+
+/*
+	IMAPBodyStructure renders a parsed message as the IMAP BODYSTRUCTURE
+	s-expression, RFC 3501 section 7.4.2 and RFC 9051 section 7.5.2, with
+	the extension data. The node is usually the root returned by ParseMime.
+
+	Sizes and line counts are those of the raw, still encoded, bodies.
+	Encapsulated messages are rendered with their envelope and structure
+	when they were parsed, ie. when their transfer encoding is 7bit, 8bit or
+	binary.
+
+	Example:
+	("text" "plain" ("charset" "utf-8") NIL NIL "quoted-printable" 1315 42 NIL NIL NIL NIL)
+*/
+func IMAPBodyStructure(n *Node) string {
+	var sb strings.Builder
+	writeIMAPBody(&sb, n, true)
+	return sb.String()
+}
+
+// IMAPBody renders a parsed message as the IMAP BODY s-expression, which is
+// BODYSTRUCTURE without the extension data
+func IMAPBody(n *Node) string {
+	var sb strings.Builder
+	writeIMAPBody(&sb, n, false)
+	return sb.String()
+}
+
+/*
+	IMAPEnvelope renders formatted header fields as the IMAP ENVELOPE
+	s-expression, RFC 3501 section 7.4.2. Sender and Reply-To default to
+	From when missing, as the RFC requires. The date is the Date field as
+	it was written, see FormattedRootHeaders.RawDate, or Date formatted
+	when it is not set.
+
+	Example:
+	sm, _ := FormatHeaders(root)
+	IMAPEnvelope(sm) == `("Mon, 7 Feb 1994 21:52:25 -0800" "Hello" (("Fred" NIL "fred" "example.com")) ...`
+*/
+func IMAPEnvelope(sm FormattedRootHeaders) string {
+	var sb strings.Builder
+	writeIMAPEnvelope(&sb, sm)
+	return sb.String()
+}
+
+func writeIMAPEnvelope(sb *strings.Builder, sm FormattedRootHeaders) {
+	date := sm.RawDate
+	if date == "" && !sm.Date.IsZero() {
+		date = sm.Date.Format(imapEnvelopeDate)
+	}
+
+	sender, replyTo := sm.Sender, sm.ReplyTo
+	if len(sender) == 0 {
+		sender = sm.From
+	}
+	if len(replyTo) == 0 {
+		replyTo = sm.From
+	}
+
+	sb.WriteString("(")
+	sb.WriteString(imapNString(date))
+	sb.WriteString(" " + imapNString(sm.Subject))
+	for _, addrs := range [][]Address{sm.From, sender, replyTo, sm.To, sm.Cc, sm.Bcc} {
+		sb.WriteString(" ")
+		writeIMAPAddressList(sb, addrs)
+	}
+	// Message ids are kept with their angle brackets
+	sb.WriteString(" " + imapNString(strings.Join(sm.InReplyTo, " ")))
+	sb.WriteString(" " + imapNString(sm.MessageID))
+	sb.WriteString(")")
+}
+
+// writeIMAPAddressList writes the addresses, a group is written as a group
+// start address, the members and a group end address
+func writeIMAPAddressList(sb *strings.Builder, addrs []Address) {
+	if len(addrs) == 0 {
+		sb.WriteString("NIL")
+		return
+	}
+
+	sb.WriteString("(")
+	group := ""
+	for _, a := range addrs {
+		if a.Group != group {
+			if group != "" {
+				sb.WriteString("(NIL NIL NIL NIL)")
+			}
+			if a.Group != "" {
+				sb.WriteString("(NIL NIL " + imapString(a.Group) + " NIL)")
+			}
+			group = a.Group
+		}
+		if a.Address == "" {
+			continue
+		}
+
+		// A NIL host marks a group, an address without a domain gets an
+		// empty one
+		mailbox, host := a.Address, ""
+		if i := strings.LastIndexByte(a.Address, '@'); i >= 0 {
+			mailbox, host = a.Address[:i], a.Address[i+1:]
+		}
+		name := ""
+		if a.Name != "" {
+			name = encodeWords(a.Name, phraseContext)
+		}
+		sb.WriteString("(" + imapNString(name) + " NIL " + imapString(mailbox) + " " + imapString(host) + ")")
+	}
+	if group != "" {
+		sb.WriteString("(NIL NIL NIL NIL)")
+	}
+	sb.WriteString(")")
+}
+
+func writeIMAPBody(sb *strings.Builder, n *Node, extended bool) {
+	if n.ContentType.Type == "multipart" {
+		writeIMAPMultipart(sb, n, extended)
+		return
+	}
+
+	ct := n.ContentType
+	if ct.Type == "" {
+		ct = ContentType{Type: "text", SubType: "plain"}
+	}
+	params := ct.Params
+	if ct.Type == "text" && params["charset"] == "" {
+		params = map[string]string{"charset": "us-ascii"}
+		for k, v := range ct.Params {
+			if k != "charset" {
+				params[k] = v
+			}
+		}
+	}
+	encoding := strings.ToLower(n.contentTransferEncoding())
+	if encoding == "" {
+		encoding = "7bit"
+	}
+
+	sb.WriteString("(")
+	sb.WriteString(imapString(ct.Type) + " " + imapString(ct.SubType) + " ")
+	writeIMAPParams(sb, params)
+	sb.WriteString(" " + imapNString(imapHeader(n, "content-id")))
+	sb.WriteString(" " + imapNString(imapHeader(n, "content-description")))
+	sb.WriteString(" " + imapString(encoding))
+	sb.WriteString(" " + strconv.FormatInt(n.RawSize, 10))
+
+	switch {
+	case n.IsMessage() && len(n.ChildNodes) != 0:
+		// The encapsulated message is the only child of the part
+		msg := n.ChildNodes[0]
+		sb.WriteString(" ")
+		writeIMAPEnvelope(sb, envelopeHeaders(msg))
+		sb.WriteString(" ")
+		writeIMAPBody(sb, msg, extended)
+		sb.WriteString(" " + strconv.Itoa(n.LineCount))
+	case ct.Type == "text":
+		sb.WriteString(" " + strconv.Itoa(n.LineCount))
+	}
+
+	if extended {
+		sb.WriteString(" " + imapNString(imapHeader(n, "content-md5")))
+		writeIMAPExtension(sb, n)
+	}
+	sb.WriteString(")")
+}
+
+func writeIMAPMultipart(sb *strings.Builder, n *Node, extended bool) {
+	sb.WriteString("(")
+	if len(n.ChildNodes) == 0 {
+		// A multipart needs at least one part, RFC 3501 has no way to
+		// express an empty one
+		sb.WriteString(`("text" "plain" ("charset" "us-ascii") NIL NIL "7bit" 0 0)`)
+	}
+	for _, child := range n.ChildNodes {
+		writeIMAPBody(sb, child, extended)
+	}
+	sb.WriteString(" " + imapString(n.ContentType.SubType))
+
+	if extended {
+		sb.WriteString(" ")
+		writeIMAPParams(sb, n.ContentType.Params)
+		writeIMAPExtension(sb, n)
+	}
+	sb.WriteString(")")
+}
+
+// writeIMAPExtension writes the disposition, language and location shared
+// by all parts
+func writeIMAPExtension(sb *strings.Builder, n *Node) {
+	sb.WriteString(" ")
+	if n.ContentDisposition.MediaType == "" {
+		sb.WriteString("NIL")
+	} else {
+		sb.WriteString("(" + imapString(n.ContentDisposition.MediaType) + " ")
+		writeIMAPParams(sb, n.ContentDisposition.Params)
+		sb.WriteString(")")
+	}
+
+	var languages []string
+	for _, lang := range strings.Split(imapHeader(n, "content-language"), ",") {
+		if lang = strings.TrimSpace(lang); lang != "" {
+			languages = append(languages, imapString(lang))
+		}
+	}
+	switch len(languages) {
+	case 0:
+		sb.WriteString(" NIL")
+	case 1:
+		sb.WriteString(" " + languages[0])
+	default:
+		sb.WriteString(" (" + strings.Join(languages, " ") + ")")
+	}
+
+	// URLs are folded anywhere, the whitespace is not part of them, RFC 2557
+	// section 4.4.1
+	location := strings.Join(strings.Fields(imapHeader(n, "content-location")), "")
+	sb.WriteString(" " + imapNString(location))
+}
+
+// writeIMAPParams writes params sorted by name, or NIL when there are none
+func writeIMAPParams(sb *strings.Builder, params map[string]string) {
+	if len(params) == 0 {
+		sb.WriteString("NIL")
+		return
+	}
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sb.WriteString("(")
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteString(" ")
+		}
+		sb.WriteString(imapString(name) + " " + imapString(params[name]))
+	}
+	sb.WriteString(")")
+}
+
+// imapHeader returns the unfolded value of the last name field of n
+func imapHeader(n *Node, name string) string {
+	v := n.ParsedHeader[name]
+	if len(v) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(linebreak.ReplaceAllString(v[len(v)-1], " "))
+}
+
+// imapString returns s as a quoted string, or as a literal when it has
+// characters a quoted string can't hold
+func imapString(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0 || s[i] == '\r' || s[i] == '\n' || s[i] >= 0x80 {
+			return "{" + strconv.Itoa(len(s)) + "}\r\n" + s
+		}
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// imapNString is imapString but returns NIL for an empty s
+func imapNString(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+	return imapString(s)
+}
+
+// envelopeHeaders formats the fields of an encapsulated message needed for
+// its envelope. Unlike FormatHeaders it skips the malformed fields, a bad
+// attached message must not break the structure of the message holding it
+func envelopeHeaders(n *Node) FormattedRootHeaders {
+	sm := NewFormattedRootHeaders()
+
+	if v := n.ParsedHeader["subject"]; len(v) != 0 {
+		sm.Subject = decodeToUTF8Base64Header(v[len(v)-1])
+	}
+	if v := n.ParsedHeader["date"]; len(v) != 0 {
+		sm.Date, _ = mail.ParseDate(v[len(v)-1])
+		sm.RawDate = imapHeader(n, "date")
+	}
+	if v := n.ParsedHeader["message-id"]; len(v) != 0 {
+		if ids, _ := MsgIDList(v[len(v)-1]); len(ids) != 0 {
+			sm.MessageID = ids[0]
+		}
+	}
+	for _, v := range n.ParsedHeader["in-reply-to"] {
+		ids, _ := MsgIDList(v)
+		sm.InReplyTo = append(sm.InReplyTo, ids...)
+	}
+
+	fields := map[string]*[]Address{
+		"from":     &sm.From,
+		"sender":   &sm.Sender,
+		"reply-to": &sm.ReplyTo,
+		"to":       &sm.To,
+		"cc":       &sm.Cc,
+		"bcc":      &sm.Bcc,
+	}
+	for name, addrs := range fields {
+		for _, v := range n.ParsedHeader[name] {
+			if parsed, err := ParseAddressList(v); err == nil {
+				*addrs = append(*addrs, parsed...)
+			}
+		}
+	}
+
+	return sm
+}
+
+/*
+	FetchSection returns the bytes an IMAP FETCH of BODY[section] delivers,
+	RFC 3501 section 6.4.5, sliced out of the message as it was received.
+	See FetchNodeSection for the section syntax.
+
+	Example:
+	FetchSection(bytes.NewReader(msg), "2.HEADER.FIELDS (From Subject)")
+*/
+func FetchSection(msg io.Reader, section string) ([]byte, error) {
+	root, err := ParseMime(msg, nil, nil, false, WithRawRetained(), WithLenientParsing())
+	if err != nil {
+		return nil, err
+	}
+	return FetchNodeSection(root, section)
+}
+
+/*
+	FetchNodeSection is FetchSection for a message parsed with
+	WithRawRetained and not modified since. section is what goes between the
+	brackets of BODY[], optionally followed by a partial:
+
+	""                                   the whole message
+	HEADER, TEXT                         header (with the empty line) or body of the message
+	HEADER.FIELDS (From To)              only these fields, followed by the empty line
+	HEADER.FIELDS.NOT (Received)         all fields but these
+	1.2                                  body of a part, still encoded
+	1.2.MIME                             header of a part
+	2.HEADER, 2.TEXT, 2.1                the same for the message/rfc822 part 2
+	TEXT<0.1024>                         1024 bytes starting at offset 0
+
+	Part numbers are those of IMAP, which differ from Node.Path inside
+	message/rfc822 parts, and the body of a message which is not multipart
+	is part 1.
+*/
+func FetchNodeSection(root *Node, section string) ([]byte, error) {
+	if root.source == nil {
+		return nil, ErrNoRawSource
+	}
+	if !root.pristine() {
+		return nil, errModifiedSource
+	}
+
+	spec, partial, err := splitSectionPartial(section)
+	if err != nil {
+		return nil, err
+	}
+
+	parts, text, err := splitSectionParts(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid section %v: %v", section, err)
+	}
+
+	node, err := sectionNode(root, parts)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid section %v: %v", section, err)
+	}
+
+	var data []byte
+	keyword := strings.ToUpper(text)
+	switch {
+	case keyword == "":
+		if len(parts) == 0 {
+			data = root.source[root.HeaderStart:root.BodyEnd]
+		} else {
+			data = node.source[node.BodyStart:node.BodyEnd]
+		}
+	case keyword == "MIME":
+		if len(parts) == 0 {
+			return nil, fmt.Errorf("Invalid section %v: MIME needs a part number", section)
+		}
+		data = node.source[node.HeaderStart:node.BodyStart]
+	default:
+		// HEADER and TEXT apply to a message, the top one or an
+		// encapsulated one
+		msg := node
+		if len(parts) != 0 {
+			if !node.IsMessage() || len(node.ChildNodes) == 0 {
+				return nil, fmt.Errorf("Invalid section %v: part is not a message", section)
+			}
+			msg = node.ChildNodes[0]
+		}
+
+		switch {
+		case keyword == "HEADER":
+			data = msg.source[msg.HeaderStart:msg.BodyStart]
+		case keyword == "TEXT":
+			data = msg.source[msg.BodyStart:msg.BodyEnd]
+		case strings.HasPrefix(keyword, "HEADER.FIELDS"):
+			data, err = sectionHeaderFields(msg, text)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid section %v: %v", section, err)
+			}
+		default:
+			return nil, fmt.Errorf("Invalid section %v: unknown section text %v", section, text)
+		}
+	}
+
+	if partial != nil {
+		data = partialBytes(data, partial[0], partial[1])
+	}
+	return data, nil
+}
+
+// splitSectionPartial splits the <start.count> partial off a section
+func splitSectionPartial(section string) (string, []int64, error) {
+	section = strings.TrimSpace(section)
+	if !strings.HasSuffix(section, ">") {
+		return section, nil, nil
+	}
+
+	i := strings.LastIndexByte(section, '<')
+	if i < 0 {
+		return "", nil, fmt.Errorf("Invalid partial in section %v", section)
+	}
+	bounds := strings.Split(section[i+1:len(section)-1], ".")
+	if len(bounds) != 2 {
+		return "", nil, fmt.Errorf("Invalid partial in section %v", section)
+	}
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || start < 0 {
+		return "", nil, fmt.Errorf("Invalid partial in section %v", section)
+	}
+	count, err := strconv.ParseInt(bounds[1], 10, 64)
+	if err != nil || count <= 0 {
+		return "", nil, fmt.Errorf("Invalid partial in section %v", section)
+	}
+
+	return strings.TrimSpace(section[:i]), []int64{start, count}, nil
+}
+
+// splitSectionParts splits the leading part numbers off a section, the rest
+// is the section text
+func splitSectionParts(spec string) ([]int, string, error) {
+	var parts []int
+	for spec != "" && spec[0] >= '0' && spec[0] <= '9' {
+		end := strings.IndexByte(spec, '.')
+		if end < 0 {
+			end = len(spec)
+		}
+		part, err := strconv.Atoi(spec[:end])
+		if err != nil || part == 0 {
+			return nil, "", fmt.Errorf("invalid part number %v", spec[:end])
+		}
+		parts = append(parts, part)
+
+		spec = spec[end:]
+		if spec != "" {
+			// Skip the dot, there must be something after it
+			spec = spec[1:]
+			if spec == "" {
+				return nil, "", fmt.Errorf("trailing dot")
+			}
+		}
+	}
+	return parts, spec, nil
+}
+
+/*
+	sectionNode finds the node of the IMAP part numbers. The parts of a
+	message/rfc822 part are numbered as the parts of the encapsulated
+	message, whose node is the only child of the message/rfc822 node, and
+	the body of a message which is not multipart is its part 1
+*/
+func sectionNode(root *Node, parts []int) (*Node, error) {
+	node := root
+	message := true
+
+	for _, part := range parts {
+		if !message && node.IsMessage() && len(node.ChildNodes) != 0 {
+			node = node.ChildNodes[0]
+			message = true
+		}
+
+		switch {
+		case node.ContentType.Type == "multipart":
+			if part > len(node.ChildNodes) {
+				return nil, fmt.Errorf("no part %v", part)
+			}
+			node = node.ChildNodes[part-1]
+		case message && part == 1:
+			// The message body itself
+		default:
+			return nil, fmt.Errorf("no part %v", part)
+		}
+		message = false
+	}
+
+	return node, nil
+}
+
+// sectionHeaderFields returns the fields of msg listed in a HEADER.FIELDS or
+// HEADER.FIELDS.NOT section text, followed by the empty line
+func sectionHeaderFields(msg *Node, text string) ([]byte, error) {
+	open := strings.IndexByte(text, '(')
+	if open < 0 || !strings.HasSuffix(text, ")") {
+		return nil, fmt.Errorf("missing field list")
+	}
+	exclude := false
+	switch strings.ToUpper(strings.TrimSpace(text[:open])) {
+	case "HEADER.FIELDS":
+	case "HEADER.FIELDS.NOT":
+		exclude = true
+	default:
+		return nil, fmt.Errorf("unknown section text %v", text)
+	}
+
+	var names []string
+	for _, name := range strings.Fields(text[open+1 : len(text)-1]) {
+		// Field names may be sent as quoted strings
+		names = append(names, strings.Trim(name, `"`))
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("empty field list")
+	}
+
+	var buf bytes.Buffer
+	for _, f := range msg.RawHeaders {
+		if containsFold(f.Name, names) != exclude {
+			buf.Write(f.Raw)
+		}
+	}
+
+	terminator := msg.headerTerminator()
+	if terminator == nil {
+		terminator = []byte("\r\n")
+	}
+	buf.Write(terminator)
+
+	return buf.Bytes(), nil
+}
+
+// partialBytes returns count bytes of data starting at start, or less if
+// data is shorter
+func partialBytes(data []byte, start, count int64) []byte {
+	if start >= int64(len(data)) {
+		return []byte{}
+	}
+	end := start + count
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return data[start:end]
+}
@@ -0,0 +1,230 @@
+package rfc2822
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const imapMessage = "From: Fred Foobar <foobar@example.com>\r\n" +
+	"To: Team: a@example.com, b@example.com;\r\n" +
+	"Subject: afternoon meeting\r\n" +
+	"Date: Mon, 7 Feb 1994 21:52:25 -0800\r\n" +
+	"Message-ID: <B27397-0100000@example.com>\r\n" +
+	"In-Reply-To: <1@example.com>\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"Content-Language: en, de\r\n" +
+	"\r\n" +
+	"Gr=C3=BC=C3=9Fe\r\n" +
+	"two\r\n" +
+	"--b\r\n" +
+	"Content-Type: image/png; name=\"a.png\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"Content-ID: <logo@example.com>\r\n" +
+	"Content-Description: the logo\r\n" +
+	"Content-Disposition: inline; filename=a.png\r\n" +
+	"Content-Location: http://example.com/\r\n" +
+	" a.png\r\n" +
+	"\r\n" +
+	"iVBORw0KGgo=\r\n" +
+	"--b\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"From: Joe <joe@example.com>\r\n" +
+	"Subject: inner\r\n" +
+	"\r\n" +
+	"inner body\r\n" +
+	"--b--\r\n"
+
+func TestIMAPBodyStructure(t *testing.T) {
+	root, err := ParseMime(strings.NewReader(imapMessage), nil, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	inner := `(NIL "inner" (("Joe" NIL "joe" "example.com")) (("Joe" NIL "joe" "example.com")) (("Joe" NIL "joe" "example.com")) NIL NIL NIL NIL NIL)`
+
+	want := `(("text" "plain" ("charset" "utf-8") NIL NIL "quoted-printable" 20 2 NIL NIL ("en" "de") NIL)` +
+		`("image" "png" ("name" "a.png") "<logo@example.com>" "the logo" "base64" 12 NIL ("inline" ("filename" "a.png")) NIL "http://example.com/a.png")` +
+		`("message" "rfc822" NIL NIL NIL "7bit" 57 ` + inner + ` ("text" "plain" ("charset" "us-ascii") NIL NIL "7bit" 10 1 NIL NIL NIL NIL) 4 NIL NIL NIL NIL)` +
+		` "mixed" ("boundary" "b") NIL NIL NIL)`
+	if got := IMAPBodyStructure(root); got != want {
+		t.Errorf("got BODYSTRUCTURE\n%s\nwant\n%s", got, want)
+	}
+
+	want = `(("text" "plain" ("charset" "utf-8") NIL NIL "quoted-printable" 20 2)` +
+		`("image" "png" ("name" "a.png") "<logo@example.com>" "the logo" "base64" 12)` +
+		`("message" "rfc822" NIL NIL NIL "7bit" 57 ` + inner + ` ("text" "plain" ("charset" "us-ascii") NIL NIL "7bit" 10 1) 4)` +
+		` "mixed")`
+	if got := IMAPBody(root); got != want {
+		t.Errorf("got BODY\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestIMAPBodySinglePart(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{"Subject: x\r\n\r\none\r\ntwo\r\n", `("text" "plain" ("charset" "us-ascii") NIL NIL "7bit" 10 2)`},
+		{
+			"Content-Type: application/pdf; name=\"r\xc3\xa9sum\xc3\xa9.pdf\"\r\nContent-Transfer-Encoding: BASE64\r\n\r\nJVBERi0=\r\n",
+			"(\"application\" \"pdf\" (\"name\" {12}\r\nr\xc3\xa9sum\xc3\xa9.pdf) NIL NIL \"base64\" 10)",
+		},
+		{"Content-Type: text/html; charset=\"a\\\"b\"\r\n\r\n<p>\r\n", `("text" "html" ("charset" "a\"b") NIL NIL "7bit" 5 1)`},
+	}
+
+	for _, tt := range tests {
+		root, err := ParseMime(strings.NewReader(tt.msg), nil, nil, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := IMAPBody(root); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestIMAPEnvelope(t *testing.T) {
+	root, err := ParseMime(strings.NewReader(imapMessage), nil, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sm, err := FormatHeaders(root)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fred := `(("Fred Foobar" NIL "foobar" "example.com"))`
+	want := `("Mon, 7 Feb 1994 21:52:25 -0800" "afternoon meeting" ` + fred + " " + fred + " " + fred +
+		` ((NIL NIL "Team" NIL)(NIL NIL "a" "example.com")(NIL NIL "b" "example.com")(NIL NIL NIL NIL))` +
+		` NIL NIL "<1@example.com>" "<B27397-0100000@example.com>")`
+	if got := IMAPEnvelope(sm); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// The date is kept as written
+	msg := strings.Replace(imapMessage, "Date: Mon, 7 Feb 1994 21:52:25 -0800\r\n", "Date: Mon, 7 Feb 1994\r\n 21:52:25 -0800 (PST)\r\n", 1)
+	root, err = ParseMime(strings.NewReader(msg), nil, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sm, err = FormatHeaders(root)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := IMAPEnvelope(sm); !strings.HasPrefix(got, `("Mon, 7 Feb 1994 21:52:25 -0800 (PST)" `) {
+		t.Errorf("got %s", got)
+	}
+
+	// Formatted when there is only the parsed date
+	sm = NewFormattedRootHeaders()
+	sm.Date = time.Date(1994, 2, 7, 21, 52, 25, 0, time.FixedZone("", -8*60*60))
+	if got := IMAPEnvelope(sm); !strings.HasPrefix(got, `("Mon, 07 Feb 1994 21:52:25 -0800" NIL `) {
+		t.Errorf("got %s", got)
+	}
+
+	sm = NewFormattedRootHeaders()
+	sm.From = []Address{{Name: "Jörg", Address: "jorg@example.com"}}
+	sm.Sender = []Address{{Address: "local"}}
+	sm.Cc = []Address{{Group: "undisclosed-recipients"}}
+	want = `(NIL NIL ((` + `"=?utf-8?b?SsO2cmc=?=" NIL "jorg" "example.com")) ((NIL NIL "local" "")) ((` +
+		`"=?utf-8?b?SsO2cmc=?=" NIL "jorg" "example.com")) NIL ((NIL NIL "undisclosed-recipients" NIL)(NIL NIL NIL NIL)) NIL NIL NIL)`
+	if got := IMAPEnvelope(sm); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFetchSection(t *testing.T) {
+	header := imapMessage[:strings.Index(imapMessage, "\r\n\r\n")+4]
+	innerHeader := "From: Joe <joe@example.com>\r\nSubject: inner\r\n\r\n"
+
+	tests := []struct {
+		section string
+		want    string
+	}{
+		{"", imapMessage},
+		{"HEADER", header},
+		{"TEXT", imapMessage[len(header):]},
+		{"TEXT<0.4>", "--b\r"},
+		{"HEADER.FIELDS (From Subject)", "From: Fred Foobar <foobar@example.com>\r\nSubject: afternoon meeting\r\n\r\n"},
+		{"header.fields (\"SUBJECT\")", "Subject: afternoon meeting\r\n\r\n"},
+		{"HEADER.FIELDS.NOT (To Date Message-ID In-Reply-To Content-Type)", "From: Fred Foobar <foobar@example.com>\r\nSubject: afternoon meeting\r\n\r\n"},
+		{"1", "Gr=C3=BC=C3=9Fe\r\ntwo"},
+		{"1<5.1000>", "=BC=C3=9Fe\r\ntwo"},
+		{"1<100.10>", ""},
+		{"1.MIME", "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\nContent-Language: en, de\r\n\r\n"},
+		{"2", "iVBORw0KGgo="},
+		{"3", innerHeader + "inner body"},
+		{"3.MIME", "Content-Type: message/rfc822\r\n\r\n"},
+		{"3.HEADER", innerHeader},
+		{"3.TEXT", "inner body"},
+		{"3.1", "inner body"},
+		{"3.HEADER.FIELDS (Subject)", "Subject: inner\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		got, err := FetchSection(strings.NewReader(imapMessage), tt.section)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.section, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.section, got, tt.want)
+		}
+	}
+}
+
+func TestFetchSectionSinglePart(t *testing.T) {
+	msg := "Subject: x\nContent-Type: message/rfc822\n\nSubject: inner\n\nbody\n"
+
+	tests := []struct {
+		section string
+		want    string
+	}{
+		{"1", "Subject: inner\n\nbody\n"},
+		{"1.HEADER", "Subject: inner\n\n"},
+		{"1.1", "body\n"},
+		{"HEADER.FIELDS (Subject)", "Subject: x\n\n"},
+	}
+
+	for _, tt := range tests {
+		got, err := FetchSection(strings.NewReader(msg), tt.section)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.section, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.section, got, tt.want)
+		}
+	}
+}
+
+func TestFetchSectionErrors(t *testing.T) {
+	for _, section := range []string{"4", "0", "1.", "1.HEADER", "MIME", "1.2", "TEXT<1>", "TEXT<0.0>", "FOO", "HEADER.FIELDS ()", "HEADER.FIELDS From"} {
+		if _, err := FetchSection(strings.NewReader(imapMessage), section); err == nil {
+			t.Errorf("%q: no error", section)
+		}
+	}
+
+	root, err := ParseMime(strings.NewReader(imapMessage), nil, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := FetchNodeSection(root, "1"); err != ErrNoRawSource {
+		t.Errorf("got error %v, want %v", err, ErrNoRawSource)
+	}
+
+	root, err = ParseMime(strings.NewReader(imapMessage), nil, nil, false, WithRawRetained())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	root.SetHeader("Subject", "changed")
+	if _, err := FetchNodeSection(root, "1"); err != errModifiedSource {
+		t.Errorf("got error %v, want %v", err, errModifiedSource)
+	}
+}
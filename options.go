@@ -0,0 +1,143 @@
+package rfc2822
+
+/*
+	ParserOptions configures ParseMimeWithOptions.
+
+	For every limit a zero value means the package default (the MAX_*
+	constants) is used, and a negative value (NoLimit) disables the check.
+	Crossing a limit returns a *LimitError wrapping one of the ErrMax* errors
+*/
+type ParserOptions struct {
+	BodyCallback       BodyCallback
+	RootHeaderCallback RootHeaderCallback
+
+	// Number of mime nodes in the tree
+	MaxMimeNodes int
+	// Number of header lines of a single part
+	MaxHeaderLines int
+	// Octets in a single line, the buffer size by default, see
+	// MAX_LINE_OCTETS
+	MaxLineOctets int
+	// Depth of the mime tree, counting multipart and message/rfc822 nesting
+	MaxNestingDepth int
+	// Total octets of all the header sections of the message
+	MaxHeaderBytes int64
+	// Decoded octets of a single part body
+	MaxPartBytes int64
+	// Octets of the whole raw message
+	MaxMessageSize int64
+
+	// Size of the buffered reader wrapping the message
+	BufferReaderSize int
+	// Decoded octets of each leaf body kept in Node.Body, not a limit, zero
+	// keeps nothing. See WithBodyCapture
+	CaptureBodyBytes int64
+	// Override CaptureBodyBytes for the parts they match, see
+	// WithCapturePolicies
+	CapturePolicies []CapturePolicy
+
+	StorePreambleAndEpilogue bool
+	// See WithCharsetDecoding
+	DecodeCharset bool
+	// See WithLenientParsing
+	Lenient bool
+	// See WithRawRetained
+	RetainRaw bool
+	// See WithHooks
+	Hooks PartHooks
+}
+
+// Option changes the default behaviour of ParseMime
+type Option func(*ParserOptions)
+
+// WithCharsetDecoding converts text/* bodies to utf-8 from the charset
+// declared in their Content-Type. Bodies without a charset param or with an
+// unknown charset are returned as is
+func WithCharsetDecoding() Option {
+	return func(o *ParserOptions) {
+		o.DecodeCharset = true
+	}
+}
+
+// WithLenientParsing keeps parsing parts with a bad Content-Type,
+// Content-Disposition or Content-Transfer-Encoding. RFC 2045 defaults are
+// used instead and the problem is recorded in Node.Defects
+func WithLenientParsing() Option {
+	return func(o *ParserOptions) {
+		o.Lenient = true
+	}
+}
+
+// WithRawRetained keeps a copy of the raw message with the tree, so that
+// Node.WriteMessage can copy unmodified parts byte by byte. Preamble and
+// epilogue are stored as well
+func WithRawRetained() Option {
+	return func(o *ParserOptions) {
+		o.RetainRaw = true
+	}
+}
+
+// WithBodyCapture keeps the first n decoded bytes of every leaf body in
+// Node.Body, whether the body callback reads them, skips the part or leaves
+// the body unread
+func WithBodyCapture(n int64) Option {
+	return func(o *ParserOptions) {
+		o.CaptureBodyBytes = n
+	}
+}
+
+// DefaultParserOptions returns the options ParseMime uses
+func DefaultParserOptions() ParserOptions {
+	return ParserOptions{
+		MaxMimeNodes:     MAX_MIME_NODES,
+		MaxHeaderLines:   MAX_HEADER_LINES,
+		MaxLineOctets:    MAX_LINE_OCTETS,
+		MaxNestingDepth:  MAX_NESTING_DEPTH,
+		MaxHeaderBytes:   MAX_HEADER_BYTES,
+		MaxPartBytes:     MAX_PART_BYTES,
+		MaxMessageSize:   MAX_MESSAGE_SIZE,
+		BufferReaderSize: BufferReaderSize,
+	}
+}
+
+// withDefaults fills the zero valued limits with package defaults
+func (o ParserOptions) withDefaults() ParserOptions {
+	d := DefaultParserOptions()
+
+	if o.MaxMimeNodes == 0 {
+		o.MaxMimeNodes = d.MaxMimeNodes
+	}
+	if o.MaxHeaderLines == 0 {
+		o.MaxHeaderLines = d.MaxHeaderLines
+	}
+	if o.MaxNestingDepth == 0 {
+		o.MaxNestingDepth = d.MaxNestingDepth
+	}
+	if o.MaxHeaderBytes == 0 {
+		o.MaxHeaderBytes = d.MaxHeaderBytes
+	}
+	if o.MaxPartBytes == 0 {
+		o.MaxPartBytes = d.MaxPartBytes
+	}
+	if o.MaxMessageSize == 0 {
+		o.MaxMessageSize = d.MaxMessageSize
+	}
+	if o.RetainRaw {
+		o.StorePreambleAndEpilogue = true
+	}
+	// The buffer size is not a limit, it can't be disabled
+	if o.BufferReaderSize <= 0 {
+		o.BufferReaderSize = d.BufferReaderSize
+	}
+	// Lines are read into the buffer, longer ones were always rejected
+	if o.MaxLineOctets == 0 {
+		o.MaxLineOctets = o.BufferReaderSize
+	}
+
+	return o
+}
+
+// crossed reports whether val is over an enabled limit
+func crossed(val, limit int64) bool {
+	return limit >= 0 && val > limit
+}
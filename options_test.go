@@ -0,0 +1,129 @@
+package rfc2822
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const limitsMessage = "From: a@example.com\r\n" +
+	"Subject: limits\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"first part\r\n" +
+	"--b\r\n" +
+	"Content-Type: multipart/alternative; boundary=c\r\n" +
+	"\r\n" +
+	"--c\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"nested part\r\n" +
+	"--c--\r\n" +
+	"--b--\r\n"
+
+func readAllCallback(n *Node) error {
+	_, err := ioutil.ReadAll(n)
+	return err
+}
+
+func TestParserLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		set   func(o *ParserOptions)
+		err   error
+		limit int64
+	}{
+		{"mime nodes", func(o *ParserOptions) { o.MaxMimeNodes = 3 }, ErrMaxMimeNodes, 3},
+		{"header lines", func(o *ParserOptions) { o.MaxHeaderLines = 2 }, ErrMaxHeaderLines, 2},
+		{"line octets", func(o *ParserOptions) { o.MaxLineOctets = 30 }, ErrMaxLineLength, 30},
+		{"nesting depth", func(o *ParserOptions) { o.MaxNestingDepth = 2 }, ErrMaxNestingDepth, 2},
+		{"header bytes", func(o *ParserOptions) { o.MaxHeaderBytes = 100 }, ErrMaxHeaderBytes, 100},
+		{"part bytes", func(o *ParserOptions) { o.MaxPartBytes = 5 }, ErrMaxPartBytes, 5},
+		{"message size", func(o *ParserOptions) { o.MaxMessageSize = 50 }, ErrMaxMessageSize, 50},
+	}
+
+	for _, tt := range tests {
+		opts := DefaultParserOptions()
+		opts.BodyCallback = readAllCallback
+		tt.set(&opts)
+
+		_, err := ParseMimeWithOptions(strings.NewReader(limitsMessage), opts)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) || limitErr.Limit != tt.limit {
+			t.Errorf("%s: got %v, want a LimitError with limit %d", tt.name, err, tt.limit)
+		}
+	}
+}
+
+func TestParserLimitsNotReached(t *testing.T) {
+	opts := DefaultParserOptions()
+	opts.BodyCallback = readAllCallback
+	opts.MaxMimeNodes = 4
+	opts.MaxNestingDepth = 3
+	opts.MaxMessageSize = int64(len(limitsMessage))
+
+	if _, err := ParseMimeWithOptions(strings.NewReader(limitsMessage), opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestParserNoLimit(t *testing.T) {
+	opts := DefaultParserOptions()
+	opts.BodyCallback = readAllCallback
+	opts.MaxMimeNodes = NoLimit
+	opts.MaxHeaderLines = NoLimit
+	opts.MaxLineOctets = NoLimit
+
+	msg := "Subject: " + strings.Repeat("x", BufferReaderSize*2) + "\r\n" +
+		strings.Repeat("X-Header: y\r\n", MAX_HEADER_LINES+1) +
+		"\r\nbody\r\n"
+	if _, err := ParseMimeWithOptions(strings.NewReader(msg), opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Long unwrapped base64 or html lines are common, only lines which don't
+// fit the reader buffer are rejected by default
+func TestParserDefaultLineLength(t *testing.T) {
+	long := strings.Repeat("QUFB", 5000)
+	msg := "Content-Type: application/octet-stream\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" + long + "\r\n"
+
+	var size int
+	_, err := ParseMime(strings.NewReader(msg), func(n *Node) error {
+		b, err := ioutil.ReadAll(n)
+		size = len(b)
+		return err
+	}, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if size != 15000 {
+		t.Errorf("got %d decoded bytes, want 15000", size)
+	}
+
+	msg = "Subject: " + strings.Repeat("x", MAX_LINE_OCTETS) + "\r\n\r\nbody\r\n"
+	if _, err := ParseMime(strings.NewReader(msg), nil, nil, false); !errors.Is(err, ErrMaxLineLength) {
+		t.Errorf("got error %v, want %v", err, ErrMaxLineLength)
+	}
+}
+
+func TestParserBufferSizeLineLength(t *testing.T) {
+	opts := DefaultParserOptions()
+	opts.BufferReaderSize = 4 * BufferReaderSize
+	opts.MaxLineOctets = 0
+
+	msg := "Subject: " + strings.Repeat("x", 2*BufferReaderSize) + "\r\n\r\nbody\r\n"
+	if _, err := ParseMimeWithOptions(strings.NewReader(msg), opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
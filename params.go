@@ -0,0 +1,447 @@
+package rfc2822
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errNoMediaType = errors.New("No media type")
+var errInvalidMediaType = errors.New("Invalid media type")
+
+// A parameter segment longer than this is split in RFC 2231 continuations
+const maxParamSegmentLen = 60
+
+/*
+	ParseMediaType parses a Content-Type or Content-Disposition value like
+	mime.ParseMediaType, but keeps going on broken params. It supports
+
+	RFC 2231 continuations and charsets
+	name*0*=utf-8''%D0%AD%D1%82%D0%BE;
+	name*1*=%20%D1%84%D0%B0%D0%B9%D0%BB.txt
+
+	RFC 2047 encoded words in params, which some older clients use instead
+	name="=?utf-8?b?0K3RgtC+INGE0LDQudC7LnR4dA==?="
+
+	unquoted values with spaces, duplicate params and missing semicolons.
+	The media type is lowercased, as are param names.
+	Every problem found is returned as a Defect, only a bad media type is an
+	error
+*/
+func ParseMediaType(s string) (mediaType string, params map[string]string, defects []Defect, err error) {
+	s = strings.TrimSpace(s)
+
+	end := strings.IndexAny(s, "; \t")
+	if end < 0 {
+		end = len(s)
+	}
+	mediaType = strings.ToLower(s[:end])
+	if err = checkMediaType(mediaType); err != nil {
+		return "", nil, nil, err
+	}
+
+	p := paramParser{s: s[end:]}
+	p.parse()
+
+	params = p.decode()
+	return mediaType, params, p.defects, nil
+}
+
+func checkMediaType(mediaType string) error {
+	if mediaType == "" {
+		return errNoMediaType
+	}
+	parts := strings.Split(mediaType, "/")
+	if len(parts) > 2 {
+		return errInvalidMediaType
+	}
+	for _, part := range parts {
+		if part == "" || strings.IndexFunc(part, func(r rune) bool { return !isTokenChar(r) }) >= 0 {
+			return errInvalidMediaType
+		}
+	}
+	return nil
+}
+
+// https://datatracker.ietf.org/doc/html/rfc2045#section-5.1
+func isTokenChar(r rune) bool {
+	return r > ' ' && r < 0x7f && !strings.ContainsRune(`()<>@,;:\"/[]?=`, r)
+}
+
+type rawParam struct {
+	name  string
+	value string
+}
+
+type paramParser struct {
+	s       string
+	params  []rawParam
+	defects []Defect
+}
+
+func (p *paramParser) defect(value string, err error) {
+	p.defects = append(p.defects, Defect{Type: DefectInvalidParam, Value: value, Err: err})
+}
+
+func (p *paramParser) skipSpace() {
+	p.s = strings.TrimLeft(p.s, " \t\r\n")
+}
+
+func (p *paramParser) parse() {
+	separated := true
+
+	for {
+		p.skipSpace()
+		if p.s == "" {
+			return
+		}
+		if p.s[0] == ';' {
+			p.s = p.s[1:]
+			separated = true
+			continue
+		}
+
+		name := p.consumeName()
+		p.skipSpace()
+		if name == "" || !strings.HasPrefix(p.s, "=") {
+			// Not a param, skip to the next one
+			junk := p.s
+			if i := strings.IndexByte(p.s, ';'); i >= 0 {
+				junk, p.s = p.s[:i], p.s[i:]
+			} else {
+				p.s = ""
+			}
+			p.defect(name+junk, fmt.Errorf("expected name=value"))
+			continue
+		}
+		p.s = p.s[1:]
+		p.skipSpace()
+
+		if !separated {
+			p.defect(name, fmt.Errorf("missing ';' before param"))
+		}
+
+		var value string
+		if strings.HasPrefix(p.s, `"`) {
+			value = p.consumeQuoted(name)
+		} else {
+			value = p.consumeUnquoted(name)
+		}
+
+		p.params = append(p.params, rawParam{strings.ToLower(name), value})
+		separated = false
+	}
+}
+
+func (p *paramParser) consumeName() string {
+	i := strings.IndexFunc(p.s, func(r rune) bool { return !isTokenChar(r) })
+	if i < 0 {
+		i = len(p.s)
+	}
+	name := p.s[:i]
+	p.s = p.s[i:]
+	return name
+}
+
+func (p *paramParser) consumeQuoted(name string) string {
+	var sb strings.Builder
+	for i := 1; i < len(p.s); i++ {
+		switch c := p.s[i]; {
+		case c == '\\' && i+1 < len(p.s):
+			i++
+			sb.WriteByte(p.s[i])
+		case c == '"':
+			p.s = p.s[i+1:]
+			return sb.String()
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	p.defect(name, fmt.Errorf("missing closing quote"))
+	p.s = ""
+	return sb.String()
+}
+
+// consumeUnquoted reads a token value. Values with spaces are taken up to
+// the next ';', unless what follows the space looks like another param
+func (p *paramParser) consumeUnquoted(name string) string {
+	end := strings.IndexByte(p.s, ';')
+	if end < 0 {
+		end = len(p.s)
+	}
+	value := p.s[:end]
+
+	if i := strings.IndexAny(value, " \t"); i >= 0 {
+		rest := strings.TrimLeft(value[i:], " \t")
+		next := strings.IndexFunc(rest, func(r rune) bool { return !isTokenChar(r) })
+		if next > 0 && rest[next] == '=' {
+			// Missing ';', the next param starts here
+			end = i
+		} else {
+			value = strings.TrimRight(value, " \t\r\n")
+			p.defect(name, fmt.Errorf("unquoted value with spaces %q", value))
+		}
+	}
+
+	value = p.s[:end]
+	p.s = p.s[end:]
+	return strings.TrimRight(value, " \t\r\n")
+}
+
+type paramSegment struct {
+	value   string
+	encoded bool
+}
+
+// decode merges RFC 2231 continuations and decodes charsets and encoded
+// words
+func (p *paramParser) decode() map[string]string {
+	params := map[string]string{}
+	segments := map[string]map[int]paramSegment{}
+	// Params using RFC 2231 win over plain ones of the same name
+	extended := map[string]bool{}
+
+	for _, param := range p.params {
+		name := param.name
+		encoded := strings.HasSuffix(name, "*")
+		name = strings.TrimSuffix(name, "*")
+
+		index := -1
+		if i := strings.LastIndexByte(name, '*'); i >= 0 {
+			if n, err := strconv.Atoi(name[i+1:]); err == nil && n >= 0 {
+				index = n
+				name = name[:i]
+			}
+		}
+
+		switch {
+		case index >= 0:
+			if segments[name] == nil {
+				segments[name] = map[int]paramSegment{}
+			}
+			if _, ok := segments[name][index]; ok {
+				p.defect(param.name, fmt.Errorf("duplicate continuation"))
+				continue
+			}
+			segments[name][index] = paramSegment{param.value, encoded}
+		case encoded:
+			if extended[name] {
+				p.defect(param.name, fmt.Errorf("duplicate param"))
+				continue
+			}
+			params[name] = p.decodeExtended(name, param.value)
+			extended[name] = true
+		default:
+			if _, ok := params[name]; ok {
+				if !extended[name] {
+					p.defect(name, fmt.Errorf("duplicate param"))
+				}
+				continue
+			}
+			params[name] = p.decodeWords(name, param.value)
+		}
+	}
+
+	// Sorted, so that the defects come in the same order every time
+	names := make([]string, 0, len(segments))
+	for name := range segments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		segs := segments[name]
+		if extended[name] {
+			p.defect(name, fmt.Errorf("duplicate param"))
+			continue
+		}
+
+		var sb strings.Builder
+		charset := ""
+		for i := 0; ; i++ {
+			seg, ok := segs[i]
+			if !ok {
+				if len(segs) != i {
+					p.defect(name, fmt.Errorf("missing continuation %d", i))
+				}
+				break
+			}
+			if !seg.encoded {
+				sb.WriteString(seg.value)
+				continue
+			}
+			if i == 0 {
+				charset, seg.value = splitExtendedValue(seg.value)
+			}
+			sb.WriteString(percentDecode(seg.value))
+		}
+
+		value := sb.String()
+		if charset != "" {
+			value = p.decodeCharset(name, charset, value)
+		}
+		params[name] = value
+		extended[name] = true
+	}
+
+	return params
+}
+
+// decodeExtended decodes a charset'language'value param
+func (p *paramParser) decodeExtended(name, value string) string {
+	charset, value := splitExtendedValue(value)
+	return p.decodeCharset(name, charset, percentDecode(value))
+}
+
+func (p *paramParser) decodeCharset(name, charset, value string) string {
+	if charset == "" || normalizeCharset(charset) == "us-ascii" {
+		return value
+	}
+	r, _, err := newCharsetReader(charset, strings.NewReader(value))
+	if err != nil {
+		p.defect(name, err)
+		return value
+	}
+	dec, err := ioutil.ReadAll(r)
+	if err != nil {
+		p.defect(name, err)
+		return value
+	}
+	return string(dec)
+}
+
+// decodeWords decodes RFC 2047 encoded words, which are not allowed in
+// params but common in filenames
+func (p *paramParser) decodeWords(name, value string) string {
+	if !strings.Contains(value, "=?") {
+		return value
+	}
+	p.defects = append(p.defects, Defect{Type: DefectEncodedWordParam, Value: name})
+	return decodeHeader(value)
+}
+
+// splitExtendedValue splits charset'language'value, the language is dropped
+func splitExtendedValue(v string) (charset, value string) {
+	parts := strings.SplitN(v, "'", 3)
+	if len(parts) != 3 {
+		return "", v
+	}
+	return parts[0], parts[2]
+}
+
+func percentDecode(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if b, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				sb.WriteByte(byte(b))
+				i += 2
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+/*
+	FormatMediaType formats a Content-Type or Content-Disposition value.
+	Params are sorted by name. Values which are not ascii or too long for a
+	line are written as RFC 2231 continuations, eg.
+	filename*0*=utf-8''%D0%AD%D1%82%D0%BE...; filename*1*=...
+	Returns "" if the media type or a param name is not valid
+*/
+func FormatMediaType(mediaType string, params map[string]string) string {
+	mediaType = strings.ToLower(mediaType)
+	if checkMediaType(mediaType) != nil {
+		return ""
+	}
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString(mediaType)
+
+	for _, name := range names {
+		if name == "" || strings.IndexFunc(name, func(r rune) bool { return !isTokenChar(r) || r == '*' || r == '\'' || r == '%' }) >= 0 {
+			return ""
+		}
+		value := params[name]
+
+		switch {
+		case IsInternational(value) || strings.ContainsAny(value, "\r\n"):
+			formatExtendedParam(&sb, name, value)
+		case len(name)+len(value) > maxParamSegmentLen:
+			for i, seg := range splitParam(value, maxParamSegmentLen, false) {
+				sb.WriteString("; " + name + "*" + strconv.Itoa(i) + "=" + quoteParam(seg))
+			}
+		default:
+			sb.WriteString("; " + name + "=" + quoteParam(value))
+		}
+	}
+
+	return sb.String()
+}
+
+func formatExtendedParam(sb *strings.Builder, name, value string) {
+	encoded := UTF8 + "''" + percentEncode(value)
+	if len(name)+len(encoded) <= maxParamSegmentLen {
+		sb.WriteString("; " + name + "*=" + encoded)
+		return
+	}
+	for i, seg := range splitParam(encoded, maxParamSegmentLen, true) {
+		sb.WriteString("; " + name + "*" + strconv.Itoa(i) + "*=" + seg)
+	}
+}
+
+// splitParam splits a value in segments of at most n bytes, without
+// splitting %XX escapes when encoded
+func splitParam(v string, n int, encoded bool) []string {
+	var segs []string
+	for len(v) > n {
+		i := n
+		if encoded {
+			if j := strings.LastIndexByte(v[:i], '%'); j >= 0 && j > i-3 {
+				i = j
+			}
+		}
+		segs = append(segs, v[:i])
+		v = v[i:]
+	}
+	return append(segs, v)
+}
+
+func quoteParam(v string) string {
+	if v != "" && strings.IndexFunc(v, func(r rune) bool { return !isTokenChar(r) }) < 0 {
+		return v
+	}
+	return quoteString(v)
+}
+
+// https://datatracker.ietf.org/doc/html/rfc2231#section-7
+// attribute-char is a token char other than *, ' and %
+func percentEncode(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x80 && isTokenChar(rune(c)) && c != '*' && c != '\'' && c != '%' {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteByte('%')
+		sb.WriteByte(upperhex[c>>4])
+		sb.WriteByte(upperhex[c&0x0f])
+	}
+	return sb.String()
+}
@@ -0,0 +1,153 @@
+package rfc2822
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMediaType(t *testing.T) {
+	tests := []struct {
+		in        string
+		mediaType string
+		params    map[string]string
+		defects   []DefectType
+	}{
+		{"Text/Plain; Charset=UTF-8", "text/plain", map[string]string{"charset": "UTF-8"}, nil},
+		{"attachment; filename=\"a \\\"b\\\".txt\"", "attachment", map[string]string{"filename": "a \"b\".txt"}, nil},
+		{
+			"attachment; name*0*=utf-8''%D0%AD%D1%82%D0%BE;\r\n\tname*1*=%20%D1%84%D0%B0%D0%B9%D0%BB.txt",
+			"attachment", map[string]string{"name": "Это файл.txt"}, nil,
+		},
+		{"attachment; name*0=\"long \"; name*1=name", "attachment", map[string]string{"name": "long name"}, nil},
+		{"attachment; filename*=iso-8859-1'en'caf%E9", "attachment", map[string]string{"filename": "café"}, nil},
+		{
+			"attachment; filename=\"=?utf-8?b?0K3RgtC+INGE0LDQudC7LnR4dA==?=\"",
+			"attachment", map[string]string{"filename": "Это файл.txt"}, []DefectType{DefectEncodedWordParam},
+		},
+		{"attachment; filename=my file.txt", "attachment", map[string]string{"filename": "my file.txt"}, []DefectType{DefectInvalidParam}},
+		{"text/plain; charset=utf-8 format=flowed", "text/plain", map[string]string{"charset": "utf-8", "format": "flowed"}, []DefectType{DefectInvalidParam}},
+		{"text/plain; ==bad; charset=utf-8", "text/plain", map[string]string{"charset": "utf-8"}, []DefectType{DefectInvalidParam}},
+		{"text/plain; charset=a; charset=b", "text/plain", map[string]string{"charset": "a"}, []DefectType{DefectInvalidParam}},
+		{"attachment; filename=\"open", "attachment", map[string]string{"filename": "open"}, []DefectType{DefectInvalidParam}},
+		{"attachment; filename=plain; filename*=utf-8''%C3%BC", "attachment", map[string]string{"filename": "ü"}, nil},
+		{"attachment; name*0=a; name*2=c", "attachment", map[string]string{"name": "a"}, []DefectType{DefectInvalidParam}},
+	}
+
+	for _, tt := range tests {
+		mediaType, params, defects, err := ParseMediaType(tt.in)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.in, err)
+			continue
+		}
+		if mediaType != tt.mediaType || !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("%q: got %q %v, want %q %v", tt.in, mediaType, params, tt.mediaType, tt.params)
+		}
+		var types []DefectType
+		for _, d := range defects {
+			types = append(types, d.Type)
+		}
+		if !reflect.DeepEqual(types, tt.defects) {
+			t.Errorf("%q: got defects %v, want %v", tt.in, types, tt.defects)
+		}
+	}
+}
+
+func TestParseMediaTypeErrors(t *testing.T) {
+	for _, in := range []string{"", "; charset=utf-8", "text/", "text/plain/x", "te(x)t/plain"} {
+		if _, _, _, err := ParseMediaType(in); err == nil {
+			t.Errorf("%q: no error", in)
+		}
+	}
+}
+
+func TestFormatMediaType(t *testing.T) {
+	tests := []struct {
+		mediaType string
+		params    map[string]string
+		want      string
+	}{
+		{"Text/Plain", map[string]string{"charset": "utf-8", "format": "flowed"}, "text/plain; charset=utf-8; format=flowed"},
+		{"attachment", map[string]string{"filename": "a b.txt"}, "attachment; filename=\"a b.txt\""},
+		{"attachment", map[string]string{"filename": "café.txt"}, "attachment; filename*=utf-8''caf%C3%A9.txt"},
+		{"attachment", map[string]string{"filename": "a\r\nb"}, "attachment; filename*=utf-8''a%0D%0Ab"},
+		{"text/plain/x", nil, ""},
+		{"attachment", map[string]string{"file name": "x"}, ""},
+	}
+
+	for _, tt := range tests {
+		if got := FormatMediaType(tt.mediaType, tt.params); got != tt.want {
+			t.Errorf("FormatMediaType(%q, %v) = %q, want %q", tt.mediaType, tt.params, got, tt.want)
+		}
+	}
+}
+
+func TestFormatMediaTypeRoundTrip(t *testing.T) {
+	params := []map[string]string{
+		{"filename": strings.Repeat("Это очень длинное имя файла ", 4) + ".txt"},
+		{"filename": strings.Repeat("plain long name ", 8)},
+		{"filename": "with \"quotes\" and \\"},
+	}
+
+	for _, p := range params {
+		formatted := FormatMediaType("attachment", p)
+		for _, line := range strings.Split(formatted, "; ") {
+			if len(line) > maxParamSegmentLen+len("filename*00*=") {
+				t.Errorf("segment of %d octets: %q", len(line), line)
+			}
+		}
+		_, got, defects, err := ParseMediaType(formatted)
+		if err != nil || len(defects) != 0 || !reflect.DeepEqual(got, p) {
+			t.Errorf("%q: got %v, %v, %v, want %v", formatted, got, defects, err, p)
+		}
+	}
+}
+
+func TestParamDefects(t *testing.T) {
+	msg := "Content-Type: text/plain; charset=utf-8 format=flowed\r\n" +
+		"Content-Disposition: attachment; filename=\"=?utf-8?q?caf=C3=A9.txt?=\"\r\n" +
+		"\r\n" +
+		"body\r\n"
+
+	// Broken params are not an error, even when strict
+	for _, lenient := range []bool{false, true} {
+		var opts []Option
+		if lenient {
+			opts = append(opts, WithLenientParsing())
+		}
+		root, err := ParseMime(strings.NewReader(msg), nil, nil, false, opts...)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := []DefectType{DefectEncodedWordParam, DefectInvalidParam}; !reflect.DeepEqual(defectTypes(root), want) {
+			t.Errorf("got defects %v, want %v", defectTypes(root), want)
+		}
+		if root.ContentType.Params["format"] != "flowed" || root.ContentDisposition.Params["filename"] != "café.txt" {
+			t.Errorf("got params %v and %v", root.ContentType.Params, root.ContentDisposition.Params)
+		}
+	}
+}
+
+func TestParamContinuationDefectsOrder(t *testing.T) {
+	in := "attachment; title*0=a; title*2=c; name*1=b; name*1=x; filename*0=f; filename*=utf-8''x"
+	want := []Defect{
+		{Type: DefectInvalidParam, Value: "name*1"},
+		{Type: DefectInvalidParam, Value: "filename"},
+		{Type: DefectInvalidParam, Value: "name"},
+		{Type: DefectInvalidParam, Value: "title"},
+	}
+
+	// Continuations are kept in a map, the order must not depend on it
+	for i := 0; i < 20; i++ {
+		_, _, defects, err := ParseMediaType(in)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for j := range defects {
+			defects[j].Err = nil
+		}
+		if !reflect.DeepEqual(defects, want) {
+			t.Fatalf("got defects %+v, want %+v", defects, want)
+		}
+	}
+}
@@ -5,14 +5,15 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"regexp"
 	"strings"
 )
 
-var whitespace, linebreak *regexp.Regexp
+var linebreak *regexp.Regexp
 
 var singleValueFields = []string{
-	"content-tansfer-encoding",
+	"content-transfer-encoding",
 	"content-id",
 	"content-description",
 	"content-language",
@@ -24,13 +25,28 @@ var singleValueFields = []string{
 
 func init() {
 	// Compile all the regex
-	whitespace = regexp.MustCompile(`^\s`)
 	linebreak = regexp.MustCompile(`\s*\r?\n\s*`)
 }
 
+// Default limits, see ParserOptions
 const MAX_MIME_NODES = 99
 const MAX_HEADER_LINES = 1000
-const MAX_LINE_OCTETS = 4000
+
+// A line can be as long as the reader buffer. Options with a zero
+// MaxLineOctets use their own BufferReaderSize instead
+const MAX_LINE_OCTETS = BufferReaderSize
+
+// Maximum depth of the mime tree, counting both multipart and
+// message/rfc822 nesting
+const MAX_NESTING_DEPTH = 20
+
+// NoLimit disables a limit in ParserOptions
+const NoLimit = -1
+
+// These are disabled unless set in ParserOptions
+const MAX_HEADER_BYTES = NoLimit
+const MAX_PART_BYTES = NoLimit
+const MAX_MESSAGE_SIZE = NoLimit
 
 const HEADER = "header"
 const BODY = "body"
@@ -43,48 +59,263 @@ var ValidContentDispositions = []string{"inline", "attachment"}
 const BufferReaderSize = 50 * 1024
 
 type tempState struct {
-	headerLines    []string
+	headerLines    int
 	root           bool
 	state          string
 	parentNode     *Node
 	parentBoundary string
-	bodyReader     io.Reader
+	// Multipart node which owns parentBoundary. This is the parent node
+	// except for parts of an encapsulated message, where the boundary is
+	// inherited from the closest multipart ancestor
+	boundaryNode    *Node
+	bodyReader      io.Reader
+	rawBodyReader   io.Reader
+	bodyDone        bool
+	headerProcessed bool
+	closed          bool
+	bodyStartLines  int
+	lastDecoded     byte
+	maxPartBytes    int64
+	// Set when Read crossed maxPartBytes, so that the error surfaces even
+	// if the body callback ignores it
+	limitErr error
+	// Decoded bytes to keep in Body, see ParserOptions.CaptureBodyBytes
+	captureBytes int64
+	captured     []byte
+	// Captured by a CapturePolicy, text is converted to utf-8
+	captureText bool
+	// Set by Skip, the rest of the body was discarded
+	skipped bool
+	// ErrSkipPart was returned by the PartHeader hook of the node or of an
+	// ancestor, see PartHooks
+	skipPart bool
+	// Defects the Defect hook was called for
+	reportedDefects int
 }
 
 type Node struct {
 	ChildNodes []*Node
 	// https://golang.org/pkg/net/textproto/#MIMEHeader
-	ParsedHeader           map[string][]string
-	BadHeaders             map[string][]string
-	Body                   []string
-	Multipart              string
-	MultipartSeenBStart    bool
-	MultipartSeenBEnd      bool
-	Preamble               string
-	Epilogue               string
-	ContentType            ContentType
-	ContentDisposition     ContentDisposition
-	Boundary               string
-	LineCount              int
-	Size                   int
+	ParsedHeader map[string][]string
+	// Header fields as they appeared in the message, see HeaderField
+	RawHeaders []HeaderField
+	BadHeaders map[string][]string
+	// Filled by the body callback, or with the start of the decoded body
+	// when parsing WithBodyCapture or WithCapturePolicies
+	Body []string
+	// The decoded body is longer than what was captured in Body
+	BodyTruncated       bool
+	Multipart           string
+	MultipartSeenBStart bool
+	MultipartSeenBEnd   bool
+	Preamble            string
+	Epilogue            string
+	ContentType         ContentType
+	ContentDisposition  ContentDisposition
+	Boundary            string
+	// Lines of the raw body
+	LineCount int
+	// Decoded size of the body
+	Size int
+	// Lines of the decoded body
+	DecodedLineCount int
+	// Absolute offsets in the raw message. The body ends before the line
+	// break preceding the next boundary delimiter, as per RFC 2046
+	HeaderStart int64
+	BodyStart   int64
+	BodyEnd     int64
+	// Size of the raw, still encoded, body
+	RawSize                int64
 	Path                   []int
 	MultipartContainerType string
-	tstate                 tempState
+	// Charset as declared in the Content-Type header
+	Charset string
+	// Charset the body was converted from when charset decoding is enabled,
+	// empty if the body was left as is. iso-8859-1 bodies are read as
+	// windows-1252, which is reported here while Charset keeps the label
+	DecodedCharset string
+	// Problems found while parsing this part, see Defect
+	Defects []Defect
+	tstate  tempState
+	// The raw message when parsed with WithRawRetained, see WriteMessage
+	source []byte
+	// Set when headers or body were changed after parsing
+	dirty   bool
+	newBody []byte
+}
+
+// IsMessage reports whether the node is a message/rfc822 or message/global
+// part. Such nodes have the encapsulated message as their only child node
+func (n *Node) IsMessage() bool {
+	return n.ContentType.Type == "message" && isEncapsulatedMessage(n.ContentType.SubType)
+}
+
+func isEncapsulatedMessage(subType string) bool {
+	// message/global is the RFC 6532 variant of message/rfc822
+	return subType == "rfc822" || subType == "global"
+}
+
+// charsetReader wraps r so that it returns utf-8, falling back to r when the
+// declared charset is missing or unknown
+func (n *Node) charsetReader(r io.Reader) io.Reader {
+	if n.Charset == "" {
+		return r
+	}
+	decoded, used, err := newBodyCharsetReader(n.Charset, r)
+	if err != nil {
+		return r
+	}
+	n.DecodedCharset = used
+	return decoded
 }
 
+// Read reads the decoded body of the part, from a BodyCallback or after
+// Reader.NextPart
 func (n *Node) Read(d []byte) (int, error) {
+	if n.tstate.limitErr != nil {
+		return 0, n.tstate.limitErr
+	}
+	// Parsing moved past the body, or it was skipped
+	if n.tstate.bodyReader == nil || n.tstate.skipped {
+		return 0, io.EOF
+	}
 	i, err := n.tstate.bodyReader.Read(d)
 	n.Size += i
-	// TODO: Put the bytes into node.Body for a particular config
-	// right now callback has to explicitly put the body inside node.Body
+	if i > 0 {
+		n.DecodedLineCount += bytes.Count(d[:i], []byte("\n"))
+		n.tstate.lastDecoded = d[i-1]
+	}
+	if crossed(int64(n.Size), n.tstate.maxPartBytes) {
+		n.tstate.limitErr = &LimitError{ErrMaxPartBytes, n.tstate.maxPartBytes}
+		return i, n.tstate.limitErr
+	}
+	if n.tstate.captureBytes > 0 && i > 0 {
+		keep := n.tstate.captureBytes - int64(len(n.tstate.captured))
+		if int64(i) > keep {
+			n.BodyTruncated = true
+		} else {
+			keep = int64(i)
+		}
+		n.tstate.captured = append(n.tstate.captured, d[:keep]...)
+	}
 	return i, err
 }
 
+/*
+	Skip discards what is left of the body without decoding it, it can be
+	called from a BodyCallback or after Reader.NextPart. Node.Size and
+	Node.DecodedLineCount then only count what was read. When the body is
+	captured, the bytes still to be captured are decoded first, and one
+	more to set Node.BodyTruncated.
+
+	Parsing goes on after the body either way, a body left unread is
+	decoded and discarded by the parser. Skip is only needed to avoid the
+	decoding
+*/
+func (n *Node) Skip() error {
+	if n.tstate.bodyReader == nil || n.tstate.skipped {
+		return nil
+	}
+
+	if n.tstate.captureBytes > 0 && !n.BodyTruncated {
+		left := n.tstate.captureBytes - int64(len(n.tstate.captured)) + 1
+		_, err := io.CopyN(ioutil.Discard, n, left)
+		if n.tstate.limitErr != nil {
+			return n.tstate.limitErr
+		}
+		if err == io.EOF {
+			return nil
+		}
+		// A body which can't be decoded is skipped all the same
+	}
+
+	n.tstate.skipped = true
+	_, err := io.Copy(ioutil.Discard, n.tstate.rawBodyReader)
+	// Unexpected EOF is a missing close delimiter, reported as a defect
+	if err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	return err
+}
+
 type mimeTree struct {
 	rawReader    *bufio.Reader
 	MimetreeRoot *Node
-	nodeCount    int16
+	nodeCount    int
+	headerBytes  int64
 	currentNode  *Node
+	opts         ParserOptions
+	// Copy of the raw message, see ParserOptions.RetainRaw
+	source *bytes.Buffer
+	// Position after the raw bytes consumed so far
+	pos streamPos
+	// Position at the start of the last line read
+	linePos streamPos
+	// Error of the last line read, io.EOF once the message was read
+	readErr error
+	// Leaf node whose body was handed out last, see nextPart
+	partNode *Node
+	// The PartStart hook was called for the root node
+	started bool
+}
+
+// streamPos is a position in the raw message
+type streamPos struct {
+	offset int64
+	lines  int
+	// Last bytes consumed, to find the line break which belongs to a
+	// boundary delimiter
+	tail    [3]byte
+	tailLen int
+}
+
+func (p *streamPos) consume(d []byte) {
+	p.offset += int64(len(d))
+	p.lines += bytes.Count(d, []byte("\n"))
+
+	if len(d) > len(p.tail) {
+		d = d[len(d)-len(p.tail):]
+	}
+	for _, c := range d {
+		p.tail[0], p.tail[1], p.tail[2] = p.tail[1], p.tail[2], c
+	}
+	p.tailLen += len(d)
+	if p.tailLen > len(p.tail) {
+		p.tailLen = len(p.tail)
+	}
+}
+
+// lineBreakLen is the length of the line break at the end of the consumed
+// bytes, if any
+func (p *streamPos) lineBreakLen() int {
+	if p.tailLen >= 2 && p.tail[1] == '\r' && p.tail[2] == '\n' {
+		return 2
+	}
+	if p.tailLen >= 1 && p.tail[2] == '\n' {
+		return 1
+	}
+	return 0
+}
+
+// lastByte returns the last consumed byte ignoring the last skip bytes
+func (p *streamPos) lastByte(skip int) byte {
+	if p.tailLen <= skip {
+		return 0
+	}
+	return p.tail[len(p.tail)-1-skip]
+}
+
+// offsetReader keeps mimeTree.pos in sync for raw bytes that are read
+// by the body readers instead of readNextLine
+type offsetReader struct {
+	r  io.Reader
+	mt *mimeTree
+}
+
+func (o *offsetReader) Read(d []byte) (int, error) {
+	n, err := o.r.Read(d)
+	o.mt.pos.consume(d[:n])
+	return n, err
 }
 
 type ContentType struct {
@@ -98,14 +329,24 @@ type ContentDisposition struct {
 	Params    map[string]string
 }
 
-func newMimeTree(raw io.Reader) *mimeTree {
+func newMimeTree(raw io.Reader, opts ParserOptions) *mimeTree {
+
+	if opts.MaxMessageSize >= 0 {
+		raw = &sizeLimitReader{r: raw, limit: opts.MaxMessageSize}
+	}
+
+	var source *bytes.Buffer
+	if opts.RetainRaw {
+		source = &bytes.Buffer{}
+		raw = io.TeeReader(raw, source)
+	}
 
 	intialState := tempState{
 		root:           true,
 		state:          "",
 		parentBoundary: "",
 		parentNode:     nil,
-		headerLines:    []string{},
+		headerLines:    0,
 	}
 
 	rootNode := Node{
@@ -123,10 +364,12 @@ func newMimeTree(raw io.Reader) *mimeTree {
 	}
 
 	mimeTree := mimeTree{
-		rawReader:    bufio.NewReaderSize(raw, BufferReaderSize),
+		rawReader:    bufio.NewReaderSize(raw, opts.BufferReaderSize),
 		MimetreeRoot: &rootNode,
 		nodeCount:    0,
 		currentNode:  nil,
+		opts:         opts,
+		source:       source,
 	}
 
 	mimeTree.currentNode = mimeTree.createNode(&rootNode)
@@ -137,10 +380,19 @@ func newMimeTree(raw io.Reader) *mimeTree {
 func (mt *mimeTree) createNode(parent *Node) *Node {
 	mt.nodeCount++
 
+	// Parts of an encapsulated message are still terminated by the
+	// boundary of the multipart enclosing the message/rfc822 part
+	boundary, boundaryNode := parent.Boundary, parent
+	if boundary == "" {
+		boundary, boundaryNode = parent.tstate.parentBoundary, parent.tstate.boundaryNode
+	}
+
 	newTempState := tempState{state: HEADER,
-		headerLines:    []string{},
-		parentBoundary: parent.Boundary,
-		parentNode:     parent}
+		headerLines:    0,
+		parentBoundary: boundary,
+		boundaryNode:   boundaryNode,
+		parentNode:     parent,
+		skipPart:       parent.tstate.skipPart}
 
 	path := []int{}
 	contType := ""
@@ -148,7 +400,11 @@ func (mt *mimeTree) createNode(parent *Node) *Node {
 	if parent.tstate.root {
 		path = append(path, 1)
 	} else {
-		path = append(parent.Path, len(parent.ChildNodes)+1)
+		// Copy, appending to parent.Path directly can share the backing
+		// array between siblings
+		path = make([]int, len(parent.Path), len(parent.Path)+1)
+		copy(path, parent.Path)
+		path = append(path, len(parent.ChildNodes)+1)
 	}
 
 	if parent.ContentType.Type == "multipart" {
@@ -156,6 +412,7 @@ func (mt *mimeTree) createNode(parent *Node) *Node {
 	}
 
 	newNode := Node{
+		HeaderStart:            mt.pos.offset,
 		ChildNodes:             []*Node{},
 		BadHeaders:             map[string][]string{},
 		Body:                   []string{},
@@ -179,11 +436,15 @@ func (mt *mimeTree) createNode(parent *Node) *Node {
 type BodyCallback func(mimeNode *Node) error
 type RootHeaderCallback func(node *Node) error
 
-func readNextLine(r *bufio.Reader, l []byte) ([]byte, []byte, error) {
+func readNextLine(r *bufio.Reader, limit int) ([]byte, []byte, error) {
 
 	br := []byte("\n")
 
-	l, err := readBytesWithLimit(r, byte('\n'), MAX_LINE_OCTETS)
+	l, err := readBytesWithLimit(r, byte('\n'), limit)
+
+	if err == ErrMaxLineLength {
+		return l, br, &LimitError{ErrMaxLineLength, int64(limit)}
+	}
 
 	if err != nil {
 		return l, br, err
@@ -252,6 +513,58 @@ func (bodR *BodyReader) Read(d []byte) (int, error) {
 	return n, nil
 }
 
+// delimitedReader drops the line break in front of the boundary delimiter
+// which ends the body, it belongs to the delimiter (RFC 2046 section 5.1.1)
+type delimitedReader struct {
+	r       io.Reader
+	buf     []byte
+	scratch [512]byte
+	err     error
+	dropped bool
+}
+
+func (d *delimitedReader) Read(p []byte) (int, error) {
+	// Keep more than a line break buffered, so that something can be
+	// returned while holding the line break back
+	for len(d.buf) <= 2 && d.err == nil {
+		n, err := d.r.Read(d.scratch[:])
+		d.buf = append(d.buf, d.scratch[:n]...)
+		d.err = err
+	}
+
+	avail := len(d.buf)
+	if d.err == nil {
+		avail -= trailingLineBreakLen(d.buf, true)
+	} else if d.err == io.EOF && !d.dropped {
+		// The body ended on a boundary, anything else is unexpected EOF
+		d.buf = d.buf[:len(d.buf)-trailingLineBreakLen(d.buf, false)]
+		d.dropped = true
+		avail = len(d.buf)
+	}
+
+	n := copy(p, d.buf[:avail])
+	d.buf = d.buf[n:]
+	if n == 0 && len(d.buf) == 0 {
+		return 0, d.err
+	}
+	return n, nil
+}
+
+// trailingLineBreakLen returns the length of the line break at the end of b.
+// With partial set a lone CR counts too, it could be the start of CRLF
+func trailingLineBreakLen(b []byte, partial bool) int {
+	l := len(b)
+	switch {
+	case l >= 2 && b[l-2] == '\r' && b[l-1] == '\n':
+		return 2
+	case l >= 1 && b[l-1] == '\n':
+		return 1
+	case partial && l >= 1 && b[l-1] == '\r':
+		return 1
+	}
+	return 0
+}
+
 func scanUntilBoundary(buf, dashBoundary []byte, readErr error) (int, error) {
 	// Search for "--boundary".
 	if i := bytes.Index(buf, dashBoundary); i >= 0 {
@@ -269,9 +582,17 @@ func scanUntilBoundary(buf, dashBoundary []byte, readErr error) (int, error) {
 		return 0, readErr
 	}
 
-	i := bytes.LastIndexByte(buf, dashBoundary[0])
-	if i >= 0 && bytes.HasPrefix(dashBoundary, buf[i:]) {
-		return i, nil
+	// The end of buf could be the start of a delimiter split across reads.
+	// It starts with "--", so look for the earliest partial match rather
+	// than the last '-'
+	i := len(buf) - len(dashBoundary) + 1
+	if i < 1 {
+		i = 1
+	}
+	for ; i < len(buf); i++ {
+		if bytes.HasPrefix(dashBoundary, buf[i:]) {
+			return i, nil
+		}
 	}
 	return len(buf), readErr
 }
@@ -290,19 +611,72 @@ func matchAfterPrefix(buf, prefix []byte, readErr error) int {
 	return -1
 }
 
-func (mt *mimeTree) parse(pc BodyCallback, hc RootHeaderCallback, storePreambleAndEpilogue bool) error {
-	line := ""
-	var readerr error = nil
-	for readerr != io.EOF {
+func (mt *mimeTree) parse() error {
+	pc := mt.opts.BodyCallback
+
+	for {
+		n, err := mt.nextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 
-		nextLine, lineBreak, err := readNextLine(mt.rawReader, nil)
+		// Bodies are drained by nextPart, there is nothing to do without
+		// a callback
+		if pc == nil {
+			continue
+		}
+
+		err = pc(n)
+
+		if n.tstate.limitErr != nil {
+			return n.tstate.limitErr
+		}
 
-		readerr = err
 		if err != nil {
+			return err
+		}
+	}
+}
+
+// nextPart parses the message up to the body of the next leaf part and
+// returns its node, ready to be read. The body of the part returned before
+// is drained first. It returns io.EOF once the whole message is parsed
+func (mt *mimeTree) nextPart() (*Node, error) {
+	if n := mt.partNode; n != nil {
+		mt.partNode = nil
+		if err := mt.drainBody(n); err != nil {
+			return nil, err
+		}
+	}
+
+	// The root node is created along with the tree
+	if !mt.started {
+		mt.started = true
+		if err := mt.partStart(mt.currentNode); err != nil {
+			return nil, err
+		}
+	}
+
+	hc := mt.opts.RootHeaderCallback
+
+	line := ""
+	for mt.readErr != io.EOF {
+
+		nextLine, lineBreak, err := readNextLine(mt.rawReader, mt.opts.MaxLineOctets)
+
+		mt.readErr = err
+		mt.linePos = mt.pos
+		mt.pos.consume(nextLine)
+		// The last line can end without a line break, it still has to
+		// be processed
+		if err != nil && !(err == io.EOF && len(nextLine) > 0) {
 			if err == io.EOF {
 				break
 			}
-			return err
+			return nil, err
 		}
 		line = string(nextLine)
 
@@ -313,53 +687,89 @@ func (mt *mimeTree) parse(pc BodyCallback, hc RootHeaderCallback, storePreambleA
 			if line == string(lineBreak) {
 				err := mt.processHeader()
 				if err != nil {
-					return err
+					return nil, err
 				}
 				err = mt.processContentType()
 				if err != nil {
-					return err
+					return nil, err
 				}
 
 				// Call root header callback
 				if mt.currentNode.tstate.parentNode.tstate.root && hc != nil {
 					err := hc(mt.currentNode)
 					if err != nil {
-						return fmt.Errorf("Error parsing header: %v", err)
+						return nil, fmt.Errorf("Error parsing header: %v", err)
 					}
 				}
 
+				if err := mt.partHeader(mt.currentNode); err != nil {
+					return nil, err
+				}
+
 				mt.currentNode.tstate.state = BODY
+				mt.currentNode.BodyStart = mt.pos.offset
+				mt.currentNode.tstate.bodyStartLines = mt.pos.lines
+
+				// The body of a message/rfc822 part is a complete message,
+				// parse it as a child node starting with its own header
+				if mt.currentNode.IsMessage() && isIdentityEncoding(mt.currentNode.ParsedHeader["content-transfer-encoding"]) {
+					mt.currentNode = mt.createNode(mt.currentNode)
+					if err := mt.partStart(mt.currentNode); err != nil {
+						return nil, err
+					}
+				}
 			} else {
-				mt.currentNode.tstate.headerLines = append(mt.currentNode.tstate.headerLines, line)
+				mt.currentNode.appendHeaderLine(nextLine, mt.linePos.offset)
+				mt.currentNode.tstate.headerLines++
 
-				if len(mt.currentNode.tstate.headerLines) > MAX_HEADER_LINES {
-					return errMaxHeaderLines
+				if crossed(int64(mt.currentNode.tstate.headerLines), int64(mt.opts.MaxHeaderLines)) {
+					return nil, &LimitError{ErrMaxHeaderLines, int64(mt.opts.MaxHeaderLines)}
 				}
 			}
 
+			mt.headerBytes += int64(len(nextLine))
+			if crossed(mt.headerBytes, mt.opts.MaxHeaderBytes) {
+				return nil, &LimitError{ErrMaxHeaderBytes, mt.opts.MaxHeaderBytes}
+			}
+
 			break
 
 		case BODY:
 			var fullReader io.Reader
 
+			delimiter, closeDelimiter := matchBoundary(line, mt.currentNode.tstate.parentBoundary)
+			ownDelimiter, _ := matchBoundary(line, mt.currentNode.Boundary)
+
 			switch {
-			case (mt.currentNode.tstate.parentBoundary != "") && (line == "--"+mt.currentNode.tstate.parentBoundary+string(lineBreak)):
-				mt.currentNode = mt.createNode(mt.currentNode.tstate.parentNode)
+			case delimiter:
+				if err := mt.closeNodes(mt.currentNode.tstate.boundaryNode, mt.linePos, true); err != nil {
+					return nil, err
+				}
+				mt.currentNode = mt.createNode(mt.currentNode.tstate.boundaryNode)
+				if err := mt.partStart(mt.currentNode); err != nil {
+					return nil, err
+				}
 				break
-			case (mt.currentNode.tstate.parentBoundary != "") && (line == "--"+mt.currentNode.tstate.parentBoundary+"--"+string(lineBreak)):
-				mt.currentNode = mt.currentNode.tstate.parentNode
+			case closeDelimiter:
+				if err := mt.closeNodes(mt.currentNode.tstate.boundaryNode, mt.linePos, true); err != nil {
+					return nil, err
+				}
+				mt.currentNode = mt.currentNode.tstate.boundaryNode
 				mt.currentNode.MultipartSeenBEnd = true
 				break
-			case (mt.currentNode.Boundary != "") && (line == "--"+mt.currentNode.Boundary+string(lineBreak)):
+			case ownDelimiter:
 				mt.currentNode.MultipartSeenBStart = true
 				mt.currentNode = mt.createNode(mt.currentNode)
+				if err := mt.partStart(mt.currentNode); err != nil {
+					return nil, err
+				}
 				break
 			default:
 
 				// https://datatracker.ietf.org/doc/html/rfc1521
 				// Check for Preamble
 				if mt.currentNode.Boundary != "" && mt.currentNode.MultipartSeenBStart == false {
-					if storePreambleAndEpilogue {
+					if mt.opts.StorePreambleAndEpilogue {
 						mt.currentNode.Preamble = mt.currentNode.Preamble + line
 					}
 					break
@@ -367,103 +777,216 @@ func (mt *mimeTree) parse(pc BodyCallback, hc RootHeaderCallback, storePreambleA
 
 				// Check for Epilogue
 				if mt.currentNode.Boundary != "" && mt.currentNode.MultipartSeenBEnd == true {
-					if storePreambleAndEpilogue {
+					if mt.opts.StorePreambleAndEpilogue {
 						mt.currentNode.Epilogue = mt.currentNode.Epilogue + line
 					}
 					break
 				}
 
+				// Lines after a body which ended on something that only
+				// looked like a boundary are still part of that body
+				if mt.currentNode.tstate.bodyDone {
+					break
+				}
+
 				// Handle body
 				if mt.currentNode.tstate.parentBoundary != "" {
 					bodReader := newBodyReader(mt.currentNode.tstate.parentBoundary, mt.rawReader)
-					fullReader = io.MultiReader(bytes.NewReader(nextLine), bodReader)
+					fullReader = &delimitedReader{r: io.MultiReader(bytes.NewReader(nextLine), &offsetReader{bodReader, mt})}
 				} else if mt.currentNode.tstate.parentBoundary == "" {
-					fullReader = io.MultiReader(bytes.NewReader(nextLine), mt.rawReader)
+					fullReader = io.MultiReader(bytes.NewReader(nextLine), &offsetReader{mt.rawReader, mt})
 				}
 
+				mt.currentNode.tstate.rawBodyReader = fullReader
+
 				// Check for content transfer encoding
 				if enc, ok := mt.currentNode.ParsedHeader["content-transfer-encoding"]; ok {
 					if decodedReader, encErr := encodingReader(enc[0], fullReader); encErr != nil {
-						return encErr
+						if !mt.opts.Lenient {
+							return nil, encErr
+						}
+						// https://datatracker.ietf.org/doc/html/rfc2045#section-6.1
+						// read as 7bit, the default encoding
+						mt.currentNode.addDefect(DefectUnknownTransferEncoding, enc[0], encErr)
 					} else {
 						fullReader = decodedReader
 					}
 				}
 
-				// TODO: Charset readers (refer enmime)
+				if mt.opts.DecodeCharset && mt.currentNode.ContentType.Type == "text" {
+					fullReader = mt.currentNode.charsetReader(fullReader)
+				}
 
 				mt.currentNode.tstate.bodyReader = fullReader
+				mt.currentNode.tstate.maxPartBytes = mt.opts.MaxPartBytes
+				mt.setCapture(mt.currentNode)
 
-				err := pc(mt.currentNode)
+				if err := mt.reportDefects(mt.currentNode); err != nil {
+					return nil, err
+				}
 
-				if err != nil {
-					return err
+				// Rejected by the PartHeader hook, the body is not handed
+				// out
+				if mt.currentNode.tstate.skipPart {
+					if err := mt.currentNode.Skip(); err != nil {
+						return nil, err
+					}
+					mt.currentNode.tstate.bodyDone = true
+					break
 				}
 
-				break
+				// The body is read by the caller, parsing goes on from
+				// here once it is drained
+				mt.partNode = mt.currentNode
+				return mt.currentNode, nil
 			}
 
 			break
 
 		default:
-			return fmt.Errorf("Unexpected state")
+			return nil, fmt.Errorf("Unexpected state")
 		}
 
-		if mt.nodeCount > MAX_MIME_NODES {
-			return fmt.Errorf("MAX_MIME_NODES count crossed")
+		if crossed(int64(mt.nodeCount), int64(mt.opts.MaxMimeNodes)) {
+			return nil, &LimitError{ErrMaxMimeNodes, int64(mt.opts.MaxMimeNodes)}
+		}
+
+		if crossed(int64(len(mt.currentNode.Path)), int64(mt.opts.MaxNestingDepth)) {
+			return nil, &LimitError{ErrMaxNestingDepth, int64(mt.opts.MaxNestingDepth)}
 		}
 
 	}
 
-	return nil
+	return nil, io.EOF
+}
+
+// https://datatracker.ietf.org/doc/html/rfc2046#section-5.1.1
+// Delimiter lines may have trailing whitespace (transport padding)
+func matchBoundary(line, boundary string) (delimiter, closeDelimiter bool) {
+	if boundary == "" || !strings.HasPrefix(line, "--"+boundary) {
+		return false, false
+	}
+	rest := strings.TrimRight(line[len(boundary)+2:], " \t\r\n")
+	return rest == "", rest == "--"
+}
+
+// drainBody reads whatever the body callback left unread, so that parsing
+// continues after the body and the sizes of the node are complete
+func (mt *mimeTree) drainBody(n *Node) error {
+	_, err := io.Copy(ioutil.Discard, n)
+	if n.tstate.limitErr != nil {
+		return n.tstate.limitErr
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		// The body can't be decoded, skip the remaining raw bytes
+		_, err = io.Copy(ioutil.Discard, n.tstate.rawBodyReader)
+	}
+	n.tstate.bodyDone = true
+
+	// Unexpected EOF is a missing close delimiter, reported as a defect
+	if err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	return err
+}
+
+// closeNodes sets the body end of the current node and its ancestors up to,
+// but not including, until. When the nodes are closed by a boundary
+// delimiter the line break preceding it is not part of the body.
+// All the nodes are closed even if a PartEnd hook fails, the first hook
+// error is returned and no hooks are called after it
+func (mt *mimeTree) closeNodes(until *Node, pos streamPos, delimited bool) error {
+	var hookErr error
+	for n := mt.currentNode; n != nil && n != until && !n.tstate.root; n = n.tstate.parentNode {
+		if n.tstate.closed {
+			continue
+		}
+		n.tstate.closed = true
+
+		if n.tstate.state == HEADER {
+			// Header never ended, there is no body
+			n.BodyStart = pos.offset
+			n.tstate.bodyStartLines = pos.lines
+		}
+
+		end, lines, last := pos.offset, pos.lines, pos.lastByte(0)
+		if brLen := pos.lineBreakLen(); delimited && brLen > 0 && end-int64(brLen) >= n.BodyStart {
+			end, lines, last = end-int64(brLen), lines-1, pos.lastByte(brLen)
+		}
+
+		n.BodyEnd = end
+		n.RawSize = end - n.BodyStart
+		n.LineCount = lines - n.tstate.bodyStartLines
+		if n.RawSize > 0 && last != '\n' {
+			n.LineCount++
+		}
+		if n.Size > 0 && n.tstate.lastDecoded != '\n' {
+			n.DecodedLineCount++
+		}
+
+		if len(n.tstate.captured) != 0 {
+			n.Body = append(n.Body, n.capturedBody())
+			n.tstate.captured = nil
+		}
+
+		if n.Boundary != "" && n.MultipartSeenBStart && !n.MultipartSeenBEnd {
+			n.addDefect(DefectMissingCloseBoundary, n.Boundary, nil)
+		}
+
+		if hookErr == nil {
+			hookErr = mt.partEnd(n)
+		}
+	}
+	return hookErr
 }
 
 func (mt *mimeTree) processHeader() error {
 	var key, value string
 
-	headers := mt.currentNode.tstate.headerLines
+	// So that finalize doesn't process it again after a failure
+	mt.currentNode.tstate.headerProcessed = true
+
+	// ParsedHeader is a view of RawHeaders. Repeated fields are kept
+	// bottom up, in the reverse order of the message
+	headers := mt.currentNode.RawHeaders
 
 	for i := (len(headers) - 1); i >= 0; i-- {
-		if i > 0 && whitespace.Match([]byte(headers[i])) {
-			headers[i-1] = headers[i-1] + "\r\n" + headers[i]
-			headers = headers[:i]
+		key = strings.ToLower(headers[i].Name)
+		value = ""
+		if headers[i].hasColon() {
+			// TODO: Check if values are utf-7
+			value = headers[i].Unfolded()
 		} else {
-			spl := strings.Split(headers[i], ":")
-			if len(spl) >= 2 {
-				key = strings.ToLower(strings.TrimSpace(spl[0]))
-				value = strings.Join(spl[1:], ":")
-			} else if len(spl) == 1 {
-				// len 1 means no ":" was found. This is a malformed header line
-				// TODO: Maybe return a malformed header line error here
-				key = strings.ToLower(strings.TrimSpace(spl[0]))
-				value = ""
-			}
+			// No ":" was found. This is a malformed header line
+			mt.currentNode.addDefect(DefectMalformedHeaderLine, headers[i].Name, nil)
+		}
 
-			// TODO: Check if values are utf-7
-			value = string(linebreak.ReplaceAll([]byte(value), []byte("")))
-			value = strings.Trim(value, " ")
-
-			// Track headers that have strange looking keys, keep these
-			// in the seperate section
-			validHeader := true
-			for _, c := range []byte(key) {
-				if !validHeaderKeyByte(c) {
-					validHeader = false
-					break
-				}
+		// Track headers that have strange looking keys, keep these
+		// in the seperate section
+		validHeader := true
+		for _, c := range []byte(key) {
+			if !validHeaderKeyByte(c) {
+				validHeader = false
+				break
 			}
+		}
 
-			if !validHeader || len(key) > 100 || key == "" {
-				mt.currentNode.BadHeaders[key] = append(mt.currentNode.ParsedHeader[key], value)
-			} else {
-				mt.currentNode.ParsedHeader[key] = append(mt.currentNode.ParsedHeader[key], value)
-			}
+		if !validHeader || len(key) > 100 || key == "" {
+			mt.currentNode.BadHeaders[key] = append(mt.currentNode.BadHeaders[key], value)
+		} else {
+			mt.currentNode.ParsedHeader[key] = append(mt.currentNode.ParsedHeader[key], value)
 		}
 	}
 
 	// Make sure Content-Type is always there
+	// https://datatracker.ietf.org/doc/html/rfc2046#section-5.1.5
+	// parts of a multipart/digest default to message/rfc822
 	if _, ok := mt.currentNode.ParsedHeader["content-type"]; !ok {
-		mt.currentNode.ParsedHeader["content-type"] = []string{"text/plain"}
+		if mt.currentNode.MultipartContainerType == "digest" {
+			mt.currentNode.ParsedHeader["content-type"] = []string{"message/rfc822"}
+		} else {
+			mt.currentNode.ParsedHeader["content-type"] = []string{"text/plain"}
+		}
 	}
 
 	// Make sure following fields have only single values
@@ -475,27 +998,33 @@ func (mt *mimeTree) processHeader() error {
 	}
 
 	if contDisp, ok := mt.currentNode.ParsedHeader["content-disposition"]; ok {
-		parsedContentDisp, err := ParseContentDisposition(contDisp[0])
+		parsedContentDisp, defects, err := parseContentDisposition(contDisp[0])
+		mt.currentNode.Defects = append(mt.currentNode.Defects, defects...)
 		if err != nil {
-			return fmt.Errorf("Could not parse content disposition %v: %v", contDisp[0], err)
+			if !mt.opts.Lenient {
+				return fmt.Errorf("Could not parse content disposition %v: %v", contDisp[0], err)
+			}
+			mt.currentNode.addDefect(DefectInvalidContentDisposition, contDisp[0], err)
+			// Keep the disposition type if that much is readable
+			parsedContentDisp = ContentDisposition{
+				MediaType: strings.ToLower(strings.TrimSpace(strings.Split(contDisp[0], ";")[0])),
+				Params:    map[string]string{},
+			}
 		}
 
 		if !Contains(parsedContentDisp.MediaType, ValidContentDispositions) {
-			return fmt.Errorf("Invalid content disposition value: %v", parsedContentDisp.MediaType)
+			if !mt.opts.Lenient {
+				return fmt.Errorf("Invalid content disposition value: %v", parsedContentDisp.MediaType)
+			}
+			// https://datatracker.ietf.org/doc/html/rfc2183#section-2.8
+			// unrecognized disposition types are treated as attachment
+			mt.currentNode.addDefect(DefectUnknownContentDisposition, parsedContentDisp.MediaType, nil)
+			parsedContentDisp.MediaType = "attachment"
 		}
 
 		mt.currentNode.ContentDisposition = parsedContentDisp
 	}
 
-	/*
-		TODO:
-		Parse address, ie values for headers 'from', 'sender', 'reply-to', 'to', 'cc', 'bcc'
-		they are of form 'Name <address@domain>'
-		convert them to proper structure like for eg.
-		 [{name: 'Name', address: 'address@domain'}]
-
-	*/
-
 	return nil
 }
 
@@ -505,11 +1034,22 @@ func (mt *mimeTree) processContentType() error {
 		return nil
 	}
 
-	parsedContentType, err := ParseContentType(mt.currentNode.ParsedHeader["content-type"][0])
+	parsedContentType, defects, err := parseContentType(mt.currentNode.ParsedHeader["content-type"][0])
+	mt.currentNode.Defects = append(mt.currentNode.Defects, defects...)
 	if err != nil {
-		return fmt.Errorf("Could not parse content type %v: %v", mt.currentNode.ParsedHeader["content-type"][0], err)
+		if !mt.opts.Lenient {
+			return fmt.Errorf("Could not parse content type %v: %v", mt.currentNode.ParsedHeader["content-type"][0], err)
+		}
+		// https://datatracker.ietf.org/doc/html/rfc2045#section-5.2
+		mt.currentNode.addDefect(DefectInvalidContentType, mt.currentNode.ParsedHeader["content-type"][0], err)
+		parsedContentType = ContentType{
+			Type:    "text",
+			SubType: "plain",
+			Params:  map[string]string{"charset": "us-ascii"},
+		}
 	}
 	mt.currentNode.ContentType = parsedContentType
+	mt.currentNode.Charset = parsedContentType.Params["charset"]
 
 	/*
 		Certain headers like content-type has ; seperated params
@@ -521,6 +1061,15 @@ func (mt *mimeTree) processContentType() error {
 		if _, ok := mt.currentNode.ContentType.Params["boundary"]; ok {
 			mt.currentNode.Multipart = mt.currentNode.ContentType.SubType
 			mt.currentNode.Boundary = mt.currentNode.ContentType.Params["boundary"]
+		} else if mt.opts.Lenient {
+			// https://datatracker.ietf.org/doc/html/rfc2046#section-5.1.1
+			// without a boundary the body can't be split, keep it opaque
+			mt.currentNode.addDefect(DefectNoBoundary, mt.currentNode.ParsedHeader["content-type"][0], errNoBoundary)
+			mt.currentNode.ContentType = ContentType{
+				Type:    "application",
+				SubType: "octet-stream",
+				Params:  map[string]string{},
+			}
 		} else {
 			// No boundary found. Return error
 			return errNoBoundary
@@ -530,17 +1079,43 @@ func (mt *mimeTree) processContentType() error {
 
 }
 
-func (mt *mimeTree) finalize() {
+// parseError wraps an error which stopped parsing with where it happened
+func (mt *mimeTree) parseError(err error) *ParseError {
+	return &ParseError{
+		Err:    err,
+		Path:   append([]int{}, mt.currentNode.Path...),
+		State:  mt.currentNode.tstate.state,
+		Offset: mt.pos.offset,
+	}
+}
+
+// finalize closes the nodes left open and clears the parsing state. err is
+// the error parsing stopped with, if any. Hooks are still called, their
+// errors are only returned when parsing had not failed
+func (mt *mimeTree) finalize(err error) error {
+	var hookErr error
 
-	if mt.currentNode.tstate.state == HEADER {
+	// Header which never ended, errors are ignored as the tree is returned
+	// as is. Defects would be recorded twice for a header processed already
+	if mt.currentNode.tstate.state == HEADER && !mt.currentNode.tstate.headerProcessed {
 		mt.processHeader()
 		mt.processContentType()
+		// Header of a part without a body
+		if err == nil {
+			hookErr = mt.partHeader(mt.currentNode)
+		}
+	}
+
+	if cerr := mt.closeNodes(nil, mt.pos, false); hookErr == nil {
+		hookErr = cerr
+	}
+	if err == nil && hookErr != nil {
+		err = mt.parseError(hookErr)
 	}
 
 	var walker func(n *Node)
 
 	walker = func(n *Node) {
-		// TODO: Handle content type 'message/rfc822'
 		for _, cn := range n.ChildNodes {
 			walker(cn)
 		}
@@ -548,12 +1123,18 @@ func (mt *mimeTree) finalize() {
 		// Empty out temp states
 		n.tstate.parentNode = nil
 		n.tstate.state = ""
-		n.tstate.headerLines = []string{}
+		n.tstate.headerLines = 0
 		if len(n.ChildNodes) == 0 {
 			n.ChildNodes = nil
 		}
 		n.tstate.parentBoundary = ""
+		n.tstate.boundaryNode = nil
 		n.tstate.bodyReader = nil
+		n.tstate.rawBodyReader = nil
+
+		if mt.source != nil {
+			n.source = mt.source.Bytes()
+		}
 	}
 
 	if len(mt.MimetreeRoot.ChildNodes) != 0 {
@@ -561,18 +1142,37 @@ func (mt *mimeTree) finalize() {
 	}
 
 	mt.currentNode = nil
+	return err
+}
+
+func ParseMime(r io.Reader, bc BodyCallback, hc RootHeaderCallback, storePreambleAndEpilogue bool, opts ...Option) (*Node, error) {
+	parserOpts := DefaultParserOptions()
+	parserOpts.BodyCallback = bc
+	parserOpts.RootHeaderCallback = hc
+	parserOpts.StorePreambleAndEpilogue = storePreambleAndEpilogue
+
+	for _, opt := range opts {
+		opt(&parserOpts)
+	}
+
+	return ParseMimeWithOptions(r, parserOpts)
 }
 
-func ParseMime(r io.Reader, bc BodyCallback, hc RootHeaderCallback, storePreambleAndEpilogue bool) (*Node, error) {
-	mimeTree := newMimeTree(r)
+// ParseMimeWithOptions is ParseMime with per call limits, see ParserOptions.
+// A nil BodyCallback discards the bodies.
+// When parsing fails the error is a *ParseError and the returned node is
+// the tree built up to that point
+func ParseMimeWithOptions(r io.Reader, opts ParserOptions) (*Node, error) {
+	mimeTree := newMimeTree(r, opts.withDefaults())
 
-	err := mimeTree.parse(bc, hc, storePreambleAndEpilogue)
+	err := mimeTree.parse()
 
 	if err != nil {
-		return &Node{}, err
+		err = mimeTree.parseError(err)
 	}
 
-	mimeTree.finalize()
+	// On errors the tree parsed so far is still returned
+	err = mimeTree.finalize(err)
 
 	var root *Node
 
@@ -582,5 +1182,5 @@ func ParseMime(r io.Reader, bc BodyCallback, hc RootHeaderCallback, storePreambl
 		return &Node{}, ErrEmptyMime
 	}
 
-	return root, nil
+	return root, err
 }
@@ -0,0 +1,405 @@
+package rfc2822
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const offsetsMessage = "Subject: offsets\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"preamble\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"line one\r\n" +
+	"line two\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"aGVsbG8K\r\n" +
+	"d29ybGQ=\r\n" +
+	"--b--\r\n" +
+	"epilogue\r\n"
+
+func TestNodeOffsets(t *testing.T) {
+	root, err := ParseMime(strings.NewReader(offsetsMessage), readAllCallback, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(root.ChildNodes) != 2 {
+		t.Fatalf("got %d parts, want 2", len(root.ChildNodes))
+	}
+
+	tests := []struct {
+		node      *Node
+		header    string
+		body      string
+		lines     int
+		size      int
+		sizeLines int
+	}{
+		{root, "Subject: offsets", offsetsMessage[strings.Index(offsetsMessage, "preamble"):], 14, 0, 0},
+		{root.ChildNodes[0], "Content-Type: text/plain", "line one\r\nline two", 2, 18, 2},
+		{root.ChildNodes[1], "Content-Type: application/octet-stream", "aGVsbG8K\r\nd29ybGQ=", 2, 11, 2},
+	}
+
+	for _, tt := range tests {
+		n := tt.node
+		if want := int64(strings.Index(offsetsMessage, tt.header)); n.HeaderStart != want {
+			t.Errorf("part %v: got header start %d, want %d", n.Path, n.HeaderStart, want)
+		}
+		if got := offsetsMessage[n.BodyStart:n.BodyEnd]; got != tt.body {
+			t.Errorf("part %v: got body %q, want %q", n.Path, got, tt.body)
+		}
+		if n.RawSize != int64(len(tt.body)) {
+			t.Errorf("part %v: got raw size %d, want %d", n.Path, n.RawSize, len(tt.body))
+		}
+		if n.LineCount != tt.lines {
+			t.Errorf("part %v: got %d lines, want %d", n.Path, n.LineCount, tt.lines)
+		}
+		if n.Size != tt.size || n.DecodedLineCount != tt.sizeLines {
+			t.Errorf("part %v: got decoded size %d and %d lines, want %d and %d", n.Path, n.Size, n.DecodedLineCount, tt.size, tt.sizeLines)
+		}
+	}
+}
+
+func TestNodeOffsetsLF(t *testing.T) {
+	msg := strings.Replace(offsetsMessage, "\r\n", "\n", -1)
+
+	root, err := ParseMime(strings.NewReader(msg), readAllCallback, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	part := root.ChildNodes[0]
+	if got := msg[part.BodyStart:part.BodyEnd]; got != "line one\nline two" {
+		t.Errorf("got body %q", got)
+	}
+	if part.LineCount != 2 || part.Size != 17 {
+		t.Errorf("got %d lines and size %d, want 2 and 17", part.LineCount, part.Size)
+	}
+	if root.BodyEnd != int64(len(msg)) {
+		t.Errorf("got root body end %d, want %d", root.BodyEnd, len(msg))
+	}
+}
+
+func TestUnreadBodiesDrained(t *testing.T) {
+	want, err := ParseMime(strings.NewReader(offsetsMessage), readAllCallback, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	callbacks := map[string]BodyCallback{
+		"nil":    nil,
+		"unread": func(n *Node) error { return nil },
+		"partial": func(n *Node) error {
+			_, err := n.Read(make([]byte, 3))
+			return err
+		},
+	}
+
+	for name, bc := range callbacks {
+		root, err := ParseMime(strings.NewReader(offsetsMessage), bc, nil, false)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if len(root.ChildNodes) != len(want.ChildNodes) {
+			t.Fatalf("%s: got %d parts, want %d", name, len(root.ChildNodes), len(want.ChildNodes))
+		}
+		for i, n := range root.ChildNodes {
+			w := want.ChildNodes[i]
+			if n.Size != w.Size || n.DecodedLineCount != w.DecodedLineCount || n.BodyEnd != w.BodyEnd {
+				t.Errorf("%s: part %v: got size %d, %d lines, body end %d, want %d, %d, %d", name, n.Path,
+					n.Size, n.DecodedLineCount, n.BodyEnd, w.Size, w.DecodedLineCount, w.BodyEnd)
+			}
+		}
+	}
+}
+
+func TestNodeSkip(t *testing.T) {
+	root, err := ParseMime(strings.NewReader(offsetsMessage), func(n *Node) error {
+		if _, err := io.ReadFull(n, make([]byte, 4)); err != nil {
+			return err
+		}
+		if err := n.Skip(); err != nil {
+			return err
+		}
+		if i, err := n.Read(make([]byte, 4)); i != 0 || err != io.EOF {
+			t.Errorf("part %v: got %d, %v reading after Skip", n.Path, i, err)
+		}
+		// Skipping twice is fine
+		return n.Skip()
+	}, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(root.ChildNodes) != 2 {
+		t.Fatalf("got %d parts, want 2", len(root.ChildNodes))
+	}
+	for _, n := range root.ChildNodes {
+		// Only what was read is counted
+		if n.Size != 4 {
+			t.Errorf("part %v: got size %d, want 4", n.Path, n.Size)
+		}
+	}
+	if got := root.ChildNodes[1].BodyEnd; got != int64(strings.Index(offsetsMessage, "\r\n--b--")) {
+		t.Errorf("got body end %d", got)
+	}
+}
+
+func TestBodyCapture(t *testing.T) {
+	callbacks := map[string]BodyCallback{
+		"nil":     nil,
+		"readAll": readAllCallback,
+		"skip":    func(n *Node) error { return n.Skip() },
+		"partial": func(n *Node) error {
+			_, err := n.Read(make([]byte, 2))
+			return err
+		},
+	}
+
+	for name, bc := range callbacks {
+		root, err := ParseMime(strings.NewReader(offsetsMessage), bc, nil, false, WithBodyCapture(5))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		for i, want := range []string{"line ", "hello"} {
+			n := root.ChildNodes[i]
+			if len(n.Body) != 1 || n.Body[0] != want {
+				t.Errorf("%s: part %v: got body %q, want %q", name, n.Path, n.Body, want)
+			}
+		}
+		if len(root.Body) != 0 {
+			t.Errorf("%s: got multipart body %q", name, root.Body)
+		}
+	}
+}
+
+func TestBodyCaptureWholeBody(t *testing.T) {
+	root, err := ParseMime(strings.NewReader(offsetsMessage), func(n *Node) error {
+		_, err := io.Copy(ioutil.Discard, n)
+		return err
+	}, nil, false, WithBodyCapture(1024))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, want := range []string{"line one\r\nline two", "hello\nworld"} {
+		if n := root.ChildNodes[i]; len(n.Body) != 1 || n.Body[0] != want {
+			t.Errorf("part %v: got body %q, want %q", n.Path, n.Body, want)
+		}
+	}
+}
+
+const encapsulatedMessage = "Subject: outer\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"see attached\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"From: Inner <inner@example.com>\r\n" +
+	"Message-ID: <inner@example.com>\r\n" +
+	"Subject: inner\r\n" +
+	"Date: Mon, 7 Feb 1994 21:52:25 -0800\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"inner plain\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>inner html</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer--\r\n"
+
+func TestEncapsulatedMessage(t *testing.T) {
+	for _, subType := range []string{"rfc822", "global"} {
+		msg := strings.Replace(encapsulatedMessage, "message/rfc822", "message/"+subType, 1)
+		root, err := ParseMime(strings.NewReader(msg), readAllCallback, nil, false)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", subType, err)
+		}
+
+		part := root.ChildNodes[1]
+		if !part.IsMessage() || len(part.ChildNodes) != 1 {
+			t.Fatalf("%s: got %d child nodes for %s", subType, len(part.ChildNodes), part.ContentType.SubType)
+		}
+		inner := part.ChildNodes[0]
+		if subject := inner.ParsedHeader["subject"]; len(subject) != 1 || subject[0] != "inner" {
+			t.Errorf("%s: got inner subject %q", subType, subject)
+		}
+		if inner.ContentType.SubType != "alternative" || len(inner.ChildNodes) != 2 {
+			t.Fatalf("%s: got inner %s with %d parts", subType, inner.ContentType.SubType, len(inner.ChildNodes))
+		}
+		if html := inner.ChildNodes[1]; !reflect.DeepEqual(html.Path, []int{1, 2, 1, 2}) || html.ContentType.SubType != "html" {
+			t.Errorf("%s: got part %v of type %s", subType, html.Path, html.ContentType.SubType)
+		}
+		// The message/rfc822 body is the whole encapsulated message
+		if got := msg[part.BodyStart:part.BodyEnd]; !strings.HasPrefix(got, "From: Inner") || !strings.HasSuffix(got, "--inner--") {
+			t.Errorf("%s: got body %q", subType, got)
+		}
+	}
+}
+
+func TestDigestDefaultType(t *testing.T) {
+	msg := "Subject: digest\r\n" +
+		"Content-Type: multipart/digest; boundary=d\r\n" +
+		"\r\n" +
+		"--d\r\n" +
+		"\r\n" +
+		"Subject: first\r\n" +
+		"\r\n" +
+		"first body\r\n" +
+		"--d\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"not a message\r\n" +
+		"--d--\r\n"
+
+	root, err := ParseMime(strings.NewReader(msg), readAllCallback, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(root.ChildNodes) != 2 {
+		t.Fatalf("got %d parts, want 2", len(root.ChildNodes))
+	}
+
+	first := root.ChildNodes[0]
+	if !first.IsMessage() || len(first.ChildNodes) != 1 {
+		t.Fatalf("got first part %s/%s with %d child nodes", first.ContentType.Type, first.ContentType.SubType, len(first.ChildNodes))
+	}
+	if subject := first.ChildNodes[0].ParsedHeader["subject"]; len(subject) != 1 || subject[0] != "first" {
+		t.Errorf("got subject %q", subject)
+	}
+	if second := root.ChildNodes[1]; second.IsMessage() || len(second.ChildNodes) != 0 {
+		t.Errorf("got second part %s/%s", second.ContentType.Type, second.ContentType.SubType)
+	}
+}
+
+func TestEncodedMessageOpaque(t *testing.T) {
+	msg := "Subject: encoded\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"U3ViamVjdDogaW5uZXINCg0KYm9keQ0K\r\n"
+
+	var body []byte
+	root, err := ParseMime(strings.NewReader(msg), func(n *Node) (err error) {
+		body, err = ioutil.ReadAll(n)
+		return err
+	}, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Not parsed as a message, the body callback gets it decoded instead
+	if len(root.ChildNodes) != 0 {
+		t.Errorf("got %d child nodes, want none", len(root.ChildNodes))
+	}
+	if string(body) != "Subject: inner\r\n\r\nbody\r\n" {
+		t.Errorf("got body %q", body)
+	}
+}
+
+func TestEncapsulatedNestingDepth(t *testing.T) {
+	msg := "Subject: level 1\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"\r\n" +
+		"Subject: level 2\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"\r\n" +
+		"Subject: level 3\r\n" +
+		"\r\n" +
+		"body\r\n"
+
+	opts := DefaultParserOptions()
+	opts.MaxNestingDepth = 3
+	if _, err := ParseMimeWithOptions(strings.NewReader(msg), opts); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	opts.MaxNestingDepth = 2
+	root, err := ParseMimeWithOptions(strings.NewReader(msg), opts)
+	if !errors.Is(err, ErrMaxNestingDepth) {
+		t.Errorf("got error %v, want %v", err, ErrMaxNestingDepth)
+	}
+	if root == nil || len(root.ChildNodes) != 1 {
+		t.Errorf("got partial tree %v", root)
+	}
+}
+
+func TestCharsetDecoding(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+		charset     string
+		decoded     string
+	}{
+		{"windows-1252", "text/plain; charset=windows-1252", "\x93quoted\x94 \x96 caf\xe9 \x80",
+			"\xe2\x80\x9cquoted\xe2\x80\x9d \xe2\x80\x93 caf\xc3\xa9 \xe2\x82\xac", "windows-1252", "windows-1252"},
+		// Read as windows-1252, the label is kept in Charset
+		{"iso-8859-1", "text/plain; charset=ISO-8859-1", "caf\xe9 \x80", "caf\xc3\xa9 \xe2\x82\xac", "ISO-8859-1", "windows-1252"},
+		{"latin1", "text/plain; charset=latin1", "caf\xe9 \x80", "caf\xc3\xa9 \xe2\x82\xac", "latin1", "windows-1252"},
+		{"iso-2022-jp", "text/plain; charset=iso-2022-jp", "\x1b$B$3$s$K$A$O\x1b(B",
+			"\xe3\x81\x93\xe3\x82\x93\xe3\x81\xab\xe3\x81\xa1\xe3\x81\xaf", "iso-2022-jp", "iso-2022-jp"},
+		{"utf-8", "text/plain; charset=utf-8", "caf\xc3\xa9", "caf\xc3\xa9", "utf-8", "utf-8"},
+		// Returned as is
+		{"unknown", "text/plain; charset=x-unknown", "caf\xe9", "caf\xe9", "x-unknown", ""},
+		{"no charset", "text/plain", "caf\xe9", "caf\xe9", "", ""},
+		{"not text", "application/octet-stream; charset=windows-1252", "caf\xe9", "caf\xe9", "windows-1252", ""},
+	}
+
+	for _, tt := range tests {
+		msg := "Content-Type: " + tt.contentType + "\r\n" +
+			"\r\n" +
+			tt.body
+
+		var body []byte
+		root, err := ParseMime(strings.NewReader(msg), func(n *Node) (err error) {
+			body, err = ioutil.ReadAll(n)
+			return err
+		}, nil, false, WithCharsetDecoding())
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+
+		if string(body) != tt.want {
+			t.Errorf("%s: got body %q, want %q", tt.name, body, tt.want)
+		}
+		if root.Charset != tt.charset || root.DecodedCharset != tt.decoded {
+			t.Errorf("%s: got charset %q decoded as %q, want %q decoded as %q", tt.name,
+				root.Charset, root.DecodedCharset, tt.charset, tt.decoded)
+		}
+	}
+}
+
+func TestCharsetDecodingDisabled(t *testing.T) {
+	msg := "Content-Type: text/plain; charset=windows-1252\r\n" +
+		"\r\n" +
+		"caf\xe9"
+
+	var body []byte
+	root, err := ParseMime(strings.NewReader(msg), func(n *Node) (err error) {
+		body, err = ioutil.ReadAll(n)
+		return err
+	}, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(body) != "caf\xe9" || root.Charset != "windows-1252" || root.DecodedCharset != "" {
+		t.Errorf("got body %q, charset %q decoded as %q", body, root.Charset, root.DecodedCharset)
+	}
+}
@@ -0,0 +1,95 @@
+package rfc2822
+
+import (
+	"io"
+)
+
+/*
+	Reader parses a message one part at a time, as an alternative to the
+	BodyCallback of ParseMime. Parsing only goes as far as the caller asks
+	for, so it can stop after any part or hand the bodies to other
+	goroutines, one at a time.
+
+	NextPart returns the leaf parts in the order of the message, the same
+	parts BodyCallback is called for, with the same limits and decoding.
+
+	Example:
+	r := NewReader(msg, WithLenientParsing())
+	for {
+		part, body, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if part.ContentDisposition.MediaType == "attachment" {
+			io.Copy(store, body)
+		}
+	}
+	root := r.Root()
+*/
+type Reader struct {
+	mt *mimeTree
+	// Error returned by NextPart once parsing stopped, io.EOF at the end
+	// of the message
+	err error
+}
+
+// NewReader returns a Reader parsing r with the ParseMime options
+func NewReader(r io.Reader, opts ...Option) *Reader {
+	parserOpts := DefaultParserOptions()
+
+	for _, opt := range opts {
+		opt(&parserOpts)
+	}
+
+	return NewReaderWithOptions(r, parserOpts)
+}
+
+// NewReaderWithOptions is NewReader with per call limits, see
+// ParserOptions. The BodyCallback is not used, RootHeaderCallback is
+func NewReaderWithOptions(r io.Reader, opts ParserOptions) *Reader {
+	return &Reader{mt: newMimeTree(r, opts.withDefaults())}
+}
+
+/*
+	NextPart parses up to the next leaf part and returns its node and
+	decoded body. The body is only valid until the next call, whatever was
+	not read of it is skipped then. Reading it is the same as reading the
+	node, which keeps Node.Size and Node.DecodedLineCount up to date.
+
+	The node sizes, line counts and offsets are set once the part is
+	closed, ie. after the following NextPart call.
+
+	At the end of the message NextPart returns io.EOF. When parsing fails
+	the error is a *ParseError. Either way parsing stops there, and Root
+	returns the tree as ParseMime would
+*/
+func (r *Reader) NextPart() (*Node, io.Reader, error) {
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+
+	n, err := r.mt.nextPart()
+	if err != nil {
+		if err == io.EOF {
+			// Errors of the PartEnd hooks of the last parts
+			if err = r.mt.finalize(nil); err == nil {
+				err = io.EOF
+			}
+		} else {
+			err = r.mt.finalize(r.mt.parseError(err))
+		}
+		r.err = err
+		return nil, nil, err
+	}
+
+	return n, n, nil
+}
+
+// Root returns the root node of the message. Until NextPart returned
+// io.EOF or an error the tree is only parsed up to the current part
+func (r *Reader) Root() *Node {
+	return r.mt.MimetreeRoot.ChildNodes[0]
+}
@@ -0,0 +1,136 @@
+package rfc2822
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReaderParts(t *testing.T) {
+	var want []string
+	wantRoot, err := ParseMime(strings.NewReader(offsetsMessage), func(n *Node) error {
+		body, err := ioutil.ReadAll(n)
+		want = append(want, string(body))
+		return err
+	}, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []string
+	var rootHeaders int
+	opts := DefaultParserOptions()
+	opts.RootHeaderCallback = func(n *Node) error {
+		rootHeaders++
+		return nil
+	}
+	r := NewReaderWithOptions(strings.NewReader(offsetsMessage), opts)
+	for {
+		part, body, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(part.ChildNodes) != 0 {
+			t.Errorf("part %v is not a leaf", part.Path)
+		}
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got = append(got, string(b))
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got bodies %q, want %q", got, want)
+	}
+	if rootHeaders != 1 {
+		t.Errorf("root header callback called %d times", rootHeaders)
+	}
+
+	root := r.Root()
+	for i, child := range root.ChildNodes {
+		w := wantRoot.ChildNodes[i]
+		if child.Size != w.Size || child.BodyStart != w.BodyStart || child.BodyEnd != w.BodyEnd || child.LineCount != w.LineCount {
+			t.Errorf("part %v: got size %d, body %d-%d, %d lines, want %d, %d-%d, %d", child.Path,
+				child.Size, child.BodyStart, child.BodyEnd, child.LineCount, w.Size, w.BodyStart, w.BodyEnd, w.LineCount)
+		}
+	}
+
+	// Done is done
+	if _, _, err := r.NextPart(); err != io.EOF {
+		t.Errorf("got error %v after the end, want %v", err, io.EOF)
+	}
+}
+
+func TestReaderSkipsUnreadBodies(t *testing.T) {
+	r := NewReader(strings.NewReader(offsetsMessage))
+
+	first, body, err := r.NextPart()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(body, buf); err != nil || string(buf) != "line" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+
+	second, body, err := r.NextPart()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b, err := ioutil.ReadAll(body); err != nil || string(b) != "hello\nworld" {
+		t.Errorf("got second body %q, %v", b, err)
+	}
+	// The rest of the first body was drained and counted
+	if first.Size != 18 || first.DecodedLineCount != 2 {
+		t.Errorf("got first part size %d and %d lines, want 18 and 2", first.Size, first.DecodedLineCount)
+	}
+
+	if _, _, err := r.NextPart(); err != io.EOF {
+		t.Fatalf("got error %v, want %v", err, io.EOF)
+	}
+	// A body handed out before is not readable anymore
+	if n, err := second.Read(buf); n != 0 || err != io.EOF {
+		t.Errorf("got %d, %v reading a finished body", n, err)
+	}
+}
+
+func TestReaderStopEarly(t *testing.T) {
+	r := NewReader(strings.NewReader(offsetsMessage))
+	if _, _, err := r.NextPart(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Only parsed up to the current part
+	root := r.Root()
+	if len(root.ChildNodes) != 1 || root.ChildNodes[0].ContentType.SubType != "plain" {
+		t.Errorf("got %d parts", len(root.ChildNodes))
+	}
+}
+
+func TestReaderError(t *testing.T) {
+	opts := DefaultParserOptions()
+	opts.MaxMimeNodes = 3
+	r := NewReaderWithOptions(strings.NewReader(limitsMessage), opts)
+
+	var err error
+	for err == nil {
+		_, _, err = r.NextPart()
+	}
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || !errors.Is(err, ErrMaxMimeNodes) {
+		t.Fatalf("got error %v, want a ParseError for %v", err, ErrMaxMimeNodes)
+	}
+	if _, _, again := r.NextPart(); again != err {
+		t.Errorf("got error %v after the failure, want %v", again, err)
+	}
+	if root := r.Root(); root == nil || len(root.ChildNodes) != 2 {
+		t.Errorf("got partial tree %v", root)
+	}
+}
@@ -0,0 +1,320 @@
+package rfc2822
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// An address literal in a Received comment, eg. [192.0.2.1] or [IPv6:2001:db8::1]
+var ipLiteral = regexp.MustCompile(`\[(?i:IPv6:)?([0-9A-Fa-f:.]+)\]`)
+
+// A comment with TLS details. Postfix: (using TLSv1.3 with cipher ...),
+// Sendmail and Exchange: (version=TLSv1.2 cipher=...), Exim: (TLS1.3),
+// Gmail: (Google Transport Security)
+var tlsComment = regexp.MustCompile(`(?i)\busing\s+(TLS|SSL)|\bversion=(TLS|SSL)|\bcipher=|\btransport security\b|^(TLS|SSL)v?\d[._]\d`)
+
+/*
+	Hop is one Received field (RFC 5321 section 4.4), a relay the message
+	passed through.
+
+	Example:
+	Received: from mail.example.com (mail.example.com [192.0.2.1])
+		(using TLSv1.3 with cipher TLS_AES_256_GCM_SHA384 (256/256 bits))
+		by mx.example.org (Postfix) with ESMTPS id 4C2B1 for <user@example.org>;
+		Mon, 1 Jan 2024 10:00:00 +0000 (UTC)
+	will become
+	{
+		From: mail.example.com
+		Helo: mail.example.com
+		ReverseDNS: mail.example.com
+		IP: 192.0.2.1
+		By: mx.example.org
+		With: ESMTPS
+		Protocol: ESMTPS
+		ID: 4C2B1
+		For: user@example.org
+		TLS: true
+		TLSInfo: using TLSv1.3 with cipher TLS_AES_256_GCM_SHA384 (256/256 bits)
+		Comments: [mail.example.com [192.0.2.1], using TLSv1.3 ..., Postfix]
+	}
+*/
+type Hop struct {
+	// The from clause without its comments
+	From string
+	// Name the client gave in HELO/EHLO
+	Helo string
+	// Name the relay looked up for the client IP
+	ReverseDNS string
+	// Client IP
+	IP string
+	By string
+	Via string
+	// The with clause as written, eg. "ESMTPS" or "Microsoft SMTP Server"
+	With string
+	// Protocol uppercased, eg. SMTP, ESMTPSA, LMTP. See RFC 3848
+	Protocol string
+	ID       string
+	For      string
+	// Whether the hop used TLS, from the protocol or the comments
+	TLS bool
+	// TLS version and cipher, as written by the relay
+	TLSInfo  string
+	Comments []string
+	Date     time.Time
+	// Time since the previous hop, zero for the first hop or when a date
+	// is missing. Clock skew between relays can make it negative
+	Delay time.Duration
+	// The unfolded field value
+	Raw string
+}
+
+// https://datatracker.ietf.org/doc/html/rfc3848
+var receivedProtocols = map[string]bool{
+	"SMTP": true, "ESMTP": true, "ESMTPA": true, "ESMTPS": true, "ESMTPSA": true,
+	"LMTP": true, "LMTPA": true, "LMTPS": true, "LMTPSA": true,
+	"UTF8SMTP": true, "UTF8SMTPA": true, "UTF8SMTPS": true, "UTF8SMTPSA": true,
+	"UTF8LMTP": true, "UTF8LMTPA": true, "UTF8LMTPS": true, "UTF8LMTPSA": true,
+	"SMTPS": true, "HTTP": true, "HTTPS": true, "LOCAL": true, "IMAP": true,
+}
+
+/*
+	ParseReceived parses the value of a Received field. Fields are written in
+	many formats (Postfix, Exim, Sendmail, qmail, Exchange, Gmail...), so this
+	is best effort: whatever could be read is returned along with an error for
+	the date
+*/
+func ParseReceived(value string) (Hop, error) {
+	hop := Hop{Raw: value}
+
+	clauses, date := splitReceivedDate(value)
+
+	var err error
+	if date != "" {
+		hop.Date, err = mail.ParseDate(date)
+		if err != nil {
+			err = fmt.Errorf("Unable to parse Received date %v: %v", date, err)
+		}
+	}
+
+	var clause string
+	for _, tok := range tokenizeReceived(clauses) {
+		if isComment(tok) {
+			comment := strings.TrimSpace(tok[1 : len(tok)-1])
+			hop.Comments = append(hop.Comments, comment)
+			hop.readComment(clause, comment)
+			continue
+		}
+
+		switch kw := strings.ToLower(tok); kw {
+		case "from", "by", "via", "with", "id", "for":
+			// The id and for values are single words, anything after
+			// them is not a keyword of theirs
+			clause = kw
+			continue
+		}
+
+		hop.readWord(clause, tok)
+		if clause == "id" || clause == "for" {
+			clause = ""
+		}
+	}
+
+	hop.Protocol = receivedProtocol(hop.With)
+	if receivedProtocols[hop.Protocol] &&
+		(strings.HasSuffix(hop.Protocol, "S") || strings.HasSuffix(hop.Protocol, "SA")) {
+		hop.TLS = true
+	}
+	if hop.Helo == "" && hop.From != "" && !strings.HasPrefix(hop.From, "[") {
+		hop.Helo = hop.From
+	}
+
+	return hop, err
+}
+
+// readWord adds a word outside comments to its clause
+func (h *Hop) readWord(clause, word string) {
+	switch clause {
+	case "from":
+		h.From = joinWord(h.From, word)
+		if m := ipLiteral.FindStringSubmatch(word); m != nil && h.IP == "" {
+			h.IP = m[1]
+		}
+	case "by":
+		h.By = joinWord(h.By, word)
+	case "via":
+		h.Via = joinWord(h.Via, word)
+	case "with":
+		// Exim writes "with esmtps tls TLS_AES_256_GCM_SHA384"
+		if strings.EqualFold(word, "tls") {
+			h.TLS = true
+			return
+		}
+		if h.TLS && strings.HasPrefix(strings.ToUpper(word), "TLS_") {
+			h.TLSInfo = joinWord(h.TLSInfo, word)
+			return
+		}
+		h.With = joinWord(h.With, word)
+	case "id":
+		h.ID = strings.Trim(word, "<>")
+	case "for":
+		h.For = strings.Trim(word, "<>")
+	}
+}
+
+// readComment picks the client details and TLS info out of a comment
+func (h *Hop) readComment(clause, comment string) {
+	lower := strings.ToLower(comment)
+
+	if tlsComment.MatchString(comment) {
+		h.TLS = true
+		h.TLSInfo = joinWord(h.TLSInfo, comment)
+	}
+
+	if clause != "from" {
+		return
+	}
+
+	// Exim: (helo=client.example), qmail: (HELO client.example)
+	for _, prefix := range []string{"helo=", "helo ", "ehlo=", "ehlo "} {
+		if strings.HasPrefix(lower, prefix) {
+			h.Helo = strings.TrimSpace(comment[len(prefix):])
+			return
+		}
+	}
+
+	words := strings.Fields(comment)
+	if len(words) == 0 {
+		return
+	}
+
+	// Postfix and Sendmail: (rdns [ip]), Exchange: (ip)
+	if m := ipLiteral.FindStringSubmatch(comment); m != nil {
+		h.IP = m[1]
+		if len(words) > 1 && !strings.HasPrefix(words[0], "[") {
+			if rdns := strings.TrimSuffix(words[0], "."); !strings.EqualFold(rdns, "unknown") {
+				h.ReverseDNS = rdns
+			}
+		}
+		return
+	}
+	if net.ParseIP(words[0]) != nil && h.IP == "" {
+		h.IP = words[0]
+	}
+}
+
+func receivedProtocol(with string) string {
+	words := strings.Fields(strings.ToUpper(with))
+	for _, w := range words {
+		if receivedProtocols[w] {
+			return w
+		}
+	}
+	if len(words) != 0 {
+		return words[0]
+	}
+	return ""
+}
+
+// splitReceivedDate splits the value at the last ';' outside comments
+func splitReceivedDate(value string) (clauses, date string) {
+	depth := 0
+	split := -1
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			if depth > 0 {
+				depth--
+			}
+		case ';':
+			if depth == 0 {
+				split = i
+			}
+		}
+	}
+	if split < 0 {
+		return value, ""
+	}
+	return value[:split], strings.TrimSpace(value[split+1:])
+}
+
+// tokenizeReceived splits on whitespace, keeping comments, possibly
+// nested, and angle addresses as single tokens
+func tokenizeReceived(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(':
+			depth, j := 0, i
+			for ; j < len(s); j++ {
+				if s[j] == '\\' {
+					j++
+					continue
+				}
+				if s[j] == '(' {
+					depth++
+				} else if s[j] == ')' {
+					depth--
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			if j >= len(s) {
+				// Unclosed comment, close it
+				tokens = append(tokens, s[i:]+")")
+				return tokens
+			}
+			tokens = append(tokens, s[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && s[j] != ' ' && s[j] != '\t' && s[j] != '(' {
+				if s[j] == '<' {
+					if k := strings.IndexByte(s[j:], '>'); k >= 0 {
+						j += k
+					}
+				}
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+func isComment(tok string) bool {
+	return strings.HasPrefix(tok, "(")
+}
+
+func joinWord(s, word string) string {
+	if s == "" {
+		return word
+	}
+	return s + " " + word
+}
+
+// ParseHops parses Received field values, given oldest first as in
+// Node.ParsedHeader, into hops and computes the delay of each hop. Hops
+// with an unparseable date are kept with a zero Date
+func ParseHops(received []string) []Hop {
+	hops := make([]Hop, 0, len(received))
+	for i, v := range received {
+		hop, _ := ParseReceived(v)
+		if i > 0 && !hop.Date.IsZero() && !hops[i-1].Date.IsZero() {
+			hop.Delay = hop.Date.Sub(hops[i-1].Date)
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
@@ -0,0 +1,188 @@
+package rfc2822
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseReceived(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  Hop
+	}{
+		{
+			"postfix",
+			"from mail.example.com (mail.example.com [192.0.2.1])\t(using TLSv1.3 with cipher TLS_AES_256_GCM_SHA384 (256/256 bits))\tby mx.example.org (Postfix) with ESMTPS id 4C2B1 for <user@example.org>;\tMon, 1 Jan 2024 10:00:00 +0000 (UTC)",
+			Hop{
+				From: "mail.example.com", Helo: "mail.example.com", ReverseDNS: "mail.example.com", IP: "192.0.2.1",
+				By: "mx.example.org", With: "ESMTPS", Protocol: "ESMTPS", ID: "4C2B1", For: "user@example.org",
+				TLS: true, TLSInfo: "using TLSv1.3 with cipher TLS_AES_256_GCM_SHA384 (256/256 bits)",
+				Comments: []string{"mail.example.com [192.0.2.1]", "using TLSv1.3 with cipher TLS_AES_256_GCM_SHA384 (256/256 bits)", "Postfix"},
+				Date:     time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			"exim",
+			"from [198.51.100.7] (helo=client.example) by mx.example.net with esmtps tls TLS_AES_128_GCM_SHA256 (Exim 4.96) id 1qAbCd-000123-Ef; Tue, 02 Jan 2024 11:30:00 +0100",
+			Hop{
+				From: "[198.51.100.7]", Helo: "client.example", IP: "198.51.100.7",
+				By: "mx.example.net", With: "esmtps", Protocol: "ESMTPS", ID: "1qAbCd-000123-Ef",
+				TLS: true, TLSInfo: "TLS_AES_128_GCM_SHA256",
+				Comments: []string{"helo=client.example", "Exim 4.96"},
+				Date:     time.Date(2024, 1, 2, 11, 30, 0, 0, time.FixedZone("", 3600)),
+			},
+		},
+		{
+			"qmail",
+			"(qmail 12345 invoked from network); 3 Jan 2024 08:00:00 -0000",
+			Hop{
+				Comments: []string{"qmail 12345 invoked from network"},
+				Date:     time.Date(2024, 1, 3, 8, 0, 0, 0, time.FixedZone("", 0)),
+			},
+		},
+		{
+			"exchange",
+			"from EX1.corp.example (10.0.0.5) by EX2.corp.example (10.0.0.6) with Microsoft SMTP Server (version=TLS1_2, cipher=TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384) id 15.1.2507.6; Wed, 3 Jan 2024 09:00:00 +0000",
+			Hop{
+				From: "EX1.corp.example", Helo: "EX1.corp.example", IP: "10.0.0.5",
+				By: "EX2.corp.example", With: "Microsoft SMTP Server", Protocol: "SMTP", ID: "15.1.2507.6",
+				TLS: true, TLSInfo: "version=TLS1_2, cipher=TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+				Comments: []string{"10.0.0.5", "10.0.0.6", "version=TLS1_2, cipher=TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+				Date:     time.Date(2024, 1, 3, 9, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			"ipv6",
+			"from relay (unknown [IPv6:2001:db8::1]) by mx with SMTP; Thu, 4 Jan 2024 00:00:00 +0000",
+			Hop{
+				From: "relay", Helo: "relay", IP: "2001:db8::1", By: "mx", With: "SMTP", Protocol: "SMTP",
+				Comments: []string{"unknown [IPv6:2001:db8::1]"},
+				Date:     time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			// Plain SMTP, "tls" in the host name is not TLS
+			"tls host",
+			"from tls1.example.com (tls1.example.com [192.0.2.1]) by mx.example.org with SMTP id 1; Fri, 5 Jan 2024 00:00:00 +0000",
+			Hop{
+				From: "tls1.example.com", Helo: "tls1.example.com", ReverseDNS: "tls1.example.com", IP: "192.0.2.1",
+				By: "mx.example.org", With: "SMTP", Protocol: "SMTP", ID: "1",
+				Comments: []string{"tls1.example.com [192.0.2.1]"},
+				Date:     time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			"sendmail",
+			"from client.example (client.example [192.0.2.9]) by mx.example.org (8.17.1/8.17.1) with ESMTP id 405AbC (version=TLSv1.3 cipher=TLS_AES_256_GCM_SHA384 bits=256 verify=NOT); Fri, 5 Jan 2024 01:00:00 +0000",
+			Hop{
+				From: "client.example", Helo: "client.example", ReverseDNS: "client.example", IP: "192.0.2.9",
+				By: "mx.example.org", With: "ESMTP", Protocol: "ESMTP", ID: "405AbC",
+				TLS: true, TLSInfo: "version=TLSv1.3 cipher=TLS_AES_256_GCM_SHA384 bits=256 verify=NOT",
+				Comments: []string{"client.example [192.0.2.9]", "8.17.1/8.17.1", "version=TLSv1.3 cipher=TLS_AES_256_GCM_SHA384 bits=256 verify=NOT"},
+				Date:     time.Date(2024, 1, 5, 1, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			"gmail",
+			"from mail-sor-f41.google.com (mail-sor-f41.google.com. [209.85.220.41]) by mx.google.com with SMTPS id a1sor for <user@example.org> (Google Transport Security); Fri, 5 Jan 2024 02:00:00 -0800",
+			Hop{
+				From: "mail-sor-f41.google.com", Helo: "mail-sor-f41.google.com", ReverseDNS: "mail-sor-f41.google.com", IP: "209.85.220.41",
+				By: "mx.google.com", With: "SMTPS", Protocol: "SMTPS", ID: "a1sor", For: "user@example.org",
+				TLS: true, TLSInfo: "Google Transport Security",
+				Comments: []string{"mail-sor-f41.google.com. [209.85.220.41]", "Google Transport Security"},
+				Date:     time.Date(2024, 1, 5, 10, 0, 0, 0, time.UTC),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseReceived(tt.value)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		tt.want.Raw = tt.value
+		if !got.Date.Equal(tt.want.Date) {
+			t.Errorf("%s: got date %v, want %v", tt.name, got.Date, tt.want.Date)
+		}
+		got.Date, tt.want.Date = time.Time{}, time.Time{}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got\n%+v\nwant\n%+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseReceivedBadDate(t *testing.T) {
+	hop, err := ParseReceived("from a by b with SMTP; yesterday")
+	if err == nil {
+		t.Error("no error for a bad date")
+	}
+	if hop.From != "a" || hop.By != "b" || !hop.Date.IsZero() {
+		t.Errorf("got %+v", hop)
+	}
+}
+
+func TestParseHops(t *testing.T) {
+	hops := ParseHops([]string{
+		"from a by b; Mon, 1 Jan 2024 10:00:00 +0000",
+		"from b by c; Mon, 1 Jan 2024 11:00:05 +0100",
+		"from c by d; broken",
+		"from d by e; Mon, 1 Jan 2024 10:00:10 +0000",
+	})
+
+	want := []time.Duration{0, 5 * time.Second, 0, 0}
+	for i, hop := range hops {
+		if hop.Delay != want[i] {
+			t.Errorf("hop %d: got delay %v, want %v", i, hop.Delay, want[i])
+		}
+	}
+}
+
+func TestFormatHeadersHops(t *testing.T) {
+	msg := "Received: from b by c; Mon, 1 Jan 2024 10:00:30 +0000\r\n" +
+		"Received: from a by b; Mon, 1 Jan 2024 10:00:00 +0000\r\n" +
+		"From: a@example.com\r\n" +
+		"Message-ID: <1@example.com>\r\n" +
+		"\r\n" +
+		"body\r\n"
+
+	root, err := ParseMime(strings.NewReader(msg), nil, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sm, err := FormatHeaders(root)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(sm.Hops) != 2 || sm.Hops[0].From != "a" || sm.Hops[1].From != "b" || sm.Hops[1].Delay != 30*time.Second {
+		t.Errorf("got hops %+v", sm.Hops)
+	}
+	if len(sm.Headers["received"]) != 2 {
+		t.Errorf("got received headers %v", sm.Headers["received"])
+	}
+}
+
+func TestReceivedTLSComments(t *testing.T) {
+	tests := []struct {
+		comment string
+		tls     bool
+	}{
+		{"using TLSv1.2 with cipher ECDHE-RSA-AES256-GCM-SHA384 (256/256 bits)", true},
+		{"version=TLS1_2, cipher=TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", true},
+		{"TLS1.3", true},
+		{"Google Transport Security", true},
+		{"tls1.example.com [192.0.2.1]", false},
+		{"helo=tls.example.com", false},
+		{"cipherpunk.example [192.0.2.2]", false},
+	}
+
+	for _, tt := range tests {
+		hop, _ := ParseReceived("from client (" + tt.comment + ") by mx with ESMTP; Fri, 5 Jan 2024 00:00:00 +0000")
+		if hop.TLS != tt.tls {
+			t.Errorf("%q: got TLS %v, want %v", tt.comment, hop.TLS, tt.tls)
+		}
+	}
+}
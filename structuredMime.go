@@ -3,6 +3,7 @@ package rfc2822
 import (
 	"fmt"
 	"net/mail"
+	"strings"
 	"time"
 )
 
@@ -11,15 +12,82 @@ import (
 	To: =?ISO-8859-1?Q?Keld_J=F8rn_Simonsen?= (Keld) <用户@例子.广告>
 	will become
 	{
-		Name: Keld Jørn Simonsen (Keld)
-		Address: <用户@例子.广告>
-		AddressText: =?utf-8?b?S2VsZCBKw7hybiBTaW1vbnNlbiAoS2VsZCk=?= <用户@例子.广告>
+		Name: Keld Jørn Simonsen
+		Address: 用户@例子.广告
+		AddressText: Keld =?utf-8?b?SsO4cm4=?= Simonsen <用户@例子.广告>
+		Comments: [Keld]
+		Raw: =?ISO-8859-1?Q?Keld_J=F8rn_Simonsen?= (Keld) <用户@例子.广告>
 	}
 */
 type Address struct {
-	Name        string // Utf-8 string
-	Address     string // Utf-8/ASCII string
-	AddressText string // Encoded Address format
+	Name    string // Utf-8 string
+	Address string // Utf-8/ASCII string
+	// Encoded Address format, with the name quoted or RFC 2047 encoded as
+	// needed. A non ascii Address is kept as utf-8, which RFC 6532 allows
+	AddressText string
+	// Name of the group the address is part of, eg. for
+	// To: Team: a@example.com, b@example.com;
+	// An empty group only has this set
+	Group string
+	// Comments around the address, decoded
+	Comments []string
+	// The address as it appeared in the header
+	Raw string
+}
+
+// String returns the encoded form of the address, see AddressText. It does
+// not include the group
+func (a Address) String() string {
+	if a.Address == "" {
+		return ""
+	}
+	if a.Name == "" {
+		return a.Address
+	}
+	return EncodePhrase(a.Name) + " <" + a.Address + ">"
+}
+
+/*
+	FormatAddressList formats addresses as a header value, members of the same
+	group are written as a group. Names are quoted or encoded as needed and
+	the value only has spaces where it may be folded, so it can be passed as
+	is to Node.SetHeader or FoldHeader.
+
+	Example:
+	FormatAddressList([]Address{{Name: "Doe, John", Address: "j@example.com"}, {Group: "undisclosed-recipients"}})
+	== `"Doe, John" <j@example.com>, undisclosed-recipients:;`
+*/
+func FormatAddressList(addrs []Address) string {
+	var sb strings.Builder
+	group := ""
+
+	for i, a := range addrs {
+		if a.Group != group {
+			if group != "" {
+				sb.WriteString(";")
+			}
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			if a.Group != "" {
+				sb.WriteString(EncodePhrase(a.Group) + ":")
+				if a.Address != "" {
+					sb.WriteString(" ")
+				}
+			}
+		} else if i > 0 {
+			sb.WriteString(", ")
+		}
+		group = a.Group
+
+		sb.WriteString(a.String())
+	}
+
+	if group != "" {
+		sb.WriteString(";")
+	}
+
+	return sb.String()
 }
 
 type FormattedRootHeaders struct {
@@ -34,12 +102,24 @@ type FormattedRootHeaders struct {
 	Sender      []Address
 	ReplyTo     []Address
 	DeliveredTo []Address
-	ReturnPath  []Address
-	Priority    string
-	MessageID   string
-	InReplyTo   []string
-	Date        time.Time
+	// The null reverse-path "<>" of a bounce is an Address with only Raw set
+	ReturnPath []Address
+	Priority   string
+	MessageID  string
+	InReplyTo  []string
+	Date       time.Time
+	// The Date field value as written, unfolded
+	RawDate     string
 	ContentType ContentType
+	// Received fields, oldest first. The fields are in Headers as well
+	Hops []Hop
+	// Authentication-Results and Received-SPF fields, oldest first. The
+	// fields are in Headers as well. Filter them with FilterAuthResults
+	// before relying on them
+	AuthResults []AuthResults
+	ReceivedSPF []ReceivedSPF
+	// ARC sets, oldest first, not validated. See VerifyARC
+	ARC []ARCSet
 }
 
 func NewFormattedRootHeaders() FormattedRootHeaders {
@@ -60,153 +140,194 @@ func NewFormattedRootHeaders() FormattedRootHeaders {
 		MessageID:   "",
 		InReplyTo:   []string{},
 		Date:        time.Time{},
+		Hops:        []Hop{},
+		AuthResults: []AuthResults{},
+		ReceivedSPF: []ReceivedSPF{},
+		ARC:         []ARCSet{},
 	}
 }
 
 func GetRootHeaderCallback(sm *FormattedRootHeaders) func(node *Node) error {
 	return func(node *Node) error {
-		parsedHeaders := node.ParsedHeader
-
-		sm.ContentType = node.ContentType
-		// Don't process bad headers, let lib consumer deal with it
-		sm.BadHeaders = node.BadHeaders
-
-		for k, v := range parsedHeaders {
-			switch k {
-			case "subject":
-				// can be encode-word, needs decoding
-				// example Subject: =?UTF-8?B?0LDQvdC00YA=?=
-				if len(v) != 0 {
-					// If there were repeated Subject header fields
-					// choose the last one
-					sm.Subject = decodeToUTF8Base64Header(v[len(v)-1])
-				} else {
-					sm.Subject = ""
-				}
-			case "date":
-				// date type
-				var decodedDate time.Time
-				var decodeErr error
-				if len(v) != 0 {
-					dateString := v[len(v)-1]
-					decodedDate, decodeErr = mail.ParseDate(dateString)
-					if decodeErr != nil {
-						return fmt.Errorf("Unable to parse date %v", dateString)
-					}
-				} else {
-					decodedDate = time.Now()
-				}
-				sm.Date = decodedDate
-			// Note: Message-Id can not have rfc2047 encoded words
-			case "references":
-				// references array
-				var referencesArr []string
-				for _, refs := range v {
-					res, err := MsgIDList(refs)
-					if err != nil {
-						return fmt.Errorf("Unable to parse references %v: %v", refs, err)
-					}
-					referencesArr = append(referencesArr, res...)
-				}
-				sm.References = append(sm.References, referencesArr...)
-			case "message-id":
-				// A message should have only one message ID
-				// if more than one then maybe show parsing error
-				if len(v) == 0 {
-					return fmt.Errorf("No message-id header")
-				}
+		return formatHeaders(sm, node)
+	}
+}
 
-				if len(v) > 1 {
-					return fmt.Errorf("Can't have more than one message-id header")
-				}
+// FormatHeaders formats the header of any message node the same way
+// GetRootHeaderCallback does for the root. This is meant for encapsulated
+// messages, ie. the child node of a message/rfc822 part
+func FormatHeaders(node *Node) (FormattedRootHeaders, error) {
+	sm := NewFormattedRootHeaders()
+	err := formatHeaders(&sm, node)
+	return sm, err
+}
+
+func formatHeaders(sm *FormattedRootHeaders, node *Node) error {
+	parsedHeaders := node.ParsedHeader
 
-				res, err := MsgIDList(v[0])
+	sm.ContentType = node.ContentType
+	// Don't process bad headers, let lib consumer deal with it
+	sm.BadHeaders = node.BadHeaders
+
+	for k, v := range parsedHeaders {
+		switch k {
+		case "subject":
+			// can be encode-word, needs decoding
+			// example Subject: =?UTF-8?B?0LDQvdC00YA=?=
+			if len(v) != 0 {
+				// If there were repeated Subject header fields
+				// choose the last one
+				sm.Subject = decodeToUTF8Base64Header(v[len(v)-1])
+			} else {
+				sm.Subject = ""
+			}
+		case "date":
+			// date type
+			var decodedDate time.Time
+			var decodeErr error
+			if len(v) != 0 {
+				dateString := v[len(v)-1]
+				sm.RawDate = strings.TrimSpace(dateString)
+				decodedDate, decodeErr = mail.ParseDate(dateString)
+				if decodeErr != nil {
+					return fmt.Errorf("Unable to parse date %v", dateString)
+				}
+			} else {
+				decodedDate = time.Now()
+			}
+			sm.Date = decodedDate
+		// Note: Message-Id can not have rfc2047 encoded words
+		case "references":
+			// references array
+			var referencesArr []string
+			for _, refs := range v {
+				res, err := MsgIDList(refs)
 				if err != nil {
-					return fmt.Errorf("Unable to parse message-id %v", v[0], err)
+					return fmt.Errorf("Unable to parse references %v: %v", refs, err)
 				}
+				referencesArr = append(referencesArr, res...)
+			}
+			sm.References = append(sm.References, referencesArr...)
+		case "message-id":
+			// A message should have only one message ID
+			// if more than one then maybe show parsing error
+			if len(v) == 0 {
+				return fmt.Errorf("No message-id header")
+			}
 
-				sm.MessageID = res[0]
+			if len(v) > 1 {
+				return fmt.Errorf("Can't have more than one message-id header")
+			}
 
-			case "in-reply-to":
-				var irts []string
-				for _, refs := range v {
-					res, err := MsgIDList(refs)
-					if err != nil {
-						return fmt.Errorf("Unable to parse references %v: %v", refs, err)
-					}
-					irts = append(irts, res...)
+			res, err := MsgIDList(v[0])
+			if err != nil {
+				return fmt.Errorf("Unable to parse message-id %v: %v", v[0], err)
+			}
+
+			sm.MessageID = res[0]
+
+		case "in-reply-to":
+			var irts []string
+			for _, refs := range v {
+				res, err := MsgIDList(refs)
+				if err != nil {
+					return fmt.Errorf("Unable to parse references %v: %v", refs, err)
 				}
-				sm.InReplyTo = append(sm.InReplyTo, irts...)
-			case "priority", "x-priority", "x-msmail-priority", "importance":
-				// Priority parser
-				// Could be a number like "1" or a string "High"
-				// Right now keeping the raw string, maybe add a parser later
-				sm.Priority = v[len(v)-1] // Use the latest header if there were more than one
-			case "to", "from", "cc", "bcc", "sender", "reply-to", "delivered-to", "return-path":
-				// UTF8 email addresses according to the RFCs 5890, 5891 and 5892 are left in unicode
-				// they are not parsed into puny-code.
-				var parsedAddresses []*mail.Address
-				var parseError error
-				var a Address
-				for _, addr := range v {
-					parsedAddresses, parseError = parseAddress(addr)
-					if parseError != nil {
-						return fmt.Errorf("Error parsing address header: %v, %v", addr, parseError)
-					}
-					for _, parsedAddr := range parsedAddresses {
-						a.Name = parsedAddr.Name
-						a.Address = parsedAddr.Address
-						a.Name = parsedAddr.String()
-
-						if k == "from" {
-							sm.From = append(sm.From, a)
-						} else if k == "to" {
-							sm.To = append(sm.To, a)
-						} else if k == "cc" {
-							sm.Cc = append(sm.Cc, a)
-						} else if k == "bcc" {
-							sm.Bcc = append(sm.Bcc, a)
-						} else if k == "sender" {
-							sm.Sender = append(sm.Sender, a)
-						} else if k == "reply-to" {
-							sm.ReplyTo = append(sm.ReplyTo, a)
-						} else if k == "delivered-to" {
-							sm.DeliveredTo = append(sm.DeliveredTo, a)
-						} else if k == "return-path" {
-							sm.ReturnPath = append(sm.ReturnPath, a)
-						}
+				irts = append(irts, res...)
+			}
+			sm.InReplyTo = append(sm.InReplyTo, irts...)
+		case "received":
+			sm.Hops = ParseHops(v)
+			sm.Headers[k] = v
+		case "authentication-results":
+			// Fields added by other hosts are not our concern, skip the
+			// malformed ones instead of failing
+			for _, res := range v {
+				if ar, _ := ParseAuthResults(res); ar.AuthServID != "" || len(ar.Results) != 0 {
+					sm.AuthResults = append(sm.AuthResults, ar)
+				}
+			}
+			sm.Headers[k] = v
+		case "received-spf":
+			for _, res := range v {
+				if spf, _ := ParseReceivedSPF(res); spf.Result != "" {
+					sm.ReceivedSPF = append(sm.ReceivedSPF, spf)
+				}
+			}
+			sm.Headers[k] = v
+		case "arc-seal":
+			// The sets are grouped from all three ARC fields, found in
+			// RawHeaders. Malformed sets are kept, VerifyARC reports them
+			sm.ARC, _ = ParseARC(node)
+			sm.Headers[k] = v
+		case "priority", "x-priority", "x-msmail-priority", "importance":
+			// Priority parser
+			// Could be a number like "1" or a string "High"
+			// Right now keeping the raw string, maybe add a parser later
+			sm.Priority = v[len(v)-1] // Use the latest header if there were more than one
+		case "to", "from", "cc", "bcc", "sender", "reply-to", "delivered-to", "return-path":
+			// UTF8 email addresses according to the RFCs 5890, 5891 and 5892 are left in unicode
+			// they are not parsed into puny-code.
+			var parsedAddresses []Address
+			var parseError error
+			for _, addr := range v {
+				if k == "return-path" {
+					parsedAddresses, parseError = parseReturnPath(addr)
+				} else {
+					parsedAddresses, parseError = ParseAddressList(addr)
+				}
+				if parseError != nil {
+					return fmt.Errorf("Error parsing address header: %v, %v", addr, parseError)
+				}
+				for _, a := range parsedAddresses {
+					if k == "from" {
+						sm.From = append(sm.From, a)
+					} else if k == "to" {
+						sm.To = append(sm.To, a)
+					} else if k == "cc" {
+						sm.Cc = append(sm.Cc, a)
+					} else if k == "bcc" {
+						sm.Bcc = append(sm.Bcc, a)
+					} else if k == "sender" {
+						sm.Sender = append(sm.Sender, a)
+					} else if k == "reply-to" {
+						sm.ReplyTo = append(sm.ReplyTo, a)
+					} else if k == "delivered-to" {
+						sm.DeliveredTo = append(sm.DeliveredTo, a)
+					} else if k == "return-path" {
+						sm.ReturnPath = append(sm.ReturnPath, a)
 					}
 				}
-			default:
-				// put it in the headers thing
-				sm.Headers[k] = v
 			}
+		default:
+			// put it in the headers thing
+			sm.Headers[k] = v
 		}
+	}
 
-		//Validations:
+	//Validations:
 
-		// TODO:
-		// Must have messageId
+	// TODO:
+	// Must have messageId
 
-		if sm.MessageID == "" {
-			return fmt.Errorf("Message-ID header can not be empty")
-		}
+	if sm.MessageID == "" {
+		return fmt.Errorf("Message-ID header can not be empty")
+	}
 
-		// https://datatracker.ietf.org/doc/html/rfc5322#section-3.6.2
-		if len(sm.From) == 0 && len(sm.Sender) == 0 {
-			return fmt.Errorf("From and Sender headers both can not be 0")
-		}
-		/*
-			If the from field contains more than one mailbox specification
-			in the mailbox-list, then the sender field, containing the field name "Sender" and a
-			single mailbox specification, MUST appear in the message.
-		*/
-		if len(sm.From) > 1 {
-			if len(sm.Sender) != 1 {
-				return fmt.Errorf("Sender header is neeed when there are multiple From values")
-			}
+	// https://datatracker.ietf.org/doc/html/rfc5322#section-3.6.2
+	if len(sm.From) == 0 && len(sm.Sender) == 0 {
+		return fmt.Errorf("From and Sender headers both can not be 0")
+	}
+	/*
+		If the from field contains more than one mailbox specification
+		in the mailbox-list, then the sender field, containing the field name "Sender" and a
+		single mailbox specification, MUST appear in the message.
+	*/
+	if len(sm.From) > 1 {
+		if len(sm.Sender) != 1 {
+			return fmt.Errorf("Sender header is neeed when there are multiple From values")
 		}
-
-		return nil
 	}
+
+	return nil
 }
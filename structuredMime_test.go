@@ -0,0 +1,125 @@
+package rfc2822
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatHeadersBounce(t *testing.T) {
+	msg := "Return-Path: <>\r\n" +
+		"From: Mail Delivery System <MAILER-DAEMON@example.com>\r\n" +
+		"To: Team: a@example.com;\r\n" +
+		"Message-ID: <bounce@example.com>\r\n" +
+		"Subject: Undelivered Mail\r\n" +
+		"\r\n" +
+		"body\r\n"
+
+	sm := NewFormattedRootHeaders()
+	_, err := ParseMime(strings.NewReader(msg), nil, GetRootHeaderCallback(&sm), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if want := []Address{{Raw: "<>"}}; !reflect.DeepEqual(sm.ReturnPath, want) {
+		t.Errorf("got return path %+v, want %+v", sm.ReturnPath, want)
+	}
+	if len(sm.From) != 1 || sm.From[0].Name != "Mail Delivery System" || sm.From[0].Address != "MAILER-DAEMON@example.com" {
+		t.Errorf("got from %+v", sm.From)
+	}
+	if len(sm.To) != 1 || sm.To[0].Group != "Team" || sm.To[0].Address != "a@example.com" {
+		t.Errorf("got to %+v", sm.To)
+	}
+	if sm.MessageID != "<bounce@example.com>" {
+		t.Errorf("got message id %q", sm.MessageID)
+	}
+}
+
+func TestFormatAddressList(t *testing.T) {
+	tests := []struct {
+		addrs []Address
+		want  string
+	}{
+		{nil, ""},
+		{[]Address{{Address: "a@example.com"}}, "a@example.com"},
+		{
+			[]Address{{Name: "Doe, John", Address: "j@example.com"}, {Group: "undisclosed-recipients"}},
+			"\"Doe, John\" <j@example.com>, undisclosed-recipients:;",
+		},
+		{
+			[]Address{
+				{Address: "a@example.com", Group: "Team"},
+				{Name: "B", Address: "b@example.com", Group: "Team"},
+				{Address: "c@example.com"},
+				{Address: "d@example.com", Group: "Other"},
+			},
+			"Team: a@example.com, B <b@example.com>;, c@example.com, Other: d@example.com;",
+		},
+		{[]Address{{Name: "Jörg", Address: "jörg@example.com"}}, "=?utf-8?b?SsO2cmc=?= <jörg@example.com>"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatAddressList(tt.addrs); got != tt.want {
+			t.Errorf("FormatAddressList(%+v) = %q, want %q", tt.addrs, got, tt.want)
+		}
+	}
+}
+
+func TestFormatAddressListRoundTrip(t *testing.T) {
+	inputs := []string{
+		"John Doe <john@example.com>, \"Doe, Jane\" <jane@example.com>",
+		"=?ISO-8859-1?Q?Keld_J=F8rn_Simonsen?= (Keld) <用户@例子.广告>",
+		"Team: a@example.com, B <b@example.com>;, c@example.com",
+		"\"john doe\"@example.com, \"say \\\"hi\\\"\" <hi@example.com>",
+		"undisclosed-recipients:;",
+	}
+
+	for _, in := range inputs {
+		addrs, err := ParseAddressList(in)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", in, err)
+		}
+		formatted := FormatAddressList(addrs)
+		again, err := ParseAddressList(formatted)
+		if err != nil {
+			t.Fatalf("%q: unexpected error parsing %q: %v", in, formatted, err)
+		}
+		if len(again) != len(addrs) {
+			t.Fatalf("%q: got %d addresses from %q, want %d", in, len(again), formatted, len(addrs))
+		}
+		for i := range addrs {
+			a, b := addrs[i], again[i]
+			if a.Name != b.Name || a.Address != b.Address || a.Group != b.Group || a.AddressText != b.AddressText {
+				t.Errorf("%q: got %+v from %q, want %+v", in, b, formatted, a)
+			}
+		}
+	}
+}
+
+func TestFormatHeadersEncapsulated(t *testing.T) {
+	root, err := ParseMime(strings.NewReader(encapsulatedMessage), nil, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sm, err := FormatHeaders(root.ChildNodes[1].ChildNodes[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sm.Subject != "inner" {
+		t.Errorf("got subject %q, want %q", sm.Subject, "inner")
+	}
+	if len(sm.From) != 1 || sm.From[0].Address != "inner@example.com" {
+		t.Errorf("got from %+v", sm.From)
+	}
+	if want := time.Date(1994, 2, 8, 5, 52, 25, 0, time.UTC); !sm.Date.Equal(want) {
+		t.Errorf("got date %v, want %v", sm.Date, want)
+	}
+	if sm.MessageID != "<inner@example.com>" {
+		t.Errorf("got message id %q", sm.MessageID)
+	}
+	if sm.ContentType.SubType != "alternative" {
+		t.Errorf("got content type %+v", sm.ContentType)
+	}
+}
@@ -17,7 +17,8 @@ func main() {
 	smCallback := bodyCallback()
 	hc := mime.GetRootHeaderCallback(&sm)
 
-	_, err := mime.ParseMime(reader, smCallback, hc, false)
+	// text/plain and text/html bodies are kept in Node.Body, up to 64KB
+	_, err := mime.ParseMime(reader, smCallback, hc, false, mime.WithCapturePolicies(mime.CaptureTextBodies(64<<10)))
 
 	fmt.Println("========= SM ============")
 	fmt.Println(sm.Date)
@@ -46,47 +47,16 @@ func main() {
 func bodyCallback() func(n *mime.Node) error {
 	return func(n *mime.Node) error {
 
-		// Is this node an attachment
-		// isAttachment := true
-
-		// if n.ContentType.Type == "text" {
-		// 	if n.ContentType.SubType == "plain" || n.ContentType.SubType == "html" {
-		// 		isAttachment = false
-		// 	}
-		// } else if n.ContentDisposition.MediaType != "inline" {
-		// 	isAttachment = false
-		// }
-
-		// Content Type can be of the following types
-		// message, multipart, text, application
-		// for now anything aside from
-		/*
-			text/
-				plain
-				html
-			multipart/
-				mixed
-				alternate
-				related
-		*/
-		// is not processed , they will be treated as attachments/blob
-
-		// If of type html/text
-		// keep putting in body till a limit, if limit crossed then create a new reader and put in store
-		// if text then keep a small subset?
-		// update the atts array
-		// if attachment
-		// put in store
-		// update the atts array
+		// The displayed bodies are captured by the parser, see
+		// WithCapturePolicies. Attachments could be streamed to a store here
+		if n.ContentDisposition.MediaType == "attachment" {
+			return n.Skip()
+		}
 
 		_, err := ioutil.ReadAll(n)
 		if err != nil {
 			return err
 		}
-		// fmt.Println("\nbody..........................")
-		// fmt.Println("attachments: ", isAttachment)
-		// fmt.Println(string(buf))
-		// fmt.Println("body over..................\n")
 
 		return nil
 	}
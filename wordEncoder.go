@@ -0,0 +1,327 @@
+package rfc2822
+
+import (
+	"encoding/base64"
+	"strings"
+	"unicode/utf8"
+)
+
+// https://datatracker.ietf.org/doc/html/rfc2047#section-2
+// An encoded word may not be more than 75 characters long
+const maxEncodedWordLen = 75
+
+// Header fields are folded at this many columns when written out
+const foldColumns = 78
+
+// Room left for the encoded text in "=?utf-8?q?...?="
+const maxEncodedTextLen = maxEncodedWordLen - len("=?"+UTF8+"?q?") - len("?=")
+
+// Where an encoded word appears restricts the characters it may contain,
+// RFC 2047 section 5
+type wordContext int
+
+const (
+	// Unstructured fields like Subject
+	textContext wordContext = iota
+	// Display names in address fields
+	phraseContext
+	// Parenthesised comments in structured fields
+	commentContext
+)
+
+/*
+	EncodeText encodes an unstructured header value, like Subject, with RFC 2047
+	encoded words. Only the words which need it are encoded, each as Q or B
+	whichever is shorter, and split on utf-8 character boundaries so that no
+	encoded word is over 75 octets.
+
+	Example:
+	EncodeText("Grüße aus Köln") == "=?utf-8?b?R3LDvMOfZQ==?= aus =?utf-8?b?S8O2bG4=?="
+	EncodeText("Zürich") == "=?utf-8?q?Z=C3=BCrich?="
+*/
+func EncodeText(s string) string {
+	return encodeWords(s, textContext)
+}
+
+// EncodePhrase encodes a display name. ASCII names are returned as atoms or
+// as a quoted string, others are encoded with the characters allowed in a
+// phrase
+func EncodePhrase(s string) string {
+	tokens := strings.Split(s, " ")
+
+	plain := true
+	atoms := true
+	for _, t := range tokens {
+		if needsEncoding(t) {
+			plain = false
+		} else if !isAtom(t) {
+			atoms = false
+		}
+	}
+
+	switch {
+	case plain && atoms:
+		return s
+	case plain:
+		return quoteString(s)
+	case atoms:
+		return encodeWords(s, phraseContext)
+	}
+
+	// Quoted strings can't hold encoded words, encode the whole phrase
+	return encodeRun(s, phraseContext)
+}
+
+// EncodeComment encodes the text of a comment, without the enclosing
+// parentheses
+func EncodeComment(s string) string {
+	return encodeWords(s, commentContext)
+}
+
+func encodeWords(s string, ctx wordContext) string {
+	var out, run []string
+
+	flush := func() {
+		if len(run) != 0 {
+			out = append(out, encodeRun(strings.Join(run, " "), ctx))
+			run = nil
+		}
+	}
+
+	for _, t := range strings.Split(s, " ") {
+		// Adjacent words are encoded together, the space between two
+		// encoded words is dropped when decoding
+		if needsEncoding(t) {
+			run = append(run, t)
+			continue
+		}
+		flush()
+		if ctx == commentContext {
+			t = escapeComment(t)
+		}
+		out = append(out, t)
+	}
+	flush()
+
+	return strings.Join(out, " ")
+}
+
+// needsEncoding reports whether a word can't be written as is. Words that
+// look like encoded words are encoded too, or they would be decoded
+func needsEncoding(word string) bool {
+	for i := 0; i < len(word); i++ {
+		c := word[i]
+		if c > '~' || c < ' ' && c != '\t' {
+			return true
+		}
+	}
+	return strings.Contains(word, "=?")
+}
+
+// encodeRun encodes s as one or more encoded words separated by spaces
+func encodeRun(s string, ctx wordContext) string {
+	qLen := 0
+	for i := 0; i < len(s); i++ {
+		qLen += len(qEncodeByte(s[i], ctx))
+	}
+	useQ := qLen <= base64.StdEncoding.EncodedLen(len(s))
+
+	var words []string
+	var sb strings.Builder
+	var chunk []byte
+
+	emit := func() {
+		if useQ {
+			words = append(words, "=?"+UTF8+"?q?"+sb.String()+"?=")
+			sb.Reset()
+		} else {
+			words = append(words, "=?"+UTF8+"?b?"+base64.StdEncoding.EncodeToString(chunk)+"?=")
+			chunk = chunk[:0]
+		}
+	}
+
+	for len(s) > 0 {
+		_, size := utf8.DecodeRuneInString(s)
+		char := s[:size]
+		s = s[size:]
+
+		if useQ {
+			var enc string
+			for i := 0; i < len(char); i++ {
+				enc += qEncodeByte(char[i], ctx)
+			}
+			if sb.Len() != 0 && sb.Len()+len(enc) > maxEncodedTextLen {
+				emit()
+			}
+			sb.WriteString(enc)
+		} else {
+			if len(chunk) != 0 && base64.StdEncoding.EncodedLen(len(chunk)+len(char)) > maxEncodedTextLen {
+				emit()
+			}
+			chunk = append(chunk, char...)
+		}
+	}
+	emit()
+
+	return strings.Join(words, " ")
+}
+
+const upperhex = "0123456789ABCDEF"
+
+// qEncodeByte returns the Q encoding of c, RFC 2047 section 4.2 and 5
+func qEncodeByte(c byte, ctx wordContext) string {
+	if c == ' ' {
+		return "_"
+	}
+
+	literal := false
+	switch ctx {
+	case textContext:
+		literal = c > ' ' && c <= '~' && c != '=' && c != '?' && c != '_'
+	case commentContext:
+		literal = c > ' ' && c <= '~' && !strings.ContainsRune("=?_()\"\\", rune(c))
+	case phraseContext:
+		literal = 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			strings.ContainsRune("!*+-/", rune(c))
+	}
+
+	if literal {
+		return string(c)
+	}
+	return "=" + string(upperhex[c>>4]) + string(upperhex[c&0x0f])
+}
+
+func isAtom(word string) bool {
+	for _, r := range word {
+		if !isAtext(r, false, false, false) {
+			return false
+		}
+	}
+	return true
+}
+
+func quoteString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(s[i])
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+func escapeComment(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "(", "\\(", ")", "\\)").Replace(s)
+}
+
+/*
+	FoldHeader formats a header field, folding the value on whitespace so that
+	lines stay within 78 columns where possible (RFC 5322 section 2.2.3).
+	Words are not split, except for a utf-8 encoded word right after the field
+	name, which is split in two encoded words when it doesn't fit. The value
+	should already be encoded, see EncodeText and EncodePhrase.
+
+	CR and LF in the value are replaced by spaces and invalid bytes are removed
+	from the name, so a value can't inject other header fields
+*/
+func FoldHeader(name, value string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < utf8.RuneSelf && validHeaderKeyByte(byte(r)) {
+			return r
+		}
+		return -1
+	}, name)
+	value = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(value)
+
+	var sb strings.Builder
+	sb.WriteString(name)
+	sb.WriteString(":")
+	lineLen := len(name) + 1
+
+	for i, word := range strings.Split(value, " ") {
+		fits := lineLen+1+len(word) <= foldColumns
+
+		// The field name can't be left alone on its line
+		if !fits && lineLen == len(name)+1 {
+			if first, rest, ok := splitEncodedWord(word, foldColumns-lineLen-1); ok {
+				sb.WriteString(" " + first + "\r\n")
+				word, lineLen = rest, 0
+			}
+		}
+
+		// Breaking before an empty word would leave a line of only
+		// whitespace
+		if i > 0 && word != "" && !fits && lineLen > len(name)+1 {
+			sb.WriteString("\r\n")
+			lineLen = 0
+		}
+		sb.WriteString(" ")
+		sb.WriteString(word)
+		lineLen += 1 + len(word)
+	}
+	sb.WriteString("\r\n")
+
+	return sb.String()
+}
+
+// splitEncodedWord splits a utf-8 encoded word in two on a character
+// boundary, the first one at most max long. The space between them is
+// dropped when decoding
+func splitEncodedWord(word string, max int) (string, string, bool) {
+	head := "=?" + UTF8 + "?"
+	if len(word) < len(head)+4 || !strings.EqualFold(word[:len(head)], head) ||
+		word[len(head)+1] != '?' || !strings.HasSuffix(word, "?=") {
+		return "", "", false
+	}
+	head = word[:len(head)+2]
+	text := word[len(head) : len(word)-2]
+	room := max - len(head) - len("?=")
+
+	split := 0
+	switch word[len(head)-2] {
+	case 'q', 'Q':
+		// Split after an encoded byte followed by the start of a rune
+		for i := 0; i < len(text); {
+			n := 1
+			if text[i] == '=' && i+2 < len(text) {
+				n = 3
+			}
+			if i+n > room {
+				break
+			}
+			i += n
+			if i == len(text) || text[i] != '=' || i+2 >= len(text) || runeStartHex(text[i+1:i+3]) {
+				split = i
+			}
+		}
+	case 'b', 'B':
+		raw, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return "", "", false
+		}
+		n := room / 4 * 3
+		for n > 0 && n < len(raw) && !utf8.RuneStart(raw[n]) {
+			n--
+		}
+		if n <= 0 || n >= len(raw) {
+			return "", "", false
+		}
+		return head + base64.StdEncoding.EncodeToString(raw[:n]) + "?=",
+			head + base64.StdEncoding.EncodeToString(raw[n:]) + "?=", true
+	}
+
+	if split == 0 || split == len(text) {
+		return "", "", false
+	}
+	return head + text[:split] + "?=", head + text[split:] + "?=", true
+}
+
+// runeStartHex reports whether the hex encoded byte of a Q encoded word
+// starts a utf-8 character
+func runeStartHex(h string) bool {
+	b := strings.IndexByte(upperhex, strings.ToUpper(h[:1])[0])
+	return b < 0 || utf8.RuneStart(byte(b<<4))
+}
@@ -0,0 +1,104 @@
+package rfc2822
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodeText(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"Hello World", "Hello World"},
+		{"Café", "=?utf-8?b?Q2Fmw6k=?="},
+		{"Zürich", "=?utf-8?q?Z=C3=BCrich?="},
+		{"Grüße aus Köln", "=?utf-8?b?R3LDvMOfZQ==?= aus =?utf-8?b?S8O2bG4=?="},
+		{"a =?x?q?y?= b", "a =?utf-8?b?PT94P3E/eT89?= b"},
+		{"Ünïcödé wörds", "=?utf-8?b?w5xuw69jw7Zkw6kgd8O2cmRz?="},
+	}
+
+	for _, tt := range tests {
+		if got := EncodeText(tt.in); got != tt.want {
+			t.Errorf("EncodeText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		if got := decodeHeader(EncodeText(tt.in)); got != tt.in {
+			t.Errorf("EncodeText(%q) decodes to %q", tt.in, got)
+		}
+	}
+}
+
+func TestEncodePhrase(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"John Doe", "John Doe"},
+		{"Doe, John", "\"Doe, John\""},
+		{"say \"hi\"", "\"say \\\"hi\\\"\""},
+		{"Jörg Müller", "=?utf-8?b?SsO2cmcgTcO8bGxlcg==?="},
+		{"Jörg, Müller", "=?utf-8?b?SsO2cmcsIE3DvGxsZXI=?="},
+	}
+
+	for _, tt := range tests {
+		if got := EncodePhrase(tt.in); got != tt.want {
+			t.Errorf("EncodePhrase(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeComment(t *testing.T) {
+	if got, want := EncodeComment("a (b) ü"), "a \\(b\\) =?utf-8?b?w7w=?="; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestEncodedWordLength(t *testing.T) {
+	for _, s := range []string{strings.Repeat("é", 100), strings.Repeat("aé", 100), strings.Repeat("日本語", 40)} {
+		enc := EncodeText(s)
+		for _, word := range strings.Split(enc, " ") {
+			if len(word) > maxEncodedWordLen {
+				t.Errorf("encoded word of %d octets: %q", len(word), word)
+			}
+		}
+		if got := decodeHeader(enc); got != s {
+			t.Errorf("got %q decoded, want %q", got, s)
+		}
+	}
+}
+
+func TestFoldHeader(t *testing.T) {
+	value := strings.Repeat("word ", 30) + "end"
+	folded := FoldHeader("Subject", value)
+
+	for _, line := range strings.Split(strings.TrimSuffix(folded, "\r\n"), "\r\n") {
+		if len(line) > foldColumns {
+			t.Errorf("line of %d columns: %q", len(line), line)
+		}
+	}
+	f := HeaderField{Value: fieldValue([]byte(folded))}
+	if f.Unfolded() != value {
+		t.Errorf("got %q unfolded, want %q", f.Unfolded(), value)
+	}
+
+	// A long encoded word is split rather than left after the name
+	long := EncodeText(strings.Repeat("ü", 30))
+	folded = FoldHeader("Subject", long)
+	for _, line := range strings.Split(strings.TrimSuffix(folded, "\r\n"), "\r\n") {
+		if len(line) > foldColumns {
+			t.Errorf("line of %d columns: %q", len(line), line)
+		}
+	}
+	if got := decodeHeader(HeaderField{Value: fieldValue([]byte(folded))}.Unfolded()); got != strings.Repeat("ü", 30) {
+		t.Errorf("got %q decoded", got)
+	}
+}
+
+func TestFoldHeaderInjection(t *testing.T) {
+	if got := FoldHeader("Subject", "a\r\nBcc: x@example.com"); got != "Subject: a Bcc: x@example.com\r\n" {
+		t.Errorf("got %q", got)
+	}
+	if got := FoldHeader("X-Bad\r\nBcc", "x"); got != "X-BadBcc: x\r\n" {
+		t.Errorf("got %q", got)
+	}
+}
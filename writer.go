@@ -0,0 +1,433 @@
+package rfc2822
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"strings"
+)
+
+var ErrNoRawSource = errors.New("Raw body not retained, parse with WithRawRetained")
+var errNotLeaf = errors.New("Body can only be set on a part without child nodes")
+
+/*
+	WriteMessage writes the node and its child nodes as an RFC 5322 message.
+
+	Parts which were not modified are copied byte by byte from the parsed
+	message, so an unmodified message round trips exactly. Modified parts
+	keep their raw header fields and only regenerate what changed.
+	Parsed nodes need the raw message, see WithRawRetained.
+
+	It is not named WriteTo on purpose: Node is the body reader of the
+	BodyCallback, io.Copy(w, node) has to copy the body
+*/
+func (n *Node) WriteMessage(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	n.writeExact(cw)
+	return cw.n, cw.err
+}
+
+// WriteNormalized writes the node and its child nodes with header fields
+// refolded, bodies encoded again, CRLF line endings and regenerated
+// boundary delimiters
+func (n *Node) WriteNormalized(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	n.writeNormalized(cw)
+
+	// A message ends with a line break
+	if cw.err == nil && cw.n > 0 && cw.last != '\n' {
+		cw.write([]byte("\r\n"))
+	}
+	return cw.n, cw.err
+}
+
+// SetHeader replaces all the fields called name with a single field, which
+// takes the place of the first one. Changing the Content-Transfer-Encoding
+// of a parsed part encodes its body again, a body which can't be decoded
+// with the previous encoding is written as it was
+func (n *Node) SetHeader(name, value string) {
+	field := newHeaderField(name, value)
+
+	fields := make([]HeaderField, 0, len(n.RawHeaders)+1)
+	replaced := false
+	for _, f := range n.RawHeaders {
+		if !strings.EqualFold(f.Name, name) {
+			fields = append(fields, f)
+		} else if !replaced {
+			fields = append(fields, field)
+			replaced = true
+		}
+	}
+	if !replaced {
+		fields = append(fields, field)
+	}
+
+	n.RawHeaders = fields
+	n.headerChanged(name)
+}
+
+// AddHeader adds a field after all the other fields
+func (n *Node) AddHeader(name, value string) {
+	n.RawHeaders = append(n.RawHeaders, newHeaderField(name, value))
+	n.headerChanged(name)
+}
+
+// PrependHeader adds a field before all the other fields, the place for
+// trace fields like Received
+func (n *Node) PrependHeader(name, value string) {
+	n.RawHeaders = append([]HeaderField{newHeaderField(name, value)}, n.RawHeaders...)
+	n.headerChanged(name)
+}
+
+// DelHeader removes all the fields called name
+func (n *Node) DelHeader(name string) {
+	fields := n.RawHeaders[:0:0]
+	for _, f := range n.RawHeaders {
+		if !strings.EqualFold(f.Name, name) {
+			fields = append(fields, f)
+		}
+	}
+	n.RawHeaders = fields
+	n.headerChanged(name)
+}
+
+// SetBody replaces the decoded body of a part. It is encoded with the
+// Content-Transfer-Encoding of the part when written
+func (n *Node) SetBody(body []byte) error {
+	if len(n.ChildNodes) != 0 {
+		return errNotLeaf
+	}
+	n.newBody = body
+	n.dirty = true
+	return nil
+}
+
+// headerChanged updates the ParsedHeader view for name
+func (n *Node) headerChanged(name string) {
+	n.dirty = true
+
+	key := strings.ToLower(name)
+	var values []string
+	for i := len(n.RawHeaders) - 1; i >= 0; i-- {
+		if strings.EqualFold(n.RawHeaders[i].Name, name) {
+			values = append(values, n.RawHeaders[i].Unfolded())
+		}
+	}
+
+	if key == "content-transfer-encoding" {
+		n.reencodeBody(values)
+	}
+
+	if n.ParsedHeader == nil {
+		n.ParsedHeader = map[string][]string{}
+	}
+	if len(values) == 0 {
+		delete(n.ParsedHeader, key)
+	} else {
+		n.ParsedHeader[key] = values
+	}
+}
+
+// reencodeBody decodes the parsed body of a leaf part whose
+// Content-Transfer-Encoding changes to values, it is then written with the
+// new encoding like a body given to SetBody
+func (n *Node) reencodeBody(values []string) {
+	enc := ""
+	if len(values) != 0 {
+		enc = strings.TrimSpace(values[0])
+	}
+	prev := n.contentTransferEncoding()
+	if strings.EqualFold(enc, prev) || n.newBody != nil || n.source == nil || len(n.ChildNodes) != 0 || n.Boundary != "" {
+		return
+	}
+
+	dec, err := encodingReader(prev, bytes.NewReader(n.source[n.BodyStart:n.BodyEnd]))
+	if err != nil {
+		return
+	}
+	body, err := ioutil.ReadAll(dec)
+	if err != nil {
+		return
+	}
+	n.newBody = body
+}
+
+func newHeaderField(name, value string) HeaderField {
+	raw := []byte(FoldHeader(name, value))
+	return HeaderField{
+		Name:   name,
+		Value:  fieldValue(raw),
+		Raw:    raw,
+		Offset: -1,
+	}
+}
+
+// pristine reports whether n and its child nodes can be copied from the
+// parsed message as they are
+func (n *Node) pristine() bool {
+	if n.source == nil || n.dirty || !n.originalChildren() {
+		return false
+	}
+	for _, c := range n.ChildNodes {
+		if !c.pristine() {
+			return false
+		}
+	}
+	return true
+}
+
+// originalChildren reports whether the child nodes are the ones parsed,
+// in the same order, so that the bytes between them can be reused
+func (n *Node) originalChildren() bool {
+	for i, c := range n.ChildNodes {
+		if c.source == nil || len(c.Path) == 0 || c.Path[len(c.Path)-1] != i+1 {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *Node) writeExact(w *countingWriter) {
+	if n.pristine() {
+		w.write(n.source[n.HeaderStart:n.BodyEnd])
+		return
+	}
+
+	for _, f := range n.RawHeaders {
+		w.write(f.Raw)
+	}
+	w.write(n.headerTerminator())
+	w.bodyStart = w.n
+
+	switch {
+	case len(n.ChildNodes) != 0 && n.source != nil && n.originalChildren():
+		// Keep preamble, delimiters and epilogue as they were
+		pos := n.BodyStart
+		for _, c := range n.ChildNodes {
+			w.write(n.source[pos:c.HeaderStart])
+			c.writeExact(w)
+			pos = c.BodyEnd
+		}
+		w.write(n.source[pos:n.BodyEnd])
+	case n.Boundary != "" || n.IsMessage() && len(n.ChildNodes) != 0:
+		n.writeChildren(w, (*Node).writeExact)
+	case n.newBody != nil:
+		n.writeEncodedBody(w, n.newBody)
+	case n.source != nil:
+		w.write(n.source[n.BodyStart:n.BodyEnd])
+	case n.RawSize != 0:
+		w.fail(ErrNoRawSource)
+	}
+}
+
+func (n *Node) writeNormalized(w *countingWriter) {
+	for _, f := range n.RawHeaders {
+		// Lines without a ':' can't be written back as a field
+		if f.hasColon() {
+			w.write([]byte(FoldHeader(f.Name, f.Unfolded())))
+		}
+	}
+	w.write([]byte("\r\n"))
+	w.bodyStart = w.n
+
+	if n.Boundary != "" || n.IsMessage() && len(n.ChildNodes) != 0 {
+		n.writeChildren(w, (*Node).writeNormalized)
+		return
+	}
+
+	body := n.newBody
+	if body == nil {
+		if n.source == nil {
+			if n.RawSize != 0 {
+				w.fail(ErrNoRawSource)
+			}
+			return
+		}
+
+		dec, err := encodingReader(n.contentTransferEncoding(), bytes.NewReader(n.source[n.BodyStart:n.BodyEnd]))
+		if err != nil {
+			// Unknown encoding, nothing to normalize
+			w.write(n.source[n.BodyStart:n.BodyEnd])
+			return
+		}
+		body, err = ioutil.ReadAll(dec)
+		if err != nil {
+			w.fail(err)
+			return
+		}
+	}
+
+	n.writeEncodedBody(w, body)
+}
+
+// writeChildren writes the body of a multipart or message/rfc822 node
+// with generated delimiters
+func (n *Node) writeChildren(w *countingWriter, writeChild func(*Node, *countingWriter)) {
+	if n.Boundary == "" {
+		// message/rfc822, the body is the encapsulated message
+		for _, c := range n.ChildNodes {
+			writeChild(c, w)
+		}
+		return
+	}
+
+	dashBoundary := []byte("--" + n.Boundary)
+
+	if n.Preamble != "" {
+		w.write(toCRLF([]byte(n.Preamble)))
+		if w.last != '\n' {
+			w.write([]byte("\r\n"))
+		}
+	}
+
+	for i, c := range n.ChildNodes {
+		if i > 0 {
+			w.delimiterBreak()
+		}
+		w.write(dashBoundary)
+		w.write([]byte("\r\n"))
+		writeChild(c, w)
+	}
+
+	if len(n.ChildNodes) != 0 {
+		w.delimiterBreak()
+	}
+	w.write(dashBoundary)
+	w.write([]byte("--"))
+
+	// Like a body, the part ends without its last line break, which
+	// belongs to the next delimiter
+	if n.Epilogue != "" {
+		epilogue := []byte(n.Epilogue)
+		w.write([]byte("\r\n"))
+		w.write(toCRLF(epilogue[:len(epilogue)-trailingLineBreakLen(epilogue, false)]))
+	}
+}
+
+func (n *Node) writeEncodedBody(w *countingWriter, body []byte) {
+	switch strings.ToLower(n.contentTransferEncoding()) {
+	case "base64":
+		enc := base64.StdEncoding.EncodeToString(body)
+		for len(enc) > 76 {
+			w.write([]byte(enc[:76]))
+			w.write([]byte("\r\n"))
+			enc = enc[76:]
+		}
+		w.write([]byte(enc))
+	case "quoted-printable":
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write(body); err != nil {
+			w.fail(err)
+			return
+		}
+		if err := qp.Close(); err != nil {
+			w.fail(err)
+		}
+	case "binary":
+		w.write(body)
+	default:
+		w.write(toCRLF(body))
+	}
+}
+
+func (n *Node) contentTransferEncoding() string {
+	if enc, ok := n.ParsedHeader["content-transfer-encoding"]; ok && len(enc) != 0 {
+		return strings.TrimSpace(enc[0])
+	}
+	return ""
+}
+
+// rawBody returns the body of n as WriteMessage writes it, which is the body
+// as it was parsed when nothing was modified
+func (n *Node) rawBody() ([]byte, error) {
+	if n.pristine() {
+		return n.source[n.BodyStart:n.BodyEnd], nil
+	}
+
+	var buf bytes.Buffer
+	if _, err := n.WriteMessage(&buf); err != nil {
+		return nil, err
+	}
+	headerLen := len(n.headerTerminator())
+	for _, f := range n.RawHeaders {
+		headerLen += len(f.Raw)
+	}
+	return buf.Bytes()[headerLen:], nil
+}
+
+// headerTerminator returns the empty line which ended the parsed header
+func (n *Node) headerTerminator() []byte {
+	if n.source != nil {
+		if n.BodyStart >= 2 && bytes.Equal(n.source[n.BodyStart-2:n.BodyStart], []byte("\r\n")) {
+			return []byte("\r\n")
+		}
+		if n.BodyStart >= 1 && n.source[n.BodyStart-1] == '\n' {
+			return []byte("\n")
+		}
+		// Header ended at EOF, there was no empty line
+		return nil
+	}
+	return []byte("\r\n")
+}
+
+// toCRLF converts bare LF line endings to CRLF
+func toCRLF(b []byte) []byte {
+	if !bytes.Contains(b, []byte("\n")) {
+		return b
+	}
+	out := make([]byte, 0, len(b)+bytes.Count(b, []byte("\n")))
+	for i, c := range b {
+		if c == '\n' && (i == 0 || b[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// countingWriter counts the written bytes and keeps the first error, so
+// that the writers above don't have to check every write
+type countingWriter struct {
+	w    io.Writer
+	n    int64
+	err  error
+	last byte
+	// Offset after the last header written
+	bodyStart int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.write(p)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return len(p), nil
+}
+
+func (c *countingWriter) write(p []byte) {
+	if c.err != nil || len(p) == 0 {
+		return
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	c.last = p[len(p)-1]
+}
+
+// delimiterBreak writes the line break preceding a boundary delimiter. An
+// empty body is left without one, the empty line ending the header
+// already precedes the delimiter
+func (c *countingWriter) delimiterBreak() {
+	if c.n != c.bodyStart {
+		c.write([]byte("\r\n"))
+	}
+}
+
+func (c *countingWriter) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
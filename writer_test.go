@@ -0,0 +1,253 @@
+package rfc2822
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+var roundTripMessages = map[string]string{
+	"simple": "From: a@example.com\r\n" +
+		"Subject: simple\r\n" +
+		"\r\n" +
+		"body\r\n",
+	"lf": "From: a@example.com\n" +
+		"Subject: lf\n" +
+		"\n" +
+		"body\n",
+	"multipart": "Subject: multipart\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b\"\r\n" +
+		"\r\n" +
+		"preamble\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"one\r\n" +
+		"--b   \r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"aGVsbG8=\r\n" +
+		"--b--\r\n" +
+		"epilogue\r\n",
+	"encapsulated": "Subject: outer\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"\r\n" +
+		"Subject: inner\r\n" +
+		"Content-Type: multipart/alternative; boundary=c\r\n" +
+		"\r\n" +
+		"--c\r\n" +
+		"\r\n" +
+		"inner body\r\n" +
+		"--c--\r\n" +
+		"--b--\r\n",
+	"no body": "Subject: no body\r\n",
+	"empty part": "Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"--b--\r\n",
+}
+
+func TestWriteMessageRoundTrip(t *testing.T) {
+	for name, msg := range roundTripMessages {
+		for _, bc := range []BodyCallback{nil, readAllCallback} {
+			root, err := ParseMime(strings.NewReader(msg), bc, nil, false, WithRawRetained())
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", name, err)
+			}
+
+			var buf bytes.Buffer
+			n, err := root.WriteMessage(&buf)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", name, err)
+			}
+			if buf.String() != msg || n != int64(len(msg)) {
+				t.Errorf("%s: got %q (%d bytes), want %q", name, buf.String(), n, msg)
+			}
+		}
+	}
+}
+
+// Node is the body reader handed to the callback, copying it must copy the
+// decoded body and not the serialized part
+func TestNodeIsNotWriterTo(t *testing.T) {
+	if _, ok := interface{}(&Node{}).(io.WriterTo); ok {
+		t.Fatal("Node implements io.WriterTo, io.Copy would not read the body")
+	}
+
+	var bodies []string
+	root, err := ParseMime(strings.NewReader(roundTripMessages["multipart"]), func(n *Node) error {
+		var buf bytes.Buffer
+		_, err := io.Copy(&buf, n)
+		bodies = append(bodies, buf.String())
+		return err
+	}, nil, false, WithRawRetained())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(bodies) != 2 || bodies[0] != "one" || bodies[1] != "hello" {
+		t.Errorf("got bodies %q", bodies)
+	}
+
+	// Bodies left unread are drained by the parser
+	root, err = ParseMime(strings.NewReader(roundTripMessages["multipart"]), nil, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if root.ChildNodes[0].Size != 3 || root.ChildNodes[1].Size != 5 {
+		t.Errorf("got sizes %d and %d, want 3 and 5", root.ChildNodes[0].Size, root.ChildNodes[1].Size)
+	}
+}
+
+func TestWriteMessageWithoutSource(t *testing.T) {
+	root, err := ParseMime(strings.NewReader(roundTripMessages["simple"]), nil, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := root.WriteMessage(ioutil.Discard); !errors.Is(err, ErrNoRawSource) {
+		t.Errorf("got error %v, want %v", err, ErrNoRawSource)
+	}
+}
+
+func TestWriteMessageModified(t *testing.T) {
+	root, err := ParseMime(strings.NewReader(roundTripMessages["multipart"]), nil, nil, false, WithRawRetained())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	root.SetHeader("Subject", "changed")
+	root.PrependHeader("Received", "from x by y")
+	if err := root.ChildNodes[1].SetBody([]byte("bye")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := root.WriteMessage(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "Received: from x by y\r\n" +
+		strings.Replace(roundTripMessages["multipart"], "Subject: multipart", "Subject: changed", 1)
+	want = strings.Replace(want, "aGVsbG8=", "Ynll", 1)
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+	if got := root.ParsedHeader["subject"]; len(got) != 1 || got[0] != "changed" {
+		t.Errorf("got subject %v", got)
+	}
+}
+
+func TestWriteMessageTransferEncodingChanged(t *testing.T) {
+	tests := []struct {
+		name string
+		part int
+		set  func(n *Node)
+		want string
+	}{
+		{"base64 to 7bit", 1, func(n *Node) { n.SetHeader("Content-Transfer-Encoding", "7bit") },
+			"Content-Transfer-Encoding: 7bit\r\n\r\nhello"},
+		{"7bit to base64", 0, func(n *Node) { n.AddHeader("Content-Transfer-Encoding", "base64") },
+			"Content-Transfer-Encoding: base64\r\n\r\nb25l"},
+		{"removed", 1, func(n *Node) { n.DelHeader("Content-Transfer-Encoding") },
+			"Content-Type: application/octet-stream\r\n\r\nhello"},
+		// Same encoding, the body is copied as it was
+		{"unchanged", 1, func(n *Node) { n.SetHeader("Content-Transfer-Encoding", "BASE64") },
+			"Content-Transfer-Encoding: BASE64\r\n\r\naGVsbG8="},
+	}
+
+	for _, tt := range tests {
+		root, err := ParseMime(strings.NewReader(roundTripMessages["multipart"]), nil, nil, false, WithRawRetained())
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		tt.set(root.ChildNodes[tt.part])
+
+		var buf bytes.Buffer
+		if _, err := root.WriteMessage(&buf); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if !strings.Contains(buf.String(), tt.want+"\r\n--b") {
+			t.Errorf("%s: got %q, want it to contain %q", tt.name, buf.String(), tt.want)
+		}
+
+		// The new encoding is read back as the same body
+		var body []byte
+		_, err = ParseMime(bytes.NewReader(buf.Bytes()), func(n *Node) (err error) {
+			if n.Path[len(n.Path)-1] == tt.part+1 {
+				body, err = ioutil.ReadAll(n)
+			}
+			return err
+		}, nil, false)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if want := []string{"one", "hello"}[tt.part]; string(body) != want {
+			t.Errorf("%s: got body %q, want %q", tt.name, body, want)
+		}
+	}
+}
+
+func TestWriteNormalized(t *testing.T) {
+	msg := "Subject: a long subject which is folded\n" +
+		" in the original message\n" +
+		"Content-Type: multipart/mixed; boundary=b\n" +
+		"\n" +
+		"--b\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"one\n" +
+		"two\n" +
+		"--b\n" +
+		"Content-Type: text/plain\n" +
+		"Content-Transfer-Encoding: base64\n" +
+		"\n" +
+		"aGVs\n" +
+		"bG8=\n" +
+		"--b--\n"
+
+	root, err := ParseMime(strings.NewReader(msg), nil, nil, false, WithRawRetained())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := root.WriteNormalized(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "Subject: a long subject which is folded in the original message\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"one\r\n" +
+		"two\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"aGVsbG8=\r\n" +
+		"--b--\r\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+
+	// The normalized message is a fixed point
+	again, err := ParseMime(strings.NewReader(want), nil, nil, false, WithRawRetained())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var buf2 bytes.Buffer
+	if _, err := again.WriteNormalized(&buf2); err != nil || buf2.String() != want {
+		t.Errorf("got %q, %v when normalizing again", buf2.String(), err)
+	}
+}